@@ -1,6 +1,7 @@
 package backoff
 
 import (
+	"errors"
 	"time"
 
 	"github.com/utilitywarehouse/semaphore-wireguard/log"
@@ -14,6 +15,30 @@ const (
 	defaultBackoffMax    = 1 * time.Minute
 )
 
+// PermanentError wraps an error that retrying the operation cannot fix.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// Permanent wraps err so that the operation returning it is not retried.
+func Permanent(err error) error {
+	return &PermanentError{Err: err}
+}
+
+// IsPermanent returns true if err or any error it wraps is permanent.
+func IsPermanent(err error) bool {
+	var permanent *PermanentError
+	return errors.As(err, &permanent)
+}
+
 // Retry will use the default backoff values to retry the passed operation
 func Retry(op operation, description string) {
 	b := &Backoff{
@@ -24,21 +49,54 @@ func Retry(op operation, description string) {
 	RetryWithBackoff(op, b, description)
 }
 
+// RetryUntil will use the default backoff values to retry the passed operation
+// until the stop channel is closed
+func RetryUntil(op operation, stop <-chan struct{}, description string) {
+	b := &Backoff{
+		Jitter: defaultBackoffJitter,
+		Min:    defaultBackoffMin,
+		Max:    defaultBackoffMax,
+	}
+	retry(op, b, stop, description)
+}
+
 // RetryWithBackoff will retry the passed function (operation) using the given
-// backoff
+// backoff, until it succeeds or returns a permanent error
 func RetryWithBackoff(op operation, b *Backoff, description string) {
+	retry(op, b, nil, description)
+}
+
+// retry retries the operation using the given backoff, until it succeeds,
+// returns a permanent error or the stop channel, if not nil, is closed.
+func retry(op operation, b *Backoff, stop <-chan struct{}, description string) {
 	b.Reset()
 	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
 		err := op()
 		if err == nil {
 			return
 		}
+		if IsPermanent(err) {
+			log.Logger.Error("Giving up retrying",
+				"description", description,
+				"error", err,
+			)
+			return
+		}
 		d := b.Duration()
 		log.Logger.Error("Retry failed",
 			"description", description,
 			"error", err,
 			"backoff", d,
 		)
-		time.Sleep(d)
+		select {
+		case <-time.After(d):
+		case <-stop:
+			return
+		}
 	}
 }
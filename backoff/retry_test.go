@@ -2,6 +2,7 @@ package backoff
 
 import (
 	"errors"
+	"fmt"
 	"testing"
 	"time"
 
@@ -37,3 +38,49 @@ func TestRetryWithBackoff(t *testing.T) {
 	assert.Equal(t, testFuncCallCounter, 3)            // should be 3 after 2 consecutive fails
 	assert.Equal(t, b.Duration(), 40*time.Millisecond) // should be 40 millisec after failing for 10 and 20 and without a jitter
 }
+
+func TestRetryWithBackoffPermanent(t *testing.T) {
+	log.InitLogger("retry-test", "info")
+	b := &Backoff{
+		Jitter: false,
+		Min:    10 * time.Millisecond,
+		Max:    1 * time.Second,
+	}
+	calls := 0
+	RetryWithBackoff(func() error {
+		calls++
+		return fmt.Errorf("wrapped: %w", Permanent(errors.New("error")))
+	}, b, "test func")
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, true, IsPermanent(Permanent(errors.New("error"))))
+	assert.Equal(t, false, IsPermanent(errors.New("error")))
+}
+
+func TestRetryUntilStop(t *testing.T) {
+	log.InitLogger("retry-test", "info")
+	stop := make(chan struct{})
+	calls := 0
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Stopping while waiting for the (2s) default backoff returns
+		// without another attempt
+		RetryUntil(func() error {
+			calls++
+			close(stop)
+			return errors.New("error")
+		}, stop, "test func")
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("RetryUntil did not return after stop")
+	}
+	assert.Equal(t, 1, calls)
+	// A closed stop channel prevents any attempt
+	RetryUntil(func() error {
+		calls++
+		return nil
+	}, stop, "test func")
+	assert.Equal(t, 1, calls)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Reasons for peer collisions.
+const (
+	collisionPublicKey  = "publicKey"
+	collisionAllowedIPs = "allowedIPs"
+)
+
+// PeerCollision describes a set of remote nodes that advertise conflicting wg
+// peer config and are thus refused as peers.
+type PeerCollision struct {
+	Reason string   `json:"reason"`
+	Value  string   `json:"value"`
+	Nodes  []string `json:"nodes"`
+}
+
+func (c PeerCollision) String() string {
+	return fmt.Sprintf("%s %s advertised by %s", c.Reason, c.Value, strings.Join(c.Nodes, ", "))
+}
+
+// filterCollisions takes peers keyed by node name and returns them keyed by
+// public key, excluding the peers of nodes that advertise the same public key
+// or overlapping allowed IPs, along with the detected collisions. Allowed IPs
+// that cannot be parsed are ignored here and left to fail the peer config.
+func filterCollisions(nodePeers map[string]Peer) (map[string]Peer, []PeerCollision) {
+	nodes := make([]string, 0, len(nodePeers))
+	for node := range nodePeers {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	var collisions []PeerCollision
+	refused := map[string]bool{}
+
+	byKey := map[string][]string{}
+	var keys []string
+	for _, node := range nodes {
+		key := nodePeers[node].publicKey
+		if _, ok := byKey[key]; !ok {
+			keys = append(keys, key)
+		}
+		byKey[key] = append(byKey[key], node)
+	}
+	for _, key := range keys {
+		if len(byKey[key]) < 2 {
+			continue
+		}
+		collisions = append(collisions, PeerCollision{Reason: collisionPublicKey, Value: key, Nodes: byKey[key]})
+		for _, node := range byKey[key] {
+			refused[node] = true
+		}
+	}
+
+	allowedNets := make(map[string][]*net.IPNet, len(nodes))
+	for _, node := range nodes {
+		allowedNets[node] = parseAllowedIPs(nodePeers[node].allowedIPs)
+	}
+	for i, a := range nodes {
+		for _, b := range nodes[i+1:] {
+			if overlap := overlappingAllowedIPs(allowedNets[a], allowedNets[b]); overlap != "" {
+				collisions = append(collisions, PeerCollision{Reason: collisionAllowedIPs, Value: overlap, Nodes: []string{a, b}})
+				refused[a] = true
+				refused[b] = true
+			}
+		}
+	}
+
+	peers := map[string]Peer{}
+	for _, node := range nodes {
+		if refused[node] {
+			continue
+		}
+		peer := nodePeers[node]
+		peers[peer.publicKey] = peer
+	}
+	return peers, collisions
+}
+
+// parseAllowedIPs returns the networks of the allowed IPs, skipping the ones
+// that cannot be parsed.
+func parseAllowedIPs(allowedIPs []string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, ip := range allowedIPs {
+		if _, n, err := net.ParseCIDR(ip); err == nil {
+			nets = append(nets, n)
+		}
+	}
+	return nets
+}
+
+// overlappingAllowedIPs returns the first network of a that overlaps with any
+// of the networks of b, or an empty string if there is no overlap.
+func overlappingAllowedIPs(a, b []*net.IPNet) string {
+	for _, x := range a {
+		for _, y := range b {
+			if subnetsOverlap(x, y) {
+				return x.String()
+			}
+		}
+	}
+	return ""
+}
+
+// inCollision returns true if the node was refused as a peer because of a
+// collision in the last sync.
+func inCollision(collisions []PeerCollision, nodeName string) bool {
+	for _, c := range collisions {
+		for _, n := range c.Nodes {
+			if n == nodeName {
+				return true
+			}
+		}
+	}
+	return false
+}
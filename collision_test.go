@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterCollisions(t *testing.T) {
+	nodePeers := map[string]Peer{
+		"node-a": {nodeName: "node-a", publicKey: "key-a", allowedIPs: []string{"10.4.0.0/24"}},
+		"node-b": {nodeName: "node-b", publicKey: "key-b", allowedIPs: []string{"10.4.1.0/24"}},
+		"node-c": {nodeName: "node-c", publicKey: "key-b", allowedIPs: []string{"10.4.2.0/24"}},
+		"node-d": {nodeName: "node-d", publicKey: "key-d", allowedIPs: []string{"10.4.3.0/24", "100.64.0.1/32"}},
+		"node-e": {nodeName: "node-e", publicKey: "key-e", allowedIPs: []string{"10.4.0.0/16"}},
+		"node-f": {nodeName: "node-f", publicKey: "key-f", allowedIPs: []string{"10.5.0.0/24"}},
+	}
+	peers, collisions := filterCollisions(nodePeers)
+	assert.Equal(t, map[string]Peer{
+		"key-f": nodePeers["node-f"],
+	}, peers)
+	assert.Equal(t, []PeerCollision{
+		{Reason: collisionPublicKey, Value: "key-b", Nodes: []string{"node-b", "node-c"}},
+		{Reason: collisionAllowedIPs, Value: "10.4.0.0/24", Nodes: []string{"node-a", "node-e"}},
+		{Reason: collisionAllowedIPs, Value: "10.4.1.0/24", Nodes: []string{"node-b", "node-e"}},
+		{Reason: collisionAllowedIPs, Value: "10.4.2.0/24", Nodes: []string{"node-c", "node-e"}},
+		{Reason: collisionAllowedIPs, Value: "10.4.3.0/24", Nodes: []string{"node-d", "node-e"}},
+	}, collisions)
+
+	peers, collisions = filterCollisions(map[string]Peer{
+		"node-a": nodePeers["node-a"],
+		"node-f": nodePeers["node-f"],
+	})
+	assert.Equal(t, 2, len(peers))
+	assert.Equal(t, 0, len(collisions))
+}
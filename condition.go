@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// nodeConditionPattern is the type of the local node condition that
+	// reports the health of the mesh with a remote cluster.
+	nodeConditionPattern = "SemaphoreWireguardReady/%s"
+	// nodeConditionPeriod is the interval to update the node condition.
+	nodeConditionPeriod = time.Minute
+	// staleHandshakeAge is the age after which a peer's last handshake is
+	// considered stale. Peers rekey every 2 minutes while there is traffic,
+	// and with a persistent keepalive there always is. Idle peers without a
+	// keepalive do not handshake at all.
+	staleHandshakeAge = 3 * time.Minute
+)
+
+// Reasons of the node condition.
+const (
+	conditionReasonInitialising = "Initialising"
+	conditionReasonStartFailed  = "StartFailed"
+	conditionReasonSyncFailed   = "SyncFailed"
+	conditionReasonPeersSynced  = "PeersSynced"
+)
+
+// meshHealth is a snapshot of a runner's state, as reported by its node
+// condition.
+type meshHealth struct {
+	startErr     error // Permanent error that the runner failed to start with
+	initialised  bool
+	lastSync     time.Time // Time of the last successful peers sync
+	syncErr      error     // Error of the last peers sync attempt
+	peers        int
+	invalidPeers int
+	stalePeers   []string
+}
+
+// nodeCondition returns the node condition for the health of the mesh with
+// the remote cluster. The caller is responsible for setting the transition
+// time.
+func nodeCondition(remoteClusterName string, h meshHealth, now time.Time) v1.NodeCondition {
+	condition := v1.NodeCondition{
+		Type:   v1.NodeConditionType(fmt.Sprintf(nodeConditionPattern, remoteClusterName)),
+		Status: v1.ConditionFalse,
+	}
+	condition.LastHeartbeatTime.Time = now
+	switch {
+	case h.startErr != nil:
+		condition.Reason = conditionReasonStartFailed
+		condition.Message = "Cannot start: " + h.startErr.Error()
+		return condition
+	case !h.initialised || (h.lastSync.IsZero() && h.syncErr == nil):
+		condition.Reason = conditionReasonInitialising
+		condition.Message = "Waiting for the first peers sync"
+		return condition
+	case h.syncErr != nil:
+		condition.Reason = conditionReasonSyncFailed
+	default:
+		condition.Status = v1.ConditionTrue
+		condition.Reason = conditionReasonPeersSynced
+	}
+	msg := []string{fmt.Sprintf("%d peers", h.peers)}
+	if len(h.stalePeers) > 0 {
+		msg = append(msg, fmt.Sprintf("%d stale (%s)", len(h.stalePeers), strings.Join(h.stalePeers, ", ")))
+	}
+	if h.invalidPeers > 0 {
+		msg = append(msg, fmt.Sprintf("%d invalid", h.invalidPeers))
+	}
+	if h.lastSync.IsZero() {
+		msg = append(msg, "never synced")
+	} else {
+		msg = append(msg, "last sync "+h.lastSync.UTC().Format(time.RFC3339))
+	}
+	if h.syncErr != nil {
+		msg = append(msg, "error: "+h.syncErr.Error())
+	}
+	condition.Message = strings.Join(msg, ", ")
+	return condition
+}
+
+// stalePeers returns the names of the nodes whose peers have not completed a
+// handshake within staleHandshakeAge, while they should have: peers with a
+// persistent keepalive, or that sent traffic since the previous check, as
+// given by their transmitted bytes then. Device peers that the runner does not
+// expect are ignored.
+func stalePeers(peers map[string]Peer, devicePeers []wgtypes.Peer, lastTransmit map[string]int64, now time.Time) []string {
+	var stale []string
+	for _, dp := range devicePeers {
+		key := dp.PublicKey.String()
+		p, ok := peers[key]
+		if !ok {
+			continue
+		}
+		active := dp.PersistentKeepaliveInterval > 0 || dp.TransmitBytes > lastTransmit[key]
+		if active && now.Sub(dp.LastHandshakeTime) > staleHandshakeAge {
+			stale = append(stale, p.nodeName)
+		}
+	}
+	sort.Strings(stale)
+	return stale
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestNodeCondition(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	c := nodeCondition("remote", meshHealth{}, now)
+	assert.Equal(t, v1.NodeConditionType("SemaphoreWireguardReady/remote"), c.Type)
+	assert.Equal(t, v1.ConditionFalse, c.Status)
+	assert.Equal(t, conditionReasonInitialising, c.Reason)
+	assert.Equal(t, now, c.LastHeartbeatTime.Time)
+
+	c = nodeCondition("remote", meshHealth{
+		initialised:  true,
+		lastSync:     now.Add(-time.Minute),
+		peers:        3,
+		invalidPeers: 1,
+		stalePeers:   []string{"node-a"},
+	}, now)
+	assert.Equal(t, v1.ConditionTrue, c.Status)
+	assert.Equal(t, conditionReasonPeersSynced, c.Reason)
+	assert.Equal(t, "3 peers, 1 stale (node-a), 1 invalid, last sync 2026-01-02T03:03:05Z", c.Message)
+
+	c = nodeCondition("remote", meshHealth{
+		initialised: true,
+		syncErr:     fmt.Errorf("boom"),
+	}, now)
+	assert.Equal(t, v1.ConditionFalse, c.Status)
+	assert.Equal(t, conditionReasonSyncFailed, c.Reason)
+	assert.Equal(t, "0 peers, never synced, error: boom", c.Message)
+
+	c = nodeCondition("remote", meshHealth{
+		startErr: fmt.Errorf("overlap"),
+	}, now)
+	assert.Equal(t, v1.ConditionFalse, c.Status)
+	assert.Equal(t, conditionReasonStartFailed, c.Reason)
+	assert.Equal(t, "Cannot start: overlap", c.Message)
+}
+
+func TestStalePeers(t *testing.T) {
+	now := time.Now()
+	keyA, _ := wgtypes.GeneratePrivateKey()
+	keyB, _ := wgtypes.GeneratePrivateKey()
+	keyC, _ := wgtypes.GeneratePrivateKey()
+	keyD, _ := wgtypes.GeneratePrivateKey()
+	keyE, _ := wgtypes.GeneratePrivateKey()
+	keyF, _ := wgtypes.GeneratePrivateKey()
+	peers := map[string]Peer{
+		keyA.PublicKey().String(): {nodeName: "node-a"},
+		keyB.PublicKey().String(): {nodeName: "node-b"},
+		keyC.PublicKey().String(): {nodeName: "node-c"},
+		keyE.PublicKey().String(): {nodeName: "node-e"},
+		keyF.PublicKey().String(): {nodeName: "node-f"},
+	}
+	keepalive := 25 * time.Second
+	devicePeers := []wgtypes.Peer{
+		{PublicKey: keyA.PublicKey(), LastHandshakeTime: now.Add(-time.Minute), PersistentKeepaliveInterval: keepalive},
+		{PublicKey: keyB.PublicKey(), LastHandshakeTime: now.Add(-10 * time.Minute), PersistentKeepaliveInterval: keepalive},
+		{PublicKey: keyC.PublicKey(), PersistentKeepaliveInterval: keepalive},
+		{PublicKey: keyD.PublicKey()},
+		// Without keepalive, idle peers are not stale, unlike peers that
+		// sent traffic without completing a handshake
+		{PublicKey: keyE.PublicKey(), LastHandshakeTime: now.Add(-10 * time.Minute), TransmitBytes: 100},
+		{PublicKey: keyF.PublicKey(), LastHandshakeTime: now.Add(-10 * time.Minute), TransmitBytes: 200},
+	}
+	lastTransmit := map[string]int64{
+		keyE.PublicKey().String(): 100,
+		keyF.PublicKey().String(): 100,
+	}
+	assert.Equal(t, []string{"node-b", "node-c", "node-f"}, stalePeers(peers, devicePeers, lastTransmit, now))
+}
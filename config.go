@@ -1,14 +1,36 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"net"
 	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/yaml"
+
+	"github.com/utilitywarehouse/semaphore-wireguard/firewall"
+	"github.com/utilitywarehouse/semaphore-wireguard/kube"
+	"github.com/utilitywarehouse/semaphore-wireguard/wireguard"
 )
 
 const (
-	defaultWGDeviceMTU  = 1420
-	defaultWGListenPort = 51820
+	defaultWGDeviceMTU     = 1420
+	defaultWGListenPort    = 51820
+	defaultIPRulePriority  = 1000
+	defaultResolveInterval = time.Minute
+	wgDeviceMTUAuto        = "auto"
+
+	// Default API version of the exec credential plugins
+	defaultExecAPIVersion = "client.authentication.k8s.io/v1"
+)
+
+// Default keys of the remote cluster credentials secret.
+const (
+	defaultSecretKeyKubeConfig = "kubeconfig"
+	defaultSecretKeyToken      = "token"
+	defaultSecretKeyCA         = "ca.crt"
 )
 
 // Duration is a helper to unmarshal time.Duration from json
@@ -45,20 +67,95 @@ func (d *Duration) UnmarshalJSON(b []byte) error {
 }
 
 type localClusterConfig struct {
-	Name           string `json:"name"`
-	KubeConfigPath string `json:"kubeConfigPath"`
+	Name                   string `json:"name"`
+	KubeConfigPath         string `json:"kubeConfigPath"`
+	TunnelAddressRange     string `json:"tunnelAddressRange"`
+	FirewallBackend        string `json:"firewallBackend"`
+	PodSubnet              string `json:"podSubnet"`
+	RemoteClusterResources bool   `json:"remoteClusterResources"`
+}
+
+// secretReference points to a secret in the local cluster that holds the
+// credentials for a remote cluster, and optionally overrides the keys to read
+// them from.
+type secretReference struct {
+	Namespace     string `json:"namespace"`
+	Name          string `json:"name"`
+	KubeConfigKey string `json:"kubeConfigKey"`
+	TokenKey      string `json:"tokenKey"`
+	CAKey         string `json:"caKey"`
+}
+
+// execConfig runs a command to get the credentials for a remote cluster, like
+// the exec plugins of kubeconfig users.
+type execConfig struct {
+	Command    string       `json:"command"`
+	Args       []string     `json:"args"`
+	Env        []execEnvVar `json:"env"`
+	APIVersion string       `json:"apiVersion"`
+}
+
+// execEnvVar is an environment variable set for the exec command.
+type execEnvVar struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
 }
 
 type remoteClusterConfig struct {
-	Name              string   `json:"name"`
-	KubeConfigPath    string   `json:"kubeConfigPath"`
-	RemoteAPIURL      string   `json:"remoteAPIURL"`
-	RemoteCAURL       string   `json:"remoteCAURL"`
-	RemoteSATokenPath string   `json:"remoteSATokenPath"`
-	WGDeviceMTU       int      `json:"wgDeviceMTU"`
-	WGListenPort      int      `json:"wgListenPort"`
-	PodSubnet         string   `json:"podSubnet"`
-	ResyncPeriod      Duration `json:"resyncPeriod"`
+	Name                string           `json:"name"`
+	KubeConfigPath      string           `json:"kubeConfigPath"`
+	RemoteAPIURL        string           `json:"remoteAPIURL"`
+	RemoteAPIURLs       []string         `json:"remoteAPIURLs"`
+	RemoteCAURL         string           `json:"remoteCAURL"`
+	RemoteSATokenPath   string           `json:"remoteSATokenPath"`
+	RemoteCA            string           `json:"remoteCA"`
+	RemoteCAPath        string           `json:"remoteCAPath"`
+	ClientCertPath      string           `json:"clientCertPath"`
+	ClientKeyPath       string           `json:"clientKeyPath"`
+	Exec                *execConfig      `json:"exec"`
+	CredentialsSecret   *secretReference `json:"credentialsSecret"`
+	WGDeviceMTU         int              `json:"wgDeviceMTU"`
+	WGListenPort        int              `json:"wgListenPort"`
+	PodSubnet           string           `json:"podSubnet"`
+	PodSubnetDiscovery  string           `json:"podSubnetDiscovery"`
+	NodeSelector        string           `json:"nodeSelector"`
+	ResyncPeriod        Duration         `json:"resyncPeriod"`
+	RouteTable          int              `json:"routeTable"`
+	RouteMetric         int              `json:"routeMetric"`
+	RouteSrc            string           `json:"routeSrc"`
+	IPRulePriority      int              `json:"ipRulePriority"`
+	WGFwMark            int              `json:"wgFwMark"`
+	TunnelAddressRange  string           `json:"tunnelAddressRange"`
+	Masquerade          bool             `json:"masquerade"`
+	PersistentKeepalive *Duration        `json:"persistentKeepalive"`
+	ResolveInterval     *Duration        `json:"endpointResolveInterval"`
+	WGDeviceMTUAuto     bool             `json:"-"` // Set when wgDeviceMTU is "auto"
+	FromResource        bool             `json:"-"` // Set for remotes of RemoteCluster resources
+}
+
+// UnmarshalJSON allows wgDeviceMTU to be set to "auto", in addition to a
+// numeric value.
+func (r *remoteClusterConfig) UnmarshalJSON(b []byte) error {
+	type plain remoteClusterConfig
+	aux := struct {
+		*plain
+		WGDeviceMTU json.RawMessage `json:"wgDeviceMTU"`
+	}{plain: (*plain)(r)}
+	if err := decodeStrict(b, &aux); err != nil {
+		return err
+	}
+	if len(aux.WGDeviceMTU) == 0 {
+		return nil
+	}
+	var mode string
+	if err := json.Unmarshal(aux.WGDeviceMTU, &mode); err == nil {
+		if mode != wgDeviceMTUAuto {
+			return fmt.Errorf("Invalid wgDeviceMTU value: %s", mode)
+		}
+		r.WGDeviceMTUAuto = true
+		return nil
+	}
+	return json.Unmarshal(aux.WGDeviceMTU, &r.WGDeviceMTU)
 }
 
 // Config holds the application configuration
@@ -67,35 +164,264 @@ type Config struct {
 	Remotes []*remoteClusterConfig `json:"remotes"`
 }
 
+// decodeStrict unmarshals json data, rejecting unknown fields.
+func decodeStrict(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// parseConfig parses a json or yaml config, rejecting unknown fields, and
+// validates it.
 func parseConfig(rawConfig []byte) (*Config, error) {
+	// Json is valid yaml, but json configs are decoded as is so that their
+	// formatting, e.g. tab indentation, does not matter.
+	if trimmed := bytes.TrimSpace(rawConfig); len(trimmed) == 0 || trimmed[0] != '{' {
+		converted, err := yaml.YAMLToJSON(rawConfig)
+		if err != nil {
+			return nil, fmt.Errorf("error unmarshalling config: %v", err)
+		}
+		rawConfig = converted
+	}
 	conf := &Config{}
-	if err := json.Unmarshal(rawConfig, conf); err != nil {
+	if err := decodeStrict(rawConfig, conf); err != nil {
 		return nil, fmt.Errorf("error unmarshalling config: %v", err)
 	}
 	// Check for mandatory local config.
 	if conf.Local.Name == "" {
 		return nil, fmt.Errorf("Configuration is missing local cluster name")
 	}
-	if len(conf.Remotes) < 1 {
+	if conf.Local.TunnelAddressRange != "" {
+		if _, _, err := net.ParseCIDR(conf.Local.TunnelAddressRange); err != nil {
+			return nil, fmt.Errorf("Cannot parse local tunnel address range: %v", err)
+		}
+	}
+	if conf.Local.PodSubnet != "" {
+		if _, _, err := net.ParseCIDR(conf.Local.PodSubnet); err != nil {
+			return nil, fmt.Errorf("Cannot parse local pod subnet: %v", err)
+		}
+	}
+	// Tunnel addresses are allocated by the nodes' block index in the pod
+	// subnet
+	if conf.Local.TunnelAddressRange != "" && conf.Local.PodSubnet == "" {
+		return nil, fmt.Errorf("Local tunnelAddressRange requires the local podSubnet")
+	}
+	switch conf.Local.FirewallBackend {
+	case "", firewall.BackendAuto, firewall.BackendNftables, firewall.BackendIptables:
+	default:
+		return nil, fmt.Errorf("Unknown firewall backend: %s", conf.Local.FirewallBackend)
+	}
+	if len(conf.Remotes) < 1 && !conf.Local.RemoteClusterResources {
 		return nil, fmt.Errorf("No remote cluster configuration defined")
 	}
-	// Check for mandatory remote config.
-	for _, r := range conf.Remotes {
-		if r.Name == "" {
-			return nil, fmt.Errorf("Configuration is missing remote cluster name")
+	for i, r := range conf.Remotes {
+		if err := validateRemote(conf.Local, r); err != nil {
+			return nil, err
+		}
+		for _, other := range conf.Remotes[:i] {
+			if err := checkRemoteConflicts(other, r); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return conf, nil
+}
+
+// validateNamespaces checks that the firewall rules can be managed in the
+// network namespaces of the wg devices. The rules are installed in the device
+// namespace, so filtering cannot also cover a listen port in another one.
+func validateNamespaces(local localClusterConfig, namespaces wireguard.Namespaces) error {
+	if local.FirewallBackend != "" && namespaces.Socket != namespaces.Device {
+		return fmt.Errorf("Filtering with firewallBackend requires the wg devices and their sockets in the same network namespace")
+	}
+	return nil
+}
+
+// apiURLs returns the remote API server URLs in order of preference.
+func (r *remoteClusterConfig) apiURLs() []string {
+	var urls []string
+	if r.RemoteAPIURL != "" {
+		urls = append(urls, r.RemoteAPIURL)
+	}
+	return append(urls, r.RemoteAPIURLs...)
+}
+
+// validateInlineCredentials checks that a remote API URL, exactly one CA
+// source and exactly one authentication method are set when the remote client
+// is not created from a kubeconfig or a credentials secret, and sets the exec
+// defaults.
+func validateInlineCredentials(r *remoteClusterConfig) error {
+	var cas, auths int
+	for _, s := range []string{r.RemoteCAURL, r.RemoteCA, r.RemoteCAPath} {
+		if s != "" {
+			cas++
+		}
+	}
+	if r.RemoteSATokenPath != "" {
+		auths++
+	}
+	if r.ClientCertPath != "" || r.ClientKeyPath != "" {
+		auths++
+	}
+	if r.Exec != nil {
+		auths++
+	}
+	if len(r.apiURLs()) == 0 || cas == 0 || auths == 0 {
+		return fmt.Errorf("Insufficient configuration to create remote cluster client. Set kubeConfigPath, credentialsSecret or remoteAPIURL or remoteAPIURLs with a CA (remoteCAURL, remoteCA or remoteCAPath) and credentials (remoteSATokenPath, clientCertPath and clientKeyPath, or exec)")
+	}
+	if cas > 1 {
+		return fmt.Errorf("Only one of remoteCAURL, remoteCA and remoteCAPath can be set for remote cluster %s", r.Name)
+	}
+	if auths > 1 {
+		return fmt.Errorf("Only one of remoteSATokenPath, clientCertPath and clientKeyPath, and exec can be set for remote cluster %s", r.Name)
+	}
+	if (r.ClientCertPath == "") != (r.ClientKeyPath == "") {
+		return fmt.Errorf("Both clientCertPath and clientKeyPath must be set for remote cluster %s", r.Name)
+	}
+	if r.Exec != nil {
+		if r.Exec.Command == "" {
+			return fmt.Errorf("Exec credentials for remote cluster %s must set a command", r.Name)
 		}
-		if (r.RemoteAPIURL == "" || r.RemoteCAURL == "" || r.RemoteSATokenPath == "") && r.KubeConfigPath == "" {
-			return nil, fmt.Errorf("Insufficient configuration to create remote cluster client. Set kubeConfigPath or remoteAPIURL and remoteCAURL and remoteSATokenPath")
+		// Exec plugins may return client certificates, which cannot be
+		// used with the custom transport that verifies against the CA URL
+		if r.RemoteCAURL != "" {
+			return fmt.Errorf("Exec credentials for remote cluster %s require remoteCA or remoteCAPath instead of remoteCAURL", r.Name)
 		}
-		if r.PodSubnet == "" {
-			return nil, fmt.Errorf("No pod subnet defined for remote cluster")
+		if r.Exec.APIVersion == "" {
+			r.Exec.APIVersion = defaultExecAPIVersion
 		}
-		if r.WGDeviceMTU == 0 {
-			r.WGDeviceMTU = defaultWGDeviceMTU
+	}
+	return nil
+}
+
+// validateRemote checks the mandatory config of a remote cluster and its
+// compatibility with the local cluster config, and sets the defaults.
+func validateRemote(local localClusterConfig, r *remoteClusterConfig) error {
+	if r.Name == "" {
+		return fmt.Errorf("Configuration is missing remote cluster name")
+	}
+	if r.Name == local.Name {
+		return fmt.Errorf("Remote cluster name %s cannot be the same as the local cluster name", r.Name)
+	}
+	wgDeviceName := fmt.Sprintf(wgDeviceNamePattern, r.Name)
+	if err := verifyInterfaceName(wgDeviceName); err != nil {
+		return fmt.Errorf("Interface name validation failed for %s: %v", wgDeviceName, err)
+	}
+	if r.KubeConfigPath == "" && r.CredentialsSecret == nil {
+		if err := validateInlineCredentials(r); err != nil {
+			return err
 		}
-		if r.WGListenPort == 0 {
-			r.WGListenPort = defaultWGListenPort
+	}
+	if r.CredentialsSecret != nil {
+		if r.CredentialsSecret.Namespace == "" || r.CredentialsSecret.Name == "" {
+			return fmt.Errorf("Credentials secret for remote cluster %s must set a namespace and name", r.Name)
+		}
+		if r.CredentialsSecret.KubeConfigKey == "" {
+			r.CredentialsSecret.KubeConfigKey = defaultSecretKeyKubeConfig
+		}
+		if r.CredentialsSecret.TokenKey == "" {
+			r.CredentialsSecret.TokenKey = defaultSecretKeyToken
+		}
+		if r.CredentialsSecret.CAKey == "" {
+			r.CredentialsSecret.CAKey = defaultSecretKeyCA
 		}
 	}
-	return conf, nil
+	if len(r.RemoteAPIURLs) > 0 {
+		// Kubeconfigs set their own server
+		if r.KubeConfigPath != "" {
+			return fmt.Errorf("Remote cluster %s cannot set remoteAPIURLs with kubeConfigPath", r.Name)
+		}
+		if _, err := kube.NewEndpointFailover(r.apiURLs()); err != nil {
+			return fmt.Errorf("Invalid API server URLs for remote cluster %s: %v", r.Name, err)
+		}
+	}
+	switch r.PodSubnetDiscovery {
+	case "", kube.PodSubnetDiscoveryCalico, kube.PodSubnetDiscoveryKubeadm, kube.PodSubnetDiscoveryNodes:
+	default:
+		return fmt.Errorf("Unknown pod subnet discovery method for remote cluster %s: %s", r.Name, r.PodSubnetDiscovery)
+	}
+	if r.PodSubnet == "" && r.PodSubnetDiscovery == "" {
+		return fmt.Errorf("No pod subnet defined for remote cluster")
+	}
+	// Discovered pod subnets are only known at runtime
+	if r.PodSubnet != "" {
+		_, podSubnet, err := net.ParseCIDR(r.PodSubnet)
+		if err != nil {
+			return fmt.Errorf("Cannot parse pod subnet for remote cluster %s: %v", r.Name, err)
+		}
+		if local.PodSubnet != "" {
+			_, localPodSubnet, _ := net.ParseCIDR(local.PodSubnet)
+			if subnetsOverlap(podSubnet, localPodSubnet) {
+				return fmt.Errorf("Pod subnet of remote cluster %s overlaps with the local pod subnet", r.Name)
+			}
+		}
+	}
+	if r.NodeSelector != "" {
+		if _, err := labels.Parse(r.NodeSelector); err != nil {
+			return fmt.Errorf("Cannot parse node selector for remote cluster %s: %v", r.Name, err)
+		}
+	}
+	if r.WGDeviceMTU < 0 {
+		return fmt.Errorf("WireGuard device MTU for remote cluster %s cannot be negative", r.Name)
+	}
+	if r.WGListenPort < 0 || r.WGListenPort > 65535 {
+		return fmt.Errorf("WireGuard listen port for remote cluster %s must be between 1 and 65535: %d", r.Name, r.WGListenPort)
+	}
+	if r.WGDeviceMTU == 0 {
+		r.WGDeviceMTU = defaultWGDeviceMTU
+	}
+	if r.WGListenPort == 0 {
+		r.WGListenPort = defaultWGListenPort
+	}
+	if r.RouteTable < 0 || r.RouteMetric < 0 || r.IPRulePriority < 0 || r.WGFwMark < 0 {
+		return fmt.Errorf("Routing options for remote cluster %s cannot be negative", r.Name)
+	}
+	if r.RouteSrc != "" && net.ParseIP(r.RouteSrc) == nil {
+		return fmt.Errorf("Cannot parse route source address for remote cluster %s: %s", r.Name, r.RouteSrc)
+	}
+	if r.TunnelAddressRange != "" {
+		if _, _, err := net.ParseCIDR(r.TunnelAddressRange); err != nil {
+			return fmt.Errorf("Cannot parse tunnel address range for remote cluster %s: %v", r.Name, err)
+		}
+	}
+	// Traffic is masqueraded to the node's tunnel address
+	if r.Masquerade && local.TunnelAddressRange == "" {
+		return fmt.Errorf("Masquerading for remote cluster %s requires the local tunnelAddressRange", r.Name)
+	}
+	if r.PersistentKeepalive == nil {
+		r.PersistentKeepalive = &Duration{wireguard.DefaultPersistentKeepaliveInterval}
+	}
+	if r.PersistentKeepalive.Duration < 0 {
+		return fmt.Errorf("Persistent keepalive for remote cluster %s cannot be negative", r.Name)
+	}
+	if r.ResolveInterval == nil {
+		r.ResolveInterval = &Duration{defaultResolveInterval}
+	}
+	if r.ResolveInterval.Duration < 0 {
+		return fmt.Errorf("Endpoint resolve interval for remote cluster %s cannot be negative", r.Name)
+	}
+	if r.RouteTable != 0 && r.IPRulePriority == 0 {
+		r.IPRulePriority = defaultIPRulePriority
+	}
+	return nil
+}
+
+// checkRemoteConflicts checks that the configs of two validated remote
+// clusters can be used together. The first one is expected to be the one
+// defined earlier.
+func checkRemoteConflicts(a, b *remoteClusterConfig) error {
+	if a.Name == b.Name {
+		return fmt.Errorf("Duplicate remote cluster name: %s", b.Name)
+	}
+	if a.PodSubnet != "" && b.PodSubnet != "" {
+		_, subnetA, _ := net.ParseCIDR(a.PodSubnet)
+		_, subnetB, _ := net.ParseCIDR(b.PodSubnet)
+		if subnetsOverlap(subnetA, subnetB) {
+			return fmt.Errorf("Pod subnets of remote clusters %s and %s overlap", a.Name, b.Name)
+		}
+	}
+	if a.WGListenPort == b.WGListenPort {
+		return fmt.Errorf("Remote clusters %s and %s use the same wg listen port %d", a.Name, b.Name, a.WGListenPort)
+	}
+	return nil
 }
@@ -2,10 +2,13 @@ package main
 
 import (
 	"fmt"
+	"os"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/utilitywarehouse/semaphore-wireguard/wireguard"
 )
 
 func TestConfig(t *testing.T) {
@@ -52,7 +55,7 @@ func TestConfig(t *testing.T) {
   },
   "remotes": [
     {
-      "name": "remote_cluster_1",
+      "name": "r1",
       "remoteCAURL": "remote_ca_url",
       "remoteAPIURL": "remote_api_url"
     }
@@ -60,7 +63,61 @@ func TestConfig(t *testing.T) {
 }
 `)
 	_, err = parseConfig(insufficientRemoteKubeConfigPath)
-	assert.Equal(t, fmt.Errorf("Insufficient configuration to create remote cluster client. Set kubeConfigPath or remoteAPIURL and remoteCAURL and remoteSATokenPath"), err)
+	assert.Equal(t, fmt.Errorf("Insufficient configuration to create remote cluster client. Set kubeConfigPath, credentialsSecret or remoteAPIURL or remoteAPIURLs with a CA (remoteCAURL, remoteCA or remoteCAPath) and credentials (remoteSATokenPath, clientCertPath and clientKeyPath, or exec)"), err)
+
+	invalidListenPort := []byte(`
+{
+  "local": {
+    "name": "local_cluster"
+  },
+  "remotes": [
+    {
+      "name": "r1",
+      "kubeConfigPath": "/path/to/kube/config",
+      "podSubnet": "10.0.0.0/16",
+      "wgListenPort": 65536
+    }
+  ]
+}
+`)
+	_, err = parseConfig(invalidListenPort)
+	assert.Equal(t, fmt.Errorf("WireGuard listen port for remote cluster r1 must be between 1 and 65535: 65536"), err)
+
+	negativeListenPort := []byte(`
+{
+  "local": {
+    "name": "local_cluster"
+  },
+  "remotes": [
+    {
+      "name": "r1",
+      "kubeConfigPath": "/path/to/kube/config",
+      "podSubnet": "10.0.0.0/16",
+      "wgListenPort": -1
+    }
+  ]
+}
+`)
+	_, err = parseConfig(negativeListenPort)
+	assert.Equal(t, fmt.Errorf("WireGuard listen port for remote cluster r1 must be between 1 and 65535: -1"), err)
+
+	negativeMTU := []byte(`
+{
+  "local": {
+    "name": "local_cluster"
+  },
+  "remotes": [
+    {
+      "name": "r1",
+      "kubeConfigPath": "/path/to/kube/config",
+      "podSubnet": "10.0.0.0/16",
+      "wgDeviceMTU": -1
+    }
+  ]
+}
+`)
+	_, err = parseConfig(negativeMTU)
+	assert.Equal(t, fmt.Errorf("WireGuard device MTU for remote cluster r1 cannot be negative"), err)
 
 	rawFullConfig := []byte(`
 {
@@ -70,7 +127,7 @@ func TestConfig(t *testing.T) {
   },
   "remotes": [
     {
-      "name": "remote_cluster_1",
+      "name": "r1",
       "remoteCAURL": "remote_ca_url",
       "remoteAPIURL": "remote_api_url",
       "remoteSATokenPath": "/path/to/token",
@@ -80,9 +137,9 @@ func TestConfig(t *testing.T) {
       "resyncPeriod": "10s"
     },
     {
-      "name": "remote_cluster_2",
+      "name": "r2",
       "kubeConfigPath": "/path/to/kube/config",
-      "podSubnet": "10.0.1.0/16"
+      "podSubnet": "10.1.0.0/16"
     }
   ]
 }
@@ -92,7 +149,7 @@ func TestConfig(t *testing.T) {
 	assert.Equal(t, "local_cluster", config.Local.Name)
 	assert.Equal(t, "/path/to/kube/config", config.Local.KubeConfigPath)
 	assert.Equal(t, 2, len(config.Remotes))
-	assert.Equal(t, "remote_cluster_1", config.Remotes[0].Name)
+	assert.Equal(t, "r1", config.Remotes[0].Name)
 	assert.Equal(t, "remote_ca_url", config.Remotes[0].RemoteCAURL)
 	assert.Equal(t, "remote_api_url", config.Remotes[0].RemoteAPIURL)
 	assert.Equal(t, "/path/to/token", config.Remotes[0].RemoteSATokenPath)
@@ -101,14 +158,856 @@ func TestConfig(t *testing.T) {
 	assert.Equal(t, 1500, config.Remotes[0].WGDeviceMTU)
 	assert.Equal(t, 51821, config.Remotes[0].WGListenPort)
 	assert.Equal(t, Duration{10 * time.Second}, config.Remotes[0].ResyncPeriod)
-	assert.Equal(t, "remote_cluster_2", config.Remotes[1].Name)
+	assert.Equal(t, "r2", config.Remotes[1].Name)
 	assert.Equal(t, "", config.Remotes[1].RemoteCAURL)
 	assert.Equal(t, "", config.Remotes[1].RemoteAPIURL)
 	assert.Equal(t, "", config.Remotes[1].RemoteSATokenPath)
 	assert.Equal(t, "/path/to/kube/config", config.Remotes[1].KubeConfigPath)
-	assert.Equal(t, "10.0.1.0/16", config.Remotes[1].PodSubnet)
+	assert.Equal(t, "10.1.0.0/16", config.Remotes[1].PodSubnet)
 	assert.Equal(t, defaultWGDeviceMTU, config.Remotes[1].WGDeviceMTU)
 	assert.Equal(t, defaultWGListenPort, config.Remotes[1].WGListenPort)
 	assert.Equal(t, Duration{0}, config.Remotes[1].ResyncPeriod)
 
 }
+
+func TestConfigRoutingOptions(t *testing.T) {
+	invalidRouteSrc := []byte(`
+{
+  "local": {
+    "name": "local_cluster"
+  },
+  "remotes": [
+    {
+      "name": "r1",
+      "kubeConfigPath": "/path/to/kube/config",
+      "podSubnet": "10.0.0.0/16",
+      "routeSrc": "foo"
+    }
+  ]
+}
+`)
+	_, err := parseConfig(invalidRouteSrc)
+	assert.Equal(t, fmt.Errorf("Cannot parse route source address for remote cluster r1: foo"), err)
+
+	negativeRouteTable := []byte(`
+{
+  "local": {
+    "name": "local_cluster"
+  },
+  "remotes": [
+    {
+      "name": "r1",
+      "kubeConfigPath": "/path/to/kube/config",
+      "podSubnet": "10.0.0.0/16",
+      "routeTable": -1
+    }
+  ]
+}
+`)
+	_, err = parseConfig(negativeRouteTable)
+	assert.Equal(t, fmt.Errorf("Routing options for remote cluster r1 cannot be negative"), err)
+
+	rawRoutingConfig := []byte(`
+{
+  "local": {
+    "name": "local_cluster"
+  },
+  "remotes": [
+    {
+      "name": "r1",
+      "kubeConfigPath": "/path/to/kube/config",
+      "podSubnet": "10.0.0.0/16",
+      "routeTable": 100,
+      "routeMetric": 10,
+      "routeSrc": "10.2.0.1",
+      "wgFwMark": 51820
+    },
+    {
+      "name": "r2",
+      "kubeConfigPath": "/path/to/kube/config",
+      "podSubnet": "10.1.0.0/16",
+      "wgListenPort": 51821,
+      "routeTable": 101,
+      "ipRulePriority": 50
+    }
+  ]
+}
+`)
+	config, err := parseConfig(rawRoutingConfig)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 100, config.Remotes[0].RouteTable)
+	assert.Equal(t, 10, config.Remotes[0].RouteMetric)
+	assert.Equal(t, "10.2.0.1", config.Remotes[0].RouteSrc)
+	assert.Equal(t, defaultIPRulePriority, config.Remotes[0].IPRulePriority)
+	assert.Equal(t, 51820, config.Remotes[0].WGFwMark)
+	assert.Equal(t, 101, config.Remotes[1].RouteTable)
+	assert.Equal(t, 0, config.Remotes[1].RouteMetric)
+	assert.Equal(t, "", config.Remotes[1].RouteSrc)
+	assert.Equal(t, 50, config.Remotes[1].IPRulePriority)
+	assert.Equal(t, 0, config.Remotes[1].WGFwMark)
+}
+
+func TestConfigTunnelAddressRange(t *testing.T) {
+	invalidLocalRange := []byte(`
+{
+  "local": {
+    "name": "local_cluster",
+    "tunnelAddressRange": "100.64.0.0"
+  },
+  "remotes": [
+    {
+      "name": "r1",
+      "kubeConfigPath": "/path/to/kube/config",
+      "podSubnet": "10.0.0.0/16"
+    }
+  ]
+}
+`)
+	_, err := parseConfig(invalidLocalRange)
+	assert.Equal(t, fmt.Errorf("Cannot parse local tunnel address range: invalid CIDR address: 100.64.0.0"), err)
+
+	invalidRemoteRange := []byte(`
+{
+  "local": {
+    "name": "local_cluster",
+    "tunnelAddressRange": "100.64.0.0/24",
+    "podSubnet": "10.4.0.0/16"
+  },
+  "remotes": [
+    {
+      "name": "r1",
+      "kubeConfigPath": "/path/to/kube/config",
+      "podSubnet": "10.0.0.0/16",
+      "tunnelAddressRange": "foo"
+    }
+  ]
+}
+`)
+	_, err = parseConfig(invalidRemoteRange)
+	assert.Equal(t, fmt.Errorf("Cannot parse tunnel address range for remote cluster r1: invalid CIDR address: foo"), err)
+
+	rawTunnelConfig := []byte(`
+{
+  "local": {
+    "name": "local_cluster",
+    "tunnelAddressRange": "100.64.0.0/24",
+    "podSubnet": "10.4.0.0/16"
+  },
+  "remotes": [
+    {
+      "name": "r1",
+      "kubeConfigPath": "/path/to/kube/config",
+      "podSubnet": "10.0.0.0/16",
+      "tunnelAddressRange": "100.64.1.0/24"
+    }
+  ]
+}
+`)
+	config, err := parseConfig(rawTunnelConfig)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "100.64.0.0/24", config.Local.TunnelAddressRange)
+	assert.Equal(t, "100.64.1.0/24", config.Remotes[0].TunnelAddressRange)
+
+	noLocalPodSubnet := []byte(`
+{
+  "local": {
+    "name": "local_cluster",
+    "tunnelAddressRange": "100.64.0.0/24"
+  },
+  "remotes": [
+    {
+      "name": "r1",
+      "kubeConfigPath": "/path/to/kube/config",
+      "podSubnet": "10.0.0.0/16"
+    }
+  ]
+}
+`)
+	_, err = parseConfig(noLocalPodSubnet)
+	assert.Equal(t, fmt.Errorf("Local tunnelAddressRange requires the local podSubnet"), err)
+}
+
+func TestConfigFirewallBackend(t *testing.T) {
+	unknownBackend := []byte(`
+{
+  "local": {
+    "name": "local_cluster",
+    "firewallBackend": "pf"
+  },
+  "remotes": [
+    {
+      "name": "r1",
+      "kubeConfigPath": "/path/to/kube/config",
+      "podSubnet": "10.0.0.0/16"
+    }
+  ]
+}
+`)
+	_, err := parseConfig(unknownBackend)
+	assert.Equal(t, fmt.Errorf("Unknown firewall backend: pf"), err)
+
+	nftablesBackend := []byte(`
+{
+  "local": {
+    "name": "local_cluster",
+    "firewallBackend": "nftables",
+    "tunnelAddressRange": "100.64.0.0/24",
+    "podSubnet": "10.4.0.0/16"
+  },
+  "remotes": [
+    {
+      "name": "r1",
+      "kubeConfigPath": "/path/to/kube/config",
+      "podSubnet": "10.0.0.0/16",
+      "masquerade": true
+    }
+  ]
+}
+`)
+	noTunnelRange := []byte(`
+{
+  "local": {
+    "name": "local_cluster"
+  },
+  "remotes": [
+    {
+      "name": "r1",
+      "kubeConfigPath": "/path/to/kube/config",
+      "podSubnet": "10.0.0.0/16",
+      "masquerade": true
+    }
+  ]
+}
+`)
+	_, err = parseConfig(noTunnelRange)
+	assert.Equal(t, fmt.Errorf("Masquerading for remote cluster r1 requires the local tunnelAddressRange"), err)
+
+	config, err := parseConfig(nftablesBackend)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "nftables", config.Local.FirewallBackend)
+	assert.Equal(t, true, config.Remotes[0].Masquerade)
+
+	assert.Equal(t, nil, validateNamespaces(config.Local, wireguard.Namespaces{Device: "/var/run/netns/wg", Socket: "/var/run/netns/wg"}))
+	assert.Equal(t, fmt.Errorf("Filtering with firewallBackend requires the wg devices and their sockets in the same network namespace"), validateNamespaces(config.Local, wireguard.Namespaces{Device: "/var/run/netns/wg"}))
+	assert.Equal(t, fmt.Errorf("Filtering with firewallBackend requires the wg devices and their sockets in the same network namespace"), validateNamespaces(config.Local, wireguard.Namespaces{Socket: "/var/run/netns/wg"}))
+	assert.Equal(t, fmt.Errorf("Filtering with firewallBackend requires the wg devices and their sockets in the same network namespace"), validateNamespaces(config.Local, wireguard.Namespaces{Device: "/var/run/netns/wg", Socket: "/var/run/netns/underlay"}))
+	config.Local.FirewallBackend = ""
+	assert.Equal(t, nil, validateNamespaces(config.Local, wireguard.Namespaces{Device: "/var/run/netns/wg"}))
+}
+
+func TestConfigWGDeviceMTU(t *testing.T) {
+	invalidMTU := []byte(`
+{
+  "local": {
+    "name": "local_cluster"
+  },
+  "remotes": [
+    {
+      "name": "r1",
+      "kubeConfigPath": "/path/to/kube/config",
+      "podSubnet": "10.0.0.0/16",
+      "wgDeviceMTU": "foo"
+    }
+  ]
+}
+`)
+	_, err := parseConfig(invalidMTU)
+	assert.Equal(t, fmt.Errorf("error unmarshalling config: Invalid wgDeviceMTU value: foo"), err)
+
+	rawMTUConfig := []byte(`
+{
+  "local": {
+    "name": "local_cluster"
+  },
+  "remotes": [
+    {
+      "name": "r1",
+      "kubeConfigPath": "/path/to/kube/config",
+      "podSubnet": "10.0.0.0/16",
+      "wgDeviceMTU": "auto"
+    },
+    {
+      "name": "r2",
+      "kubeConfigPath": "/path/to/kube/config",
+      "podSubnet": "10.1.0.0/16",
+      "wgListenPort": 51821,
+      "wgDeviceMTU": 1380
+    }
+  ]
+}
+`)
+	config, err := parseConfig(rawMTUConfig)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, config.Remotes[0].WGDeviceMTUAuto)
+	assert.Equal(t, defaultWGDeviceMTU, config.Remotes[0].WGDeviceMTU)
+	assert.Equal(t, false, config.Remotes[1].WGDeviceMTUAuto)
+	assert.Equal(t, 1380, config.Remotes[1].WGDeviceMTU)
+}
+
+func TestConfigPersistentKeepalive(t *testing.T) {
+	negativeKeepalive := []byte(`
+{
+  "local": {
+    "name": "local_cluster"
+  },
+  "remotes": [
+    {
+      "name": "r1",
+      "kubeConfigPath": "/path/to/kube/config",
+      "podSubnet": "10.0.0.0/16",
+      "persistentKeepalive": "-1s"
+    }
+  ]
+}
+`)
+	_, err := parseConfig(negativeKeepalive)
+	assert.Equal(t, fmt.Errorf("Persistent keepalive for remote cluster r1 cannot be negative"), err)
+
+	rawKeepaliveConfig := []byte(`
+{
+  "local": {
+    "name": "local_cluster"
+  },
+  "remotes": [
+    {
+      "name": "r1",
+      "kubeConfigPath": "/path/to/kube/config",
+      "podSubnet": "10.0.0.0/16",
+      "persistentKeepalive": "0s"
+    },
+    {
+      "name": "r2",
+      "kubeConfigPath": "/path/to/kube/config",
+      "podSubnet": "10.1.0.0/16",
+      "wgListenPort": 51821,
+      "persistentKeepalive": "10s"
+    },
+    {
+      "name": "r3",
+      "kubeConfigPath": "/path/to/kube/config",
+      "podSubnet": "10.2.0.0/16",
+      "wgListenPort": 51822
+    }
+  ]
+}
+`)
+	config, err := parseConfig(rawKeepaliveConfig)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, &Duration{0}, config.Remotes[0].PersistentKeepalive)
+	assert.Equal(t, &Duration{10 * time.Second}, config.Remotes[1].PersistentKeepalive)
+	assert.Equal(t, &Duration{wireguard.DefaultPersistentKeepaliveInterval}, config.Remotes[2].PersistentKeepalive)
+}
+
+func TestConfigPodSubnets(t *testing.T) {
+	invalidPodSubnet := []byte(`
+{
+  "local": {
+    "name": "local_cluster"
+  },
+  "remotes": [
+    {
+      "name": "r1",
+      "kubeConfigPath": "/path/to/kube/config",
+      "podSubnet": "10.0.0.0"
+    }
+  ]
+}
+`)
+	_, err := parseConfig(invalidPodSubnet)
+	assert.Equal(t, fmt.Errorf("Cannot parse pod subnet for remote cluster r1: invalid CIDR address: 10.0.0.0"), err)
+
+	overlappingRemotes := []byte(`
+{
+  "local": {
+    "name": "local_cluster"
+  },
+  "remotes": [
+    {
+      "name": "r1",
+      "kubeConfigPath": "/path/to/kube/config",
+      "podSubnet": "10.0.0.0/16"
+    },
+    {
+      "name": "r2",
+      "kubeConfigPath": "/path/to/kube/config",
+      "podSubnet": "10.0.128.0/17"
+    }
+  ]
+}
+`)
+	_, err = parseConfig(overlappingRemotes)
+	assert.Equal(t, fmt.Errorf("Pod subnets of remote clusters r1 and r2 overlap"), err)
+
+	overlappingLocal := []byte(`
+{
+  "local": {
+    "name": "local_cluster",
+    "podSubnet": "10.0.0.0/8"
+  },
+  "remotes": [
+    {
+      "name": "r1",
+      "kubeConfigPath": "/path/to/kube/config",
+      "podSubnet": "10.0.0.0/16"
+    }
+  ]
+}
+`)
+	_, err = parseConfig(overlappingLocal)
+	assert.Equal(t, fmt.Errorf("Pod subnet of remote cluster r1 overlaps with the local pod subnet"), err)
+
+	unknownDiscovery := []byte(`
+{
+  "local": {
+    "name": "local_cluster"
+  },
+  "remotes": [
+    {
+      "name": "r1",
+      "kubeConfigPath": "/path/to/kube/config",
+      "podSubnetDiscovery": "foo"
+    }
+  ]
+}
+`)
+	_, err = parseConfig(unknownDiscovery)
+	assert.Equal(t, fmt.Errorf("Unknown pod subnet discovery method for remote cluster r1: foo"), err)
+
+	discoveredPodSubnet := []byte(`
+{
+  "local": {
+    "name": "local_cluster"
+  },
+  "remotes": [
+    {
+      "name": "r1",
+      "kubeConfigPath": "/path/to/kube/config",
+      "podSubnetDiscovery": "calico"
+    },
+    {
+      "name": "r2",
+      "kubeConfigPath": "/path/to/kube/config",
+      "podSubnet": "10.0.0.0/16",
+      "wgListenPort": 51821
+    }
+  ]
+}
+`)
+	config, err := parseConfig(discoveredPodSubnet)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "calico", config.Remotes[0].PodSubnetDiscovery)
+	assert.Equal(t, "", config.Remotes[0].PodSubnet)
+}
+
+func TestConfigRemoteUniqueness(t *testing.T) {
+	duplicateNames := []byte(`
+{
+  "local": {
+    "name": "local_cluster"
+  },
+  "remotes": [
+    {
+      "name": "r1",
+      "kubeConfigPath": "/path/to/kube/config",
+      "podSubnet": "10.0.0.0/16"
+    },
+    {
+      "name": "r1",
+      "kubeConfigPath": "/path/to/kube/config",
+      "podSubnet": "10.1.0.0/16",
+      "wgListenPort": 51821
+    }
+  ]
+}
+`)
+	_, err := parseConfig(duplicateNames)
+	assert.Equal(t, fmt.Errorf("Duplicate remote cluster name: r1"), err)
+
+	localName := []byte(`
+{
+  "local": {
+    "name": "c1"
+  },
+  "remotes": [
+    {
+      "name": "c1",
+      "kubeConfigPath": "/path/to/kube/config",
+      "podSubnet": "10.0.0.0/16"
+    }
+  ]
+}
+`)
+	_, err = parseConfig(localName)
+	assert.Equal(t, fmt.Errorf("Remote cluster name c1 cannot be the same as the local cluster name"), err)
+
+	longName := []byte(`
+{
+  "local": {
+    "name": "local_cluster"
+  },
+  "remotes": [
+    {
+      "name": "remote_cluster_1",
+      "kubeConfigPath": "/path/to/kube/config",
+      "podSubnet": "10.0.0.0/16"
+    }
+  ]
+}
+`)
+	_, err = parseConfig(longName)
+	assert.Equal(t, fmt.Errorf("Interface name validation failed for wireguard.remote_cluster_1: %v", ifaceNameTooLongErr), err)
+
+	duplicatePorts := []byte(`
+{
+  "local": {
+    "name": "local_cluster"
+  },
+  "remotes": [
+    {
+      "name": "r1",
+      "kubeConfigPath": "/path/to/kube/config",
+      "podSubnet": "10.0.0.0/16"
+    },
+    {
+      "name": "r2",
+      "kubeConfigPath": "/path/to/kube/config",
+      "podSubnet": "10.1.0.0/16"
+    }
+  ]
+}
+`)
+	_, err = parseConfig(duplicatePorts)
+	assert.Equal(t, fmt.Errorf("Remote clusters r1 and r2 use the same wg listen port 51820"), err)
+}
+
+func TestConfigStrictDecoding(t *testing.T) {
+	unknownLocalField := []byte(`
+{
+  "local": {
+    "name": "local_cluster",
+    "foo": "bar"
+  }
+}
+`)
+	_, err := parseConfig(unknownLocalField)
+	assert.Equal(t, fmt.Errorf("error unmarshalling config: json: unknown field \"foo\""), err)
+
+	unknownRemoteField := []byte(`
+{
+  "local": {
+    "name": "local_cluster"
+  },
+  "remotes": [
+    {
+      "name": "r1",
+      "kubeConfigPath": "/path/to/kube/config",
+      "podSubnet": "10.0.0.0/16",
+      "wgListnPort": 51821
+    }
+  ]
+}
+`)
+	_, err = parseConfig(unknownRemoteField)
+	assert.Equal(t, fmt.Errorf("error unmarshalling config: json: unknown field \"wgListnPort\""), err)
+}
+
+func TestConfigRemoteClusterResources(t *testing.T) {
+	noRemotes := []byte(`
+{
+  "local": {
+    "name": "local_cluster",
+    "remoteClusterResources": true
+  }
+}
+`)
+	config, err := parseConfig(noRemotes)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(config.Remotes))
+
+	secretCredentials := []byte(`
+{
+  "local": {
+    "name": "local_cluster"
+  },
+  "remotes": [
+    {
+      "name": "r1",
+      "credentialsSecret": {
+        "namespace": "sys-semaphore",
+        "name": "r1-credentials"
+      },
+      "podSubnet": "10.0.0.0/16",
+      "nodeSelector": "wireguard=enabled"
+    }
+  ]
+}
+`)
+	config, err = parseConfig(secretCredentials)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, &secretReference{
+		Namespace:     "sys-semaphore",
+		Name:          "r1-credentials",
+		KubeConfigKey: "kubeconfig",
+		TokenKey:      "token",
+		CAKey:         "ca.crt",
+	}, config.Remotes[0].CredentialsSecret)
+	assert.Equal(t, "wireguard=enabled", config.Remotes[0].NodeSelector)
+
+	incompleteSecret := []byte(`
+{
+  "local": {
+    "name": "local_cluster"
+  },
+  "remotes": [
+    {
+      "name": "r1",
+      "credentialsSecret": {
+        "name": "r1-credentials"
+      },
+      "podSubnet": "10.0.0.0/16"
+    }
+  ]
+}
+`)
+	_, err = parseConfig(incompleteSecret)
+	assert.Equal(t, fmt.Errorf("Credentials secret for remote cluster r1 must set a namespace and name"), err)
+}
+
+func TestConfigRemoteInlineCredentials(t *testing.T) {
+	clientCert := []byte(`
+{
+  "local": {
+    "name": "local_cluster"
+  },
+  "remotes": [
+    {
+      "name": "r1",
+      "remoteAPIURL": "https://api.r1.example.com",
+      "remoteCAPath": "/path/to/ca.crt",
+      "clientCertPath": "/path/to/tls.crt",
+      "clientKeyPath": "/path/to/tls.key",
+      "podSubnet": "10.0.0.0/16"
+    }
+  ]
+}
+`)
+	config, err := parseConfig(clientCert)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "/path/to/tls.crt", config.Remotes[0].ClientCertPath)
+	assert.Equal(t, "/path/to/tls.key", config.Remotes[0].ClientKeyPath)
+
+	exec := []byte(`
+{
+  "local": {
+    "name": "local_cluster"
+  },
+  "remotes": [
+    {
+      "name": "r1",
+      "remoteAPIURL": "https://api.r1.example.com",
+      "remoteCA": "-----BEGIN CERTIFICATE-----",
+      "exec": {
+        "command": "token-helper",
+        "args": ["token", "--cluster", "r1"],
+        "env": [{"name": "REGION", "value": "eu-west-1"}]
+      },
+      "podSubnet": "10.0.0.0/16"
+    }
+  ]
+}
+`)
+	config, err = parseConfig(exec)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, &execConfig{
+		Command:    "token-helper",
+		Args:       []string{"token", "--cluster", "r1"},
+		Env:        []execEnvVar{{Name: "REGION", Value: "eu-west-1"}},
+		APIVersion: "client.authentication.k8s.io/v1",
+	}, config.Remotes[0].Exec)
+
+	missingKey := []byte(`
+{
+  "local": {
+    "name": "local_cluster"
+  },
+  "remotes": [
+    {
+      "name": "r1",
+      "remoteAPIURL": "https://api.r1.example.com",
+      "remoteCAURL": "https://ca.r1.example.com",
+      "clientCertPath": "/path/to/tls.crt",
+      "podSubnet": "10.0.0.0/16"
+    }
+  ]
+}
+`)
+	_, err = parseConfig(missingKey)
+	assert.Equal(t, fmt.Errorf("Both clientCertPath and clientKeyPath must be set for remote cluster r1"), err)
+
+	multipleCAs := []byte(`
+{
+  "local": {
+    "name": "local_cluster"
+  },
+  "remotes": [
+    {
+      "name": "r1",
+      "remoteAPIURL": "https://api.r1.example.com",
+      "remoteCAURL": "https://ca.r1.example.com",
+      "remoteCAPath": "/path/to/ca.crt",
+      "remoteSATokenPath": "/path/to/token",
+      "podSubnet": "10.0.0.0/16"
+    }
+  ]
+}
+`)
+	_, err = parseConfig(multipleCAs)
+	assert.Equal(t, fmt.Errorf("Only one of remoteCAURL, remoteCA and remoteCAPath can be set for remote cluster r1"), err)
+
+	multipleAuths := []byte(`
+{
+  "local": {
+    "name": "local_cluster"
+  },
+  "remotes": [
+    {
+      "name": "r1",
+      "remoteAPIURL": "https://api.r1.example.com",
+      "remoteCAPath": "/path/to/ca.crt",
+      "remoteSATokenPath": "/path/to/token",
+      "exec": {
+        "command": "token-helper"
+      },
+      "podSubnet": "10.0.0.0/16"
+    }
+  ]
+}
+`)
+	_, err = parseConfig(multipleAuths)
+	assert.Equal(t, fmt.Errorf("Only one of remoteSATokenPath, clientCertPath and clientKeyPath, and exec can be set for remote cluster r1"), err)
+
+	execWithCAURL := []byte(`
+{
+  "local": {
+    "name": "local_cluster"
+  },
+  "remotes": [
+    {
+      "name": "r1",
+      "remoteAPIURL": "https://api.r1.example.com",
+      "remoteCAURL": "https://ca.r1.example.com",
+      "exec": {
+        "command": "token-helper"
+      },
+      "podSubnet": "10.0.0.0/16"
+    }
+  ]
+}
+`)
+	_, err = parseConfig(execWithCAURL)
+	assert.Equal(t, fmt.Errorf("Exec credentials for remote cluster r1 require remoteCA or remoteCAPath instead of remoteCAURL"), err)
+}
+
+func TestConfigRemoteAPIURLs(t *testing.T) {
+	apiURLs := []byte(`
+{
+  "local": {
+    "name": "local_cluster"
+  },
+  "remotes": [
+    {
+      "name": "r1",
+      "remoteAPIURLs": ["https://api-a.r1.example.com", "https://api-b.r1.example.com:6443"],
+      "remoteCAURL": "https://ca.r1.example.com",
+      "remoteSATokenPath": "/path/to/token",
+      "podSubnet": "10.0.0.0/16"
+    }
+  ]
+}
+`)
+	config, err := parseConfig(apiURLs)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"https://api-a.r1.example.com", "https://api-b.r1.example.com:6443"}, config.Remotes[0].apiURLs())
+
+	config.Remotes[0].RemoteAPIURL = "https://api.r1.example.com"
+	assert.Equal(t, []string{"https://api.r1.example.com", "https://api-a.r1.example.com", "https://api-b.r1.example.com:6443"}, config.Remotes[0].apiURLs())
+
+	invalidURL := []byte(`
+{
+  "local": {
+    "name": "local_cluster"
+  },
+  "remotes": [
+    {
+      "name": "r1",
+      "remoteAPIURLs": ["https://api-a.r1.example.com", "api-b.r1.example.com"],
+      "remoteCAURL": "https://ca.r1.example.com",
+      "remoteSATokenPath": "/path/to/token",
+      "podSubnet": "10.0.0.0/16"
+    }
+  ]
+}
+`)
+	_, err = parseConfig(invalidURL)
+	assert.Equal(t, fmt.Errorf("Invalid API server URLs for remote cluster r1: API server URL api-b.r1.example.com must set a scheme and host"), err)
+
+	withKubeConfig := []byte(`
+{
+  "local": {
+    "name": "local_cluster"
+  },
+  "remotes": [
+    {
+      "name": "r1",
+      "kubeConfigPath": "/path/to/kube/config",
+      "remoteAPIURLs": ["https://api-a.r1.example.com", "https://api-b.r1.example.com"],
+      "podSubnet": "10.0.0.0/16"
+    }
+  ]
+}
+`)
+	_, err = parseConfig(withKubeConfig)
+	assert.Equal(t, fmt.Errorf("Remote cluster r1 cannot set remoteAPIURLs with kubeConfigPath"), err)
+}
+
+func TestConfigYAML(t *testing.T) {
+	rawYAMLConfig := []byte(`
+local:
+  name: local_cluster
+remotes:
+  - name: r1
+    kubeConfigPath: /path/to/kube/config
+    podSubnet: 10.0.0.0/16
+    wgDeviceMTU: auto
+    resyncPeriod: 10s
+  - name: r2
+    kubeConfigPath: /path/to/kube/config
+    podSubnet: 10.1.0.0/16
+    wgDeviceMTU: 1380
+    wgListenPort: 51821
+`)
+	config, err := parseConfig(rawYAMLConfig)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "local_cluster", config.Local.Name)
+	assert.Equal(t, 2, len(config.Remotes))
+	assert.Equal(t, true, config.Remotes[0].WGDeviceMTUAuto)
+	assert.Equal(t, Duration{10 * time.Second}, config.Remotes[0].ResyncPeriod)
+	assert.Equal(t, 1380, config.Remotes[1].WGDeviceMTU)
+	assert.Equal(t, 51821, config.Remotes[1].WGListenPort)
+
+	unknownYAMLField := []byte(`
+local:
+  name: local_cluster
+  nmae: foo
+`)
+	_, err = parseConfig(unknownYAMLField)
+	assert.Equal(t, fmt.Errorf("error unmarshalling config: json: unknown field \"nmae\""), err)
+}
+
+func TestConfigSchema(t *testing.T) {
+	schema, err := configSchema()
+	assert.Equal(t, nil, err)
+	published, err := os.ReadFile("config.schema.json")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, string(published), string(schema), "config.schema.json is out of date, run go generate")
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+
+	"github.com/utilitywarehouse/semaphore-wireguard/kube"
+)
+
+// remoteClientFromSecret returns a client for the remote cluster using the
+// credentials secret in the local cluster, along with the credentials data it
+// was created from.
+func remoteClientFromSecret(homeClient kubernetes.Interface, rConf *remoteClusterConfig, failover *kube.EndpointFailover) (*kubernetes.Clientset, string, error) {
+	if homeClient == nil {
+		return nil, "", fmt.Errorf("Reading credentials secret %s/%s requires a local cluster client", rConf.CredentialsSecret.Namespace, rConf.CredentialsSecret.Name)
+	}
+	secret, err := homeClient.CoreV1().Secrets(rConf.CredentialsSecret.Namespace).Get(context.Background(), rConf.CredentialsSecret.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, "", fmt.Errorf("Cannot get credentials secret: %v", err)
+	}
+	client, err := remoteClientFromSecretData(secret, rConf, failover)
+	if err != nil {
+		return nil, "", err
+	}
+	return client, credentialsData(secret, rConf.CredentialsSecret), nil
+}
+
+// remoteClientFromSecretData returns a client for the remote cluster using the
+// credentials in the secret. A kubeconfig in the secret takes precedence,
+// otherwise the secret must contain a token that is used with the remote API
+// URLs, and a CA or else the remote CA or CA URL. The failover, if not nil, selects
+// which of the remote API URLs requests are sent to, and cannot be used with a
+// kubeconfig.
+func remoteClientFromSecretData(secret *v1.Secret, rConf *remoteClusterConfig, failover *kube.EndpointFailover) (*kubernetes.Clientset, error) {
+	ref := rConf.CredentialsSecret
+	if kubeConfig, ok := secret.Data[ref.KubeConfigKey]; ok {
+		// Kubeconfigs set their own server, so the failover would report
+		// switches that never happen
+		if failover != nil {
+			return nil, fmt.Errorf("Credentials secret %s/%s has a %s key, which cannot be used with remoteAPIURLs", secret.Namespace, secret.Name, ref.KubeConfigKey)
+		}
+		// Resources must not be able to run commands via the kubeconfig
+		return kube.ClientFromKubeConfig(kubeConfig, !rConf.FromResource)
+	}
+	token := strings.TrimSpace(string(secret.Data[ref.TokenKey]))
+	if token == "" {
+		return nil, fmt.Errorf("Credentials secret %s/%s has neither a %s nor a %s key", secret.Namespace, secret.Name, ref.KubeConfigKey, ref.TokenKey)
+	}
+	if !bearerRe.MatchString(token) {
+		return nil, fmt.Errorf("The provided token does not match regex: %s", bearerRe.String())
+	}
+	apiURLs := rConf.apiURLs()
+	if len(apiURLs) == 0 {
+		return nil, fmt.Errorf("Using a token from the credentials secret requires remoteAPIURL or remoteAPIURLs")
+	}
+	opts := kube.ClientOptions{APIURL: apiURLs[0], Token: token, Failover: failover}
+	if ca, ok := secret.Data[ref.CAKey]; ok {
+		opts.CAData = ca
+	} else if rConf.RemoteCA != "" {
+		opts.CAData = []byte(rConf.RemoteCA)
+	} else if rConf.RemoteCAURL != "" {
+		opts.CAURL = rConf.RemoteCAURL
+	} else {
+		return nil, fmt.Errorf("Credentials secret %s/%s has no %s key and neither remoteCA nor remoteCAURL is set", secret.Namespace, secret.Name, ref.CAKey)
+	}
+	return kube.ClientFromOptions(opts)
+}
+
+// remoteClientFromInlineConfig returns a client for the remote cluster using
+// the remote API URLs, CA and credentials set in the remote config. The
+// failover, if not nil, selects which of the URLs requests are sent to.
+func remoteClientFromInlineConfig(rConf *remoteClusterConfig, failover *kube.EndpointFailover) (*kubernetes.Clientset, error) {
+	opts := kube.ClientOptions{
+		APIURL:   rConf.apiURLs()[0],
+		CAURL:    rConf.RemoteCAURL,
+		CAFile:   rConf.RemoteCAPath,
+		CAData:   []byte(rConf.RemoteCA),
+		CertFile: rConf.ClientCertPath,
+		KeyFile:  rConf.ClientKeyPath,
+		Failover: failover,
+	}
+	if rConf.RemoteSATokenPath != "" {
+		token, err := readSAToken(rConf.RemoteSATokenPath)
+		if err != nil {
+			return nil, err
+		}
+		opts.Token = token
+	}
+	if rConf.Exec != nil {
+		opts.Exec = rConf.Exec.clientcmdConfig()
+	}
+	return kube.ClientFromOptions(opts)
+}
+
+// clientcmdConfig returns the exec config in the form that the client
+// libraries expect. Plugins are never run interactively.
+func (e *execConfig) clientcmdConfig() *clientcmdapi.ExecConfig {
+	conf := &clientcmdapi.ExecConfig{
+		Command:         e.Command,
+		Args:            e.Args,
+		APIVersion:      e.APIVersion,
+		InteractiveMode: clientcmdapi.NeverExecInteractiveMode,
+	}
+	for _, env := range e.Env {
+		conf.Env = append(conf.Env, clientcmdapi.ExecEnvVar{Name: env.Name, Value: env.Value})
+	}
+	return conf
+}
+
+// newEndpointFailover returns a failover between the remote API URLs, or nil
+// if there is only one.
+func newEndpointFailover(rConf *remoteClusterConfig) (*kube.EndpointFailover, error) {
+	if len(rConf.apiURLs()) < 2 {
+		return nil, nil
+	}
+	return kube.NewEndpointFailover(rConf.apiURLs())
+}
+
+// credentialsData returns the secret data that remoteClientFromSecretData
+// uses, to tell if a secret update affects the remote client.
+func credentialsData(secret *v1.Secret, ref *secretReference) string {
+	return strings.Join([]string{
+		string(secret.Data[ref.KubeConfigKey]),
+		string(secret.Data[ref.TokenKey]),
+		string(secret.Data[ref.CAKey]),
+	}, "\x00")
+}
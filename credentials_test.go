@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/pem"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+
+	"github.com/utilitywarehouse/semaphore-wireguard/kube"
+)
+
+func TestRemoteClientFromSecretData(t *testing.T) {
+	rConf := &remoteClusterConfig{
+		Name:         "r1",
+		RemoteAPIURL: "https://remote.example.com",
+		CredentialsSecret: &secretReference{
+			Namespace:     "sys-semaphore",
+			Name:          "r1-credentials",
+			KubeConfigKey: "kubeconfig",
+			TokenKey:      "r1-token",
+			CAKey:         "ca.crt",
+		},
+	}
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "sys-semaphore", Name: "r1-credentials"},
+		Data: map[string][]byte{
+			"r1-token": []byte("token\n"),
+		},
+	}
+	_, err := remoteClientFromSecretData(secret, rConf, nil)
+	assert.Equal(t, fmt.Errorf("Credentials secret sys-semaphore/r1-credentials has no ca.crt key and neither remoteCA nor remoteCAURL is set"), err)
+
+	rConf.RemoteCAURL = "https://ca.example.com"
+	client, err := remoteClientFromSecretData(secret, rConf, nil)
+	assert.Equal(t, nil, err)
+	assert.NotEqual(t, nil, client)
+
+	secret.Data = map[string][]byte{"token": []byte("token")}
+	_, err = remoteClientFromSecretData(secret, rConf, nil)
+	assert.Equal(t, fmt.Errorf("Credentials secret sys-semaphore/r1-credentials has neither a kubeconfig nor a r1-token key"), err)
+
+	secret.Data = map[string][]byte{"kubeconfig": []byte("foo")}
+	_, err = remoteClientFromSecretData(secret, rConf, nil)
+	assert.NotEqual(t, nil, err)
+
+	// Remotes of resources cannot use exec plugins via the kubeconfig
+	secret.Data = map[string][]byte{"kubeconfig": []byte(`
+apiVersion: v1
+kind: Config
+clusters:
+- name: r1
+  cluster:
+    server: https://remote.example.com
+users:
+- name: r1
+  user:
+    exec:
+      apiVersion: client.authentication.k8s.io/v1
+      command: token-helper
+      interactiveMode: Never
+contexts:
+- name: r1
+  context:
+    cluster: r1
+    user: r1
+current-context: r1
+`)}
+	client, err = remoteClientFromSecretData(secret, rConf, nil)
+	assert.Equal(t, nil, err)
+	assert.NotEqual(t, nil, client)
+	rConf.FromResource = true
+	_, err = remoteClientFromSecretData(secret, rConf, nil)
+	assert.Equal(t, fmt.Errorf("exec credential plugins are not allowed in this kubeconfig"), err)
+
+	// Kubeconfigs cannot be used with a failover between the API URLs
+	failover, err := kube.NewEndpointFailover([]string{"https://api-a.example.com", "https://api-b.example.com"})
+	assert.Equal(t, nil, err)
+	_, err = remoteClientFromSecretData(secret, rConf, failover)
+	assert.Equal(t, fmt.Errorf("Credentials secret sys-semaphore/r1-credentials has a kubeconfig key, which cannot be used with remoteAPIURLs"), err)
+}
+
+func TestCredentialsData(t *testing.T) {
+	ref := &secretReference{KubeConfigKey: "kubeconfig", TokenKey: "token", CAKey: "ca.crt"}
+	secret := &v1.Secret{Data: map[string][]byte{
+		"token":  []byte("a"),
+		"ca.crt": []byte("b"),
+		"other":  []byte("c"),
+	}}
+	data := credentialsData(secret, ref)
+	secret.Data["other"] = []byte("d")
+	assert.Equal(t, data, credentialsData(secret, ref))
+	secret.Data["token"] = []byte("e")
+	assert.NotEqual(t, data, credentialsData(secret, ref))
+}
+
+func TestRemoteClientFromInlineConfig(t *testing.T) {
+	rConf := &remoteClusterConfig{
+		Name:         "r1",
+		RemoteAPIURL: "https://remote.example.com",
+		RemoteCAURL:  "https://ca.example.com",
+		Exec: &execConfig{
+			Command:    "token-helper",
+			Args:       []string{"token"},
+			Env:        []execEnvVar{{Name: "REGION", Value: "eu-west-1"}},
+			APIVersion: defaultExecAPIVersion,
+		},
+	}
+	assert.Equal(t, &clientcmdapi.ExecConfig{
+		Command:         "token-helper",
+		Args:            []string{"token"},
+		Env:             []clientcmdapi.ExecEnvVar{{Name: "REGION", Value: "eu-west-1"}},
+		APIVersion:      "client.authentication.k8s.io/v1",
+		InteractiveMode: clientcmdapi.NeverExecInteractiveMode,
+	}, rConf.Exec.clientcmdConfig())
+
+	// The client certificate is loaded when the CA is fetched from a URL
+	rConf.Exec = nil
+	rConf.ClientCertPath = "/non/existent/tls.crt"
+	rConf.ClientKeyPath = "/non/existent/tls.key"
+	_, err := remoteClientFromInlineConfig(rConf, nil)
+	assert.NotEqual(t, nil, err)
+
+	rConf.RemoteCAURL = ""
+	server := httptest.NewTLSServer(nil)
+	defer server.Close()
+	rConf.RemoteCA = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+	rConf.ClientCertPath = ""
+	rConf.ClientKeyPath = ""
+	rConf.Exec = &execConfig{Command: "token-helper", APIVersion: defaultExecAPIVersion}
+	client, err := remoteClientFromInlineConfig(rConf, nil)
+	assert.Equal(t, nil, err)
+	assert.NotEqual(t, nil, client)
+}
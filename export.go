@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/utilitywarehouse/semaphore-wireguard/kube"
+	"github.com/utilitywarehouse/semaphore-wireguard/log"
+	"github.com/utilitywarehouse/semaphore-wireguard/wireguard"
+)
+
+const redactedKey = "<redacted>"
+
+// exportInterface holds the [Interface] section of an exported config.
+type exportInterface struct {
+	privateKey string
+	address    net.IP // Local node's tunnel address, nil without a local tunnel range
+	listenPort int
+	fwMark     int
+	mtu        int
+}
+
+// exportResult holds the peers that a runner would configure, along with the
+// skipped ones and the local node's tunnel address.
+type exportResult struct {
+	peers      map[string]Peer
+	collisions []PeerCollision
+	invalid    map[string]string // Reasons for skipping invalid peers keyed by node name
+	address    net.IP
+}
+
+// runExport implements the export command, which writes a wg-quick style
+// config with the peers that the runner for a remote cluster would configure.
+// It returns the process exit code.
+func runExport(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	fs.SetOutput(out)
+	configPath := fs.String("clusters-config", getEnv("SWG_CLUSTERS_CONFIG", ""), "Path to the clusters' json or yaml config file")
+	keyPath := fs.String("wg-key-path", getEnv("SWG_WG_KEY_PATH", "/var/lib/semaphore-wireguard"), "Path to look for wg private key")
+	remote := fs.String("remote", "", "(Required) Name of the remote cluster to export the config for")
+	output := fs.String("output", "", "Path to write the config to, defaults to stdout")
+	redact := fs.Bool("redact", false, "Replace the private key with a placeholder")
+	nodeName := fs.String("node-name", getEnv("SWG_NODE_NAME", ""), "The local node to export the tunnel address of, required with a local tunnelAddressRange")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	log.InitLogger("semaphore-wireguard", "error")
+	if *configPath == "" || *remote == "" {
+		fmt.Fprintln(out, "Must specify a clusters config file location and a remote cluster")
+		fs.Usage()
+		return 2
+	}
+
+	fileContent, err := os.ReadFile(*configPath)
+	if err != nil {
+		fmt.Fprintf(out, "Cannot read clusters config file: %v\n", err)
+		return 1
+	}
+	config, err := parseConfig(fileContent)
+	if err != nil {
+		fmt.Fprintf(out, "Cannot parse clusters config: %v\n", err)
+		return 1
+	}
+	var rConf *remoteClusterConfig
+	for _, r := range config.Remotes {
+		if r.Name == *remote {
+			rConf = r
+		}
+	}
+	if rConf == nil {
+		fmt.Fprintf(out, "Remote cluster %s not found in config\n", *remote)
+		return 1
+	}
+
+	iface := exportInterface{
+		privateKey: redactedKey,
+		listenPort: rConf.WGListenPort,
+		fwMark:     rConf.WGFwMark,
+	}
+	if !rConf.WGDeviceMTUAuto {
+		iface.mtu = rConf.WGDeviceMTU
+	}
+	if !*redact {
+		wgDeviceName := fmt.Sprintf(wgDeviceNamePattern, rConf.Name)
+		kd, err := os.ReadFile(fmt.Sprintf("%s/%s.key", *keyPath, wgDeviceName))
+		if err != nil {
+			fmt.Fprintf(out, "Cannot read private key: %v\n", err)
+			return 1
+		}
+		key, err := wgtypes.ParseKey(string(kd))
+		if err != nil {
+			fmt.Fprintf(out, "Cannot parse private key: %v\n", err)
+			return 1
+		}
+		iface.privateKey = key.String()
+	}
+
+	res, err := exportPeers(config.Local, rConf, *nodeName)
+	if err != nil {
+		fmt.Fprintf(out, "Cannot calculate peers: %v\n", err)
+		return 1
+	}
+	iface.address = res.address
+	// Skipped peers are written as comments, so that the config stays
+	// valid when it is written to out
+	for _, c := range res.collisions {
+		fmt.Fprintf(out, "# Skipping colliding peers: %s\n", c)
+	}
+	var invalid []string
+	for node := range res.invalid {
+		invalid = append(invalid, node)
+	}
+	sort.Strings(invalid)
+	for _, node := range invalid {
+		fmt.Fprintf(out, "# Skipping invalid peer %s: %s\n", node, res.invalid[node])
+	}
+
+	w := out
+	if *output != "" {
+		f, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			fmt.Fprintf(out, "Cannot open output file: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	renderWGQuickConfig(w, rConf.Name, iface, res.peers)
+	return 0
+}
+
+// exportPeers lists the remote cluster's nodes and returns the peers for them
+// the same way a runner would, along with the tunnel address of the local node
+// if a local tunnel range is set.
+func exportPeers(local localClusterConfig, rConf *remoteClusterConfig, nodeName string) (*exportResult, error) {
+	if local.TunnelAddressRange != "" && nodeName == "" {
+		return nil, fmt.Errorf("Exporting the tunnel address requires the local node name")
+	}
+	var homeClient kubernetes.Interface
+	if rConf.CredentialsSecret != nil || local.TunnelAddressRange != "" {
+		c, err := kube.ClientFromConfig(local.KubeConfigPath)
+		if err != nil {
+			return nil, err
+		}
+		homeClient = c
+	}
+	client, _, err := makeRemoteClient(homeClient, rConf, nil)
+	if err != nil {
+		return nil, err
+	}
+	wgDeviceName := fmt.Sprintf(wgDeviceNamePattern, rConf.Name)
+	r := &Runner{
+		device:          wireguard.NewDevice(wgDeviceName, "", 0, 0, 0, wireguard.RouteConfig{}, "", wireguard.Namespaces{}),
+		remoteClient:    client,
+		subnetDiscovery: rConf.PodSubnetDiscovery,
+		keepalive:       rConf.PersistentKeepalive.Duration,
+		resolver:        newEndpointResolver(wgDeviceName),
+		annotations:     constructRunnerAnnotations(local.Name, rConf.Name),
+	}
+	// The config is validated, so the ranges parse
+	if rConf.PodSubnet != "" {
+		_, r.podSubnetConfig, _ = net.ParseCIDR(rConf.PodSubnet)
+		r.podSubnet = r.podSubnetConfig
+	}
+	if rConf.TunnelAddressRange != "" {
+		_, r.remoteTunnelRange, _ = net.ParseCIDR(rConf.TunnelAddressRange)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var localNode *v1.Node
+	if local.TunnelAddressRange != "" {
+		_, r.localTunnelRange, _ = net.ParseCIDR(local.TunnelAddressRange)
+		_, r.localPodSubnet, _ = net.ParseCIDR(local.PodSubnet)
+		localNode, err = homeClient.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("Cannot get local node: %v", err)
+		}
+	}
+	if r.subnetDiscovery != "" {
+		if _, err := r.discoverPodSubnet(); err != nil && r.podSubnet == nil {
+			return nil, err
+		}
+	}
+	list, err := client.CoreV1().Nodes().List(ctx, metav1.ListOptions{LabelSelector: rConf.NodeSelector})
+	if err != nil {
+		return nil, err
+	}
+	var nodes []*v1.Node
+	for i := range list.Items {
+		nodes = append(nodes, &list.Items[i])
+	}
+	return r.exportFromNodes(nodes, localNode)
+}
+
+// exportFromNodes returns the peers for the remote nodes that the runner would
+// configure, and the tunnel address of the local node if it is passed.
+func (r *Runner) exportFromNodes(nodes []*v1.Node, localNode *v1.Node) (*exportResult, error) {
+	peers, collisions := r.peersFromNodes(nodes)
+	valid, _, invalid := r.validPeers(peers)
+	res := &exportResult{peers: valid, collisions: collisions, invalid: invalid}
+	if localNode != nil {
+		addr, err := r.localTunnelAddress(localNode)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot calculate local tunnel address: %v", err)
+		}
+		res.address = addr
+	}
+	return res, nil
+}
+
+// renderWGQuickConfig writes a wg-quick style config. The peers are sorted by
+// node name, which is added as a comment. The config can be used with
+// `wg setconf` after stripping the Address and MTU lines with `wg-quick strip`.
+func renderWGQuickConfig(w io.Writer, remoteClusterName string, iface exportInterface, peers map[string]Peer) {
+	var sorted []Peer
+	for _, p := range peers {
+		sorted = append(sorted, p)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].nodeName < sorted[j].nodeName
+	})
+
+	fmt.Fprintf(w, "# Exported by semaphore-wireguard for remote cluster %s\n", remoteClusterName)
+	fmt.Fprintln(w, "[Interface]")
+	fmt.Fprintf(w, "PrivateKey = %s\n", iface.privateKey)
+	if iface.address != nil {
+		fmt.Fprintf(w, "Address = %s\n", hostIPNet(iface.address))
+	}
+	fmt.Fprintf(w, "ListenPort = %d\n", iface.listenPort)
+	if iface.fwMark != 0 {
+		fmt.Fprintf(w, "FwMark = %d\n", iface.fwMark)
+	}
+	if iface.mtu != 0 {
+		fmt.Fprintf(w, "MTU = %d\n", iface.mtu)
+	}
+	for _, p := range sorted {
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "# %s\n", p.nodeName)
+		fmt.Fprintln(w, "[Peer]")
+		fmt.Fprintf(w, "PublicKey = %s\n", p.publicKey)
+		if p.endpoint != "" {
+			fmt.Fprintf(w, "Endpoint = %s\n", p.endpoint)
+		}
+		fmt.Fprintf(w, "AllowedIPs = %s\n", strings.Join(p.allowedIPs, ", "))
+		if p.persistentKeepalive > 0 {
+			fmt.Fprintf(w, "PersistentKeepalive = %d\n", int(p.persistentKeepalive.Seconds()))
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"maps"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/utilitywarehouse/semaphore-wireguard/log"
+)
+
+func TestRenderWGQuickConfig(t *testing.T) {
+	peers := map[string]Peer{
+		"key-b": {nodeName: "node-b", publicKey: "key-b", endpoint: "10.0.0.2:51820", allowedIPs: []string{"10.4.1.0/24", "100.64.0.2/32"}},
+		"key-a": {nodeName: "node-a", publicKey: "key-a", endpoint: "node-a.example.com:51820", allowedIPs: []string{"10.4.0.0/24"}, persistentKeepalive: 25 * time.Second},
+	}
+	var out bytes.Buffer
+	renderWGQuickConfig(&out, "c2", exportInterface{privateKey: redactedKey, address: net.ParseIP("100.64.0.6"), listenPort: 51821, fwMark: 100, mtu: 1380}, peers)
+	expected := `# Exported by semaphore-wireguard for remote cluster c2
+[Interface]
+PrivateKey = <redacted>
+Address = 100.64.0.6/32
+ListenPort = 51821
+FwMark = 100
+MTU = 1380
+
+# node-a
+[Peer]
+PublicKey = key-a
+Endpoint = node-a.example.com:51820
+AllowedIPs = 10.4.0.0/24
+PersistentKeepalive = 25
+
+# node-b
+[Peer]
+PublicKey = key-b
+Endpoint = 10.0.0.2:51820
+AllowedIPs = 10.4.1.0/24, 100.64.0.2/32
+`
+	assert.Equal(t, expected, out.String())
+}
+
+func TestExportFromNodes(t *testing.T) {
+	log.InitLogger("export-test", "info")
+	_, podSubnet, _ := net.ParseCIDR("10.4.0.0/16")
+	_, localPodSubnet, _ := net.ParseCIDR("10.2.0.0/16")
+	_, localTunnelRange, _ := net.ParseCIDR("100.64.0.0/24")
+	r := &Runner{
+		podSubnet:        podSubnet,
+		localPodSubnet:   localPodSubnet,
+		localTunnelRange: localTunnelRange,
+		resolver:         newEndpointResolver("wireguard.c2"),
+		annotations:      constructRunnerAnnotations("c1", "c2"),
+	}
+	node := func(name, publicKey, endpoint, podCIDR string) *v1.Node {
+		return &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: name,
+				Annotations: map[string]string{
+					r.annotations.watchAnnotationWGPublicKey: publicKey,
+					r.annotations.watchAnnotationWGEndpoint:  endpoint,
+				},
+			},
+			Spec: v1.NodeSpec{PodCIDR: podCIDR},
+		}
+	}
+	key, err := wgtypes.GeneratePrivateKey()
+	assert.Equal(t, nil, err)
+	nodes := []*v1.Node{
+		node("node-a", key.PublicKey().String(), "10.0.0.1:51820", "10.4.0.0/24"),
+		node("node-b", "key-b", "10.0.0.2:51820", ""),
+		node("node-c", "key-c", "10.0.0.3:51820", "10.5.0.0/24"),
+		node("node-d", "key-d", "10.0.0.4", "10.4.3.0/24"),
+	}
+	localNode := &v1.Node{Spec: v1.NodeSpec{PodCIDR: "10.2.5.0/24"}}
+	res, err := r.exportFromNodes(nodes, localNode)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{key.PublicKey().String()}, slices.Collect(maps.Keys(res.peers)))
+	assert.Equal(t, []string{"node-b", "node-c", "node-d"}, slices.Sorted(maps.Keys(res.invalid)))
+	assert.Equal(t, "100.64.0.6", res.address.String())
+
+	// Without a local node, as with no local tunnel range, there is no address
+	res, err = r.exportFromNodes(nodes, nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, net.IP(nil), res.address)
+}
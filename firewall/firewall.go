@@ -0,0 +1,109 @@
+// Package firewall manages the host firewall rules for the wireguard devices,
+// using either nftables or iptables-legacy.
+package firewall
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+
+	"github.com/utilitywarehouse/semaphore-wireguard/log"
+)
+
+// Supported firewall backends.
+const (
+	BackendAuto     = "auto"
+	BackendNftables = "nftables"
+	BackendIptables = "iptables"
+)
+
+// Rules describes the firewall rules that should be in place for a wireguard
+// device. Zero values skip the respective rules.
+type Rules struct {
+	// ListenPort is the device's wg listen port.
+	ListenPort int
+	// Endpoints are the addresses that are allowed to reach the listen port.
+	Endpoints []net.IP
+	// PodSubnet is the remote pod subnet to allow forwarding from and to
+	// via the device.
+	PodSubnet *net.IPNet
+	// SNATAddress is the address to translate the source of traffic leaving
+	// via the device to, unless it originates from LocalPodCIDR.
+	SNATAddress  net.IP
+	LocalPodCIDR *net.IPNet
+}
+
+// Manager installs and removes the firewall rules for a wireguard device.
+type Manager interface {
+	// Apply replaces the rules for the device with the passed ones.
+	Apply(rules Rules) error
+	// Cleanup removes all the rules installed for the device.
+	Cleanup() error
+}
+
+// NetNSFunc runs fn in the network namespace that the rules belong to, which
+// the firewall commands run by fn inherit. A nil NetNSFunc runs fn in the
+// namespace of the process.
+type NetNSFunc = func(fn func() error) error
+
+// NewManager returns a Manager for the given device using the requested
+// backend. The auto backend will pick nftables if the nft binary is available
+// and fall back to iptables-legacy otherwise. The rules are managed in the
+// network namespace of inNetNS, which should be the device's.
+func NewManager(backend, deviceName string, inNetNS NetNSFunc) (Manager, error) {
+	c := commander{inNetNS: inNetNS}
+	if backend == BackendAuto {
+		backend = c.detectBackend()
+		log.Logger.Info("Detected firewall backend", "backend", backend)
+	}
+	switch backend {
+	case BackendNftables:
+		return &nftables{commander: c, device: deviceName}, nil
+	case BackendIptables:
+		return newIptables(c, deviceName), nil
+	default:
+		return nil, fmt.Errorf("Unknown firewall backend: %s", backend)
+	}
+}
+
+func (c commander) detectBackend() string {
+	if _, err := exec.LookPath(nftBinary); err != nil {
+		return BackendIptables
+	}
+	if err := c.run(nftBinary, "", "list", "tables"); err != nil {
+		return BackendIptables
+	}
+	return BackendNftables
+}
+
+// commander runs the firewall commands in the managed network namespace.
+type commander struct {
+	inNetNS NetNSFunc
+}
+
+// run executes the command with the given stdin and returns an error that
+// includes the command output in case of failure.
+func (c commander) run(name, stdin string, args ...string) error {
+	if c.inNetNS == nil {
+		return run(name, stdin, args...)
+	}
+	return c.inNetNS(func() error {
+		return run(name, stdin, args...)
+	})
+}
+
+func run(name, stdin string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s failed: %v: %s", name, strings.Join(args, " "), err, strings.TrimSpace(out.String()))
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package firewall
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/utilitywarehouse/semaphore-wireguard/log"
+)
+
+var testRules = Rules{
+	ListenPort:   51821,
+	Endpoints:    []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("fd00::1"), net.ParseIP("10.0.0.2")},
+	PodSubnet:    &net.IPNet{IP: net.ParseIP("10.4.0.0").To4(), Mask: net.CIDRMask(16, 32)},
+	SNATAddress:  net.ParseIP("10.2.5.1"),
+	LocalPodCIDR: &net.IPNet{IP: net.ParseIP("10.2.5.0").To4(), Mask: net.CIDRMask(24, 32)},
+}
+
+func TestNftablesRender(t *testing.T) {
+	n := &nftables{device: "wireguard.c2"}
+	expected := `table inet semaphore-wireguard.c2
+delete table inet semaphore-wireguard.c2
+table inet semaphore-wireguard.c2 {
+	chain input {
+		type filter hook input priority 0; policy accept;
+		udp dport 51821 ip saddr { 10.0.0.1, 10.0.0.2 } accept
+		udp dport 51821 ip6 saddr { fd00::1 } accept
+		udp dport 51821 drop
+	}
+	chain forward {
+		type filter hook forward priority 0; policy accept;
+		iifname "wireguard.c2" ip saddr 10.4.0.0/16 accept
+		oifname "wireguard.c2" ip daddr 10.4.0.0/16 accept
+	}
+	chain postrouting {
+		type nat hook postrouting priority 100; policy accept;
+		oifname "wireguard.c2" ip saddr != 10.2.5.0/24 snat ip to 10.2.5.1
+	}
+}
+`
+	assert.Equal(t, expected, n.render(testRules))
+
+	expected = `table inet semaphore-wireguard.c2
+delete table inet semaphore-wireguard.c2
+table inet semaphore-wireguard.c2 {
+	chain input {
+		type filter hook input priority 0; policy accept;
+		udp dport 51821 drop
+	}
+}
+`
+	assert.Equal(t, expected, n.render(Rules{ListenPort: 51821}))
+
+	expected = `table inet semaphore-wireguard.c2
+delete table inet semaphore-wireguard.c2
+table inet semaphore-wireguard.c2 {
+	chain postrouting {
+		type nat hook postrouting priority 100; policy accept;
+		oifname "wireguard.c2" snat ip to 100.64.0.5
+	}
+}
+`
+	assert.Equal(t, expected, n.render(Rules{SNATAddress: net.ParseIP("100.64.0.5")}))
+}
+
+func TestIptablesRender(t *testing.T) {
+	i := newIptables(commander{}, "wireguard.c2")
+	expected := `*filter
+:SWG-IN-wireguard.c2 - [0:0]
+:SWG-FWD-wireguard.c2 - [0:0]
+-A SWG-IN-wireguard.c2 -p udp --dport 51821 -s 10.0.0.1 -j ACCEPT
+-A SWG-IN-wireguard.c2 -p udp --dport 51821 -s 10.0.0.2 -j ACCEPT
+-A SWG-IN-wireguard.c2 -p udp --dport 51821 -j DROP
+-A SWG-FWD-wireguard.c2 -i wireguard.c2 -s 10.4.0.0/16 -j ACCEPT
+-A SWG-FWD-wireguard.c2 -o wireguard.c2 -d 10.4.0.0/16 -j ACCEPT
+COMMIT
+*nat
+:SWG-NAT-wireguard.c2 - [0:0]
+-A SWG-NAT-wireguard.c2 -o wireguard.c2 ! -s 10.2.5.0/24 -j SNAT --to-source 10.2.5.1
+COMMIT
+`
+	assert.Equal(t, expected, i.render(testRules))
+}
+
+func TestManagerRunsInNetNS(t *testing.T) {
+	log.InitLogger("firewall-test", "info")
+	// Every command runs in the namespace, which here skips running it
+	var calls int
+	inNetNS := func(fn func() error) error {
+		calls++
+		return nil
+	}
+	m, err := NewManager(BackendNftables, "wireguard.c2", inNetNS)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, m.Apply(testRules))
+	assert.Equal(t, 1, calls)
+
+	calls = 0
+	m, err = NewManager(BackendIptables, "wireguard.c2", inNetNS)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, m.Apply(testRules))
+	// The rules are restored and each jump is checked
+	assert.Equal(t, 4, calls)
+
+	calls = 0
+	err = m.Apply(Rules{SNATAddress: net.ParseIP("fd00:64::6")})
+	assert.Equal(t, fmt.Errorf("The iptables backend cannot masquerade to IPv6 address fd00:64::6, use nftables"), err)
+	assert.Equal(t, 0, calls)
+}
@@ -0,0 +1,146 @@
+package firewall
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/utilitywarehouse/semaphore-wireguard/log"
+)
+
+const (
+	iptablesLegacyBinary        = "iptables-legacy"
+	iptablesLegacyRestoreBinary = "iptables-legacy-restore"
+	iptablesBinary              = "iptables"
+	iptablesRestoreBinary       = "iptables-restore"
+	iptablesInputChainPrefix    = "SWG-IN-"
+	iptablesForwardChainPrefix  = "SWG-FWD-"
+	iptablesNATChainPrefix      = "SWG-NAT-"
+)
+
+// iptables manages dedicated chains per wireguard device, jumped to from the
+// builtin INPUT and FORWARD chains of the filter table and the POSTROUTING
+// chain of the nat table. Only IPv4 rules are supported.
+type iptables struct {
+	commander
+	device        string
+	binary        string
+	restoreBinary string
+	inputChain    string
+	forwardChain  string
+	natChain      string
+}
+
+// iptablesJump describes a jump from a builtin chain to a device chain.
+type iptablesJump struct {
+	table, builtin, chain string
+}
+
+func newIptables(c commander, deviceName string) *iptables {
+	binary, restoreBinary := iptablesLegacyBinary, iptablesLegacyRestoreBinary
+	if _, err := exec.LookPath(binary); err != nil {
+		binary, restoreBinary = iptablesBinary, iptablesRestoreBinary
+	}
+	return &iptables{
+		commander:     c,
+		device:        deviceName,
+		binary:        binary,
+		restoreBinary: restoreBinary,
+		inputChain:    iptablesInputChainPrefix + deviceName,
+		forwardChain:  iptablesForwardChainPrefix + deviceName,
+		natChain:      iptablesNATChainPrefix + deviceName,
+	}
+}
+
+func (i *iptables) jumps() []iptablesJump {
+	return []iptablesJump{
+		{"filter", "INPUT", i.inputChain},
+		{"filter", "FORWARD", i.forwardChain},
+		{"nat", "POSTROUTING", i.natChain},
+	}
+}
+
+// Apply implements Manager.
+func (i *iptables) Apply(rules Rules) error {
+	// IPv6 rules would need ip6tables
+	if rules.SNATAddress != nil && rules.SNATAddress.To4() == nil {
+		return fmt.Errorf("The iptables backend cannot masquerade to IPv6 address %s, use nftables", rules.SNATAddress)
+	}
+	log.Logger.Debug("Applying iptables rules", "device", i.device)
+	if err := i.run(i.restoreBinary, i.render(rules), "-w", "--noflush"); err != nil {
+		return err
+	}
+	for _, j := range i.jumps() {
+		if err := i.ensureJump(j); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Cleanup implements Manager.
+func (i *iptables) Cleanup() error {
+	log.Logger.Debug("Deleting iptables chains", "device", i.device)
+	for _, j := range i.jumps() {
+		if err := i.run(i.binary, "", "-w", "-t", j.table, "-C", j.builtin, "-j", j.chain); err == nil {
+			if err := i.run(i.binary, "", "-w", "-t", j.table, "-D", j.builtin, "-j", j.chain); err != nil {
+				return err
+			}
+		}
+		if err := i.run(i.binary, "", "-w", "-t", j.table, "-L", j.chain, "-n"); err != nil {
+			// chain does not exist
+			continue
+		}
+		if err := i.run(i.binary, "", "-w", "-t", j.table, "-F", j.chain); err != nil {
+			return err
+		}
+		if err := i.run(i.binary, "", "-w", "-t", j.table, "-X", j.chain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureJump inserts the jump at the top of the builtin chain, unless it
+// exists.
+func (i *iptables) ensureJump(j iptablesJump) error {
+	if err := i.run(i.binary, "", "-w", "-t", j.table, "-C", j.builtin, "-j", j.chain); err == nil {
+		return nil
+	}
+	return i.run(i.binary, "", "-w", "-t", j.table, "-I", j.builtin, "1", "-j", j.chain)
+}
+
+// render returns an iptables-restore input that flushes and populates the
+// device chains. Chains are always declared, so that jumps to them are valid
+// even when there are no rules.
+func (i *iptables) render(rules Rules) string {
+	var b strings.Builder
+	b.WriteString("*filter\n")
+	fmt.Fprintf(&b, ":%s - [0:0]\n", i.inputChain)
+	fmt.Fprintf(&b, ":%s - [0:0]\n", i.forwardChain)
+	if rules.ListenPort != 0 {
+		for _, ip := range rules.Endpoints {
+			if ip.To4() == nil {
+				continue
+			}
+			fmt.Fprintf(&b, "-A %s -p udp --dport %d -s %s -j ACCEPT\n", i.inputChain, rules.ListenPort, ip)
+		}
+		fmt.Fprintf(&b, "-A %s -p udp --dport %d -j DROP\n", i.inputChain, rules.ListenPort)
+	}
+	if rules.PodSubnet != nil && rules.PodSubnet.IP.To4() != nil {
+		fmt.Fprintf(&b, "-A %s -i %s -s %s -j ACCEPT\n", i.forwardChain, i.device, rules.PodSubnet)
+		fmt.Fprintf(&b, "-A %s -o %s -d %s -j ACCEPT\n", i.forwardChain, i.device, rules.PodSubnet)
+	}
+	b.WriteString("COMMIT\n")
+	b.WriteString("*nat\n")
+	fmt.Fprintf(&b, ":%s - [0:0]\n", i.natChain)
+	if rules.SNATAddress != nil {
+		fmt.Fprintf(&b, "-A %s -o %s", i.natChain, i.device)
+		if rules.LocalPodCIDR != nil {
+			fmt.Fprintf(&b, " ! -s %s", rules.LocalPodCIDR)
+		}
+		fmt.Fprintf(&b, " -j SNAT --to-source %s\n", rules.SNATAddress)
+	}
+	b.WriteString("COMMIT\n")
+	return b.String()
+}
@@ -0,0 +1,103 @@
+package firewall
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/utilitywarehouse/semaphore-wireguard/log"
+)
+
+const (
+	nftBinary          = "nft"
+	nftTableNamePrefix = "semaphore-"
+)
+
+// nftables manages a dedicated inet table per wireguard device. The whole
+// table is replaced atomically on every Apply.
+type nftables struct {
+	commander
+	device string
+}
+
+func (n *nftables) table() string {
+	return nftTableNamePrefix + n.device
+}
+
+// Apply implements Manager.
+func (n *nftables) Apply(rules Rules) error {
+	log.Logger.Debug("Applying nftables rules", "table", n.table())
+	return n.run(nftBinary, n.render(rules), "-f", "-")
+}
+
+// Cleanup implements Manager.
+func (n *nftables) Cleanup() error {
+	log.Logger.Debug("Deleting nftables table", "table", n.table())
+	// Declaring the table first makes the deletion idempotent.
+	script := fmt.Sprintf("table inet %[1]s\ndelete table inet %[1]s\n", n.table())
+	return n.run(nftBinary, script, "-f", "-")
+}
+
+// render returns an nft script that replaces the device table.
+func (n *nftables) render(rules Rules) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "table inet %s\n", n.table())
+	fmt.Fprintf(&b, "delete table inet %s\n", n.table())
+	fmt.Fprintf(&b, "table inet %s {\n", n.table())
+	if rules.ListenPort != 0 {
+		b.WriteString("\tchain input {\n")
+		b.WriteString("\t\ttype filter hook input priority 0; policy accept;\n")
+		groups := groupByFamily(rules.Endpoints)
+		for _, family := range []string{"ip", "ip6"} {
+			addrs, ok := groups[family]
+			if !ok {
+				continue
+			}
+			fmt.Fprintf(&b, "\t\tudp dport %d %s saddr { %s } accept\n", rules.ListenPort, family, strings.Join(addrs, ", "))
+		}
+		fmt.Fprintf(&b, "\t\tudp dport %d drop\n", rules.ListenPort)
+		b.WriteString("\t}\n")
+	}
+	if rules.PodSubnet != nil {
+		// An accept here only ends the evaluation of this table. Packets
+		// are still dropped by drop verdicts or policies of the forward
+		// hook chains in other tables, e.g. those of iptables-nft.
+		family := nftFamily(rules.PodSubnet.IP)
+		b.WriteString("\tchain forward {\n")
+		b.WriteString("\t\ttype filter hook forward priority 0; policy accept;\n")
+		fmt.Fprintf(&b, "\t\tiifname %q %s saddr %s accept\n", n.device, family, rules.PodSubnet)
+		fmt.Fprintf(&b, "\t\toifname %q %s daddr %s accept\n", n.device, family, rules.PodSubnet)
+		b.WriteString("\t}\n")
+	}
+	if rules.SNATAddress != nil {
+		family := nftFamily(rules.SNATAddress)
+		b.WriteString("\tchain postrouting {\n")
+		b.WriteString("\t\ttype nat hook postrouting priority 100; policy accept;\n")
+		fmt.Fprintf(&b, "\t\toifname %q", n.device)
+		if rules.LocalPodCIDR != nil {
+			fmt.Fprintf(&b, " %s saddr != %s", family, rules.LocalPodCIDR)
+		}
+		fmt.Fprintf(&b, " snat %s to %s\n", family, rules.SNATAddress)
+		b.WriteString("\t}\n")
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func nftFamily(ip net.IP) string {
+	if ip.To4() != nil {
+		return "ip"
+	}
+	return "ip6"
+}
+
+// groupByFamily returns the passed addresses as strings grouped by their nft
+// family.
+func groupByFamily(ips []net.IP) map[string][]string {
+	groups := map[string][]string{}
+	for _, ip := range ips {
+		f := nftFamily(ip)
+		groups[f] = append(groups[f], ip.String())
+	}
+	return groups
+}
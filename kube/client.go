@@ -9,9 +9,11 @@ import (
 	"io/ioutil"
 	"net/http"
 
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 
 	// in case of local kube config
 	_ "k8s.io/client-go/plugin/pkg/client/auth/oidc"
@@ -22,44 +24,112 @@ type certMan struct {
 }
 
 func (cm *certMan) verifyConn(cs tls.ConnectionState) error {
-	resp, err := http.Get(cm.caURL)
+	roots, err := FetchCA(cm.caURL)
 	if err != nil {
-		return fmt.Errorf("error getting remote CA from %s: %v", cm.caURL, err)
+		return err
+	}
+	opts := x509.VerifyOptions{
+		DNSName: cs.ServerName,
+		Roots:   roots,
+	}
+	_, err = cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// FetchCA downloads the PEM encoded CA certificates from caURL.
+func FetchCA(caURL string) (*x509.CertPool, error) {
+	resp, err := http.Get(caURL)
+	if err != nil {
+		return nil, fmt.Errorf("error getting remote CA from %s: %v", caURL, err)
 	}
 	defer func() {
 		io.Copy(ioutil.Discard, resp.Body)
 		resp.Body.Close()
 	}()
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("expected %d response from %s, got %d", http.StatusOK, cm.caURL, resp.StatusCode)
+		return nil, fmt.Errorf("expected %d response from %s, got %d", http.StatusOK, caURL, resp.StatusCode)
 	}
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return fmt.Errorf("error reading response body from %s: %v", cm.caURL, err)
+		return nil, fmt.Errorf("error reading response body from %s: %v", caURL, err)
 	}
 	roots := x509.NewCertPool()
 	ok := roots.AppendCertsFromPEM(body)
 	if !ok {
-		return fmt.Errorf("failed to parse root certificate from %s", cm.caURL)
+		return nil, fmt.Errorf("failed to parse root certificate from %s", caURL)
 	}
-	opts := x509.VerifyOptions{
-		DNSName: cs.ServerName,
-		Roots:   roots,
+	return roots, nil
+}
+
+// ClientOptions describe how to connect to a cluster without a kubeconfig. The
+// CA can be fetched from a URL on every connection, read from a file or given
+// inline. Authentication is with a bearer token, a client certificate and key
+// or an exec credential plugin. Requests are sent to the active endpoint of
+// the failover instead of the API URL, if set.
+type ClientOptions struct {
+	APIURL   string
+	CAURL    string
+	CAFile   string
+	CAData   []byte
+	Token    string
+	CertFile string
+	KeyFile  string
+	Exec     *clientcmdapi.ExecConfig
+	Failover *EndpointFailover
+}
+
+// ClientFromOptions returns a Kubernetes client (clientset) from the options
+func ClientFromOptions(o ClientOptions) (*kubernetes.Clientset, error) {
+	conf := &rest.Config{
+		Host:         o.APIURL,
+		BearerToken:  o.Token,
+		ExecProvider: o.Exec,
 	}
-	_, err = cs.PeerCertificates[0].Verify(opts)
-	return err
+	if o.Failover != nil {
+		conf.WrapTransport = o.Failover.WrapTransport
+	}
+	if o.CAURL != "" {
+		// A custom transport cannot be combined with the TLS options of
+		// the rest config, so the client certificate is loaded here
+		cm := &certMan{o.CAURL}
+		tlsConf := &tls.Config{
+			InsecureSkipVerify: true,
+			VerifyConnection:   cm.verifyConn,
+		}
+		if o.CertFile != "" {
+			cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load client certificate: %v", err)
+			}
+			tlsConf.Certificates = []tls.Certificate{cert}
+		}
+		conf.Transport = &http.Transport{TLSClientConfig: tlsConf}
+	} else {
+		conf.TLSClientConfig = rest.TLSClientConfig{
+			CAFile:   o.CAFile,
+			CAData:   o.CAData,
+			CertFile: o.CertFile,
+			KeyFile:  o.KeyFile,
+		}
+	}
+	return kubernetes.NewForConfig(conf)
 }
 
 // Client returns a Kubernetes client (clientset) from token, apiURL and caURL
 func Client(token, apiURL, caURL string) (*kubernetes.Clientset, error) {
-	cm := &certMan{caURL}
-	conf := &rest.Config{
-		Host: apiURL,
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-				VerifyConnection:   cm.verifyConn}},
-		BearerToken: token,
+	return ClientFromOptions(ClientOptions{APIURL: apiURL, CAURL: caURL, Token: token})
+}
+
+// ClientFromKubeConfig returns a Kubernetes client (clientset) from the
+// contents of a kubeconfig file. Unless allowExec is set, kubeconfigs that use
+// an exec credential plugin are rejected.
+func ClientFromKubeConfig(data []byte, allowExec bool) (*kubernetes.Clientset, error) {
+	conf, err := clientcmd.RESTConfigFromKubeConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Kubernetes client config: %v", err)
+	}
+	if conf.ExecProvider != nil && !allowExec {
+		return nil, fmt.Errorf("exec credential plugins are not allowed in this kubeconfig")
 	}
 	return kubernetes.NewForConfig(conf)
 }
@@ -74,6 +144,16 @@ func ClientFromConfig(path string) (*kubernetes.Clientset, error) {
 	return kubernetes.NewForConfig(conf)
 }
 
+// DynamicClientFromConfig returns a dynamic Kubernetes client from the
+// kubeconfig path or from the in-cluster service account environment.
+func DynamicClientFromConfig(path string) (dynamic.Interface, error) {
+	conf, err := getClientConfig(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Kubernetes client config: %v", err)
+	}
+	return dynamic.NewForConfig(conf)
+}
+
 // getClientConfig returns a Kubernetes client Config.
 func getClientConfig(path string) (*rest.Config, error) {
 	if path != "" {
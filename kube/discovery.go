@@ -0,0 +1,181 @@
+package kube
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+// Supported pod subnet discovery methods.
+const (
+	PodSubnetDiscoveryCalico  = "calico"
+	PodSubnetDiscoveryKubeadm = "kubeadm"
+	PodSubnetDiscoveryNodes   = "nodes"
+)
+
+const calicoIPPoolsPath = "/apis/crd.projectcalico.org/v1/ippools"
+
+// DiscoverPodSubnet derives a cluster's pod subnet using the given method. It
+// returns the smallest subnet that contains all the IPv4 pod networks found,
+// which are the enabled Calico IPPools, the podSubnet of the kubeadm
+// ClusterConfiguration or the nodes' PodCIDRs, and fails if there are gaps
+// between the networks.
+func DiscoverPodSubnet(client kubernetes.Interface, method string) (*net.IPNet, error) {
+	ctx := context.Background()
+	var subnets []*net.IPNet
+	var err error
+	switch method {
+	case PodSubnetDiscoveryCalico:
+		var data []byte
+		data, err = client.Discovery().RESTClient().Get().AbsPath(calicoIPPoolsPath).DoRaw(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot list Calico IPPools: %v", err)
+		}
+		subnets, err = calicoPoolsSubnets(data)
+	case PodSubnetDiscoveryKubeadm:
+		cm, cmErr := client.CoreV1().ConfigMaps(metav1.NamespaceSystem).Get(ctx, "kubeadm-config", metav1.GetOptions{})
+		if cmErr != nil {
+			return nil, fmt.Errorf("Cannot get kubeadm config: %v", cmErr)
+		}
+		subnets, err = kubeadmSubnets(cm.Data["ClusterConfiguration"])
+	case PodSubnetDiscoveryNodes:
+		nodes, listErr := client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+		if listErr != nil {
+			return nil, fmt.Errorf("Cannot list nodes: %v", listErr)
+		}
+		var cidrs []string
+		for _, n := range nodes.Items {
+			cidrs = append(cidrs, n.Spec.PodCIDRs...)
+			if len(n.Spec.PodCIDRs) == 0 && n.Spec.PodCIDR != "" {
+				cidrs = append(cidrs, n.Spec.PodCIDR)
+			}
+		}
+		subnets, err = parseIPv4Subnets(cidrs)
+	default:
+		return nil, fmt.Errorf("Unknown pod subnet discovery method: %s", method)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(subnets) == 0 {
+		return nil, fmt.Errorf("No pod subnets found using the %s discovery method", method)
+	}
+	return AggregateSubnets(subnets)
+}
+
+// calicoPoolsSubnets returns the subnets of the enabled pools in a Calico
+// IPPoolList.
+func calicoPoolsSubnets(data []byte) ([]*net.IPNet, error) {
+	list := struct {
+		Items []struct {
+			Spec struct {
+				CIDR     string `json:"cidr"`
+				Disabled bool   `json:"disabled"`
+			} `json:"spec"`
+		} `json:"items"`
+	}{}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("Cannot decode Calico IPPools: %v", err)
+	}
+	var cidrs []string
+	for _, pool := range list.Items {
+		if !pool.Spec.Disabled {
+			cidrs = append(cidrs, pool.Spec.CIDR)
+		}
+	}
+	return parseIPv4Subnets(cidrs)
+}
+
+// kubeadmSubnets returns the pod subnets of a kubeadm ClusterConfiguration.
+// Dual stack clusters list comma separated subnets.
+func kubeadmSubnets(clusterConfiguration string) ([]*net.IPNet, error) {
+	conf := struct {
+		Networking struct {
+			PodSubnet string `json:"podSubnet"`
+		} `json:"networking"`
+	}{}
+	if err := yaml.Unmarshal([]byte(clusterConfiguration), &conf); err != nil {
+		return nil, fmt.Errorf("Cannot decode kubeadm ClusterConfiguration: %v", err)
+	}
+	if conf.Networking.PodSubnet == "" {
+		return nil, nil
+	}
+	return parseIPv4Subnets(strings.Split(conf.Networking.PodSubnet, ","))
+}
+
+// parseIPv4Subnets parses the passed cidrs, skipping IPv6 ones.
+func parseIPv4Subnets(cidrs []string) ([]*net.IPNet, error) {
+	var subnets []*net.IPNet
+	for _, c := range cidrs {
+		_, subnet, err := net.ParseCIDR(strings.TrimSpace(c))
+		if err != nil {
+			return nil, fmt.Errorf("Cannot parse pod subnet: %v", err)
+		}
+		if subnet.IP.To4() == nil {
+			continue
+		}
+		subnets = append(subnets, subnet)
+	}
+	return subnets, nil
+}
+
+// AggregateSubnets returns the smallest subnet that contains all the passed
+// IPv4 subnets. It fails if there are gaps between the subnets, for example for
+// disjoint pools, so that routing to the aggregate does not capture unrelated
+// traffic. The aggregate may still extend past the first and last subnets,
+// like when node PodCIDRs do not fill a power of two block.
+func AggregateSubnets(subnets []*net.IPNet) (*net.IPNet, error) {
+	first := new(big.Int).SetBytes(subnets[0].IP.To4())
+	ones, _ := subnets[0].Mask.Size()
+	for _, s := range subnets[1:] {
+		ip := new(big.Int).SetBytes(s.IP.To4())
+		sOnes, _ := s.Mask.Size()
+		if sOnes < ones {
+			ones = sOnes
+		}
+		// Shorten the prefix until both addresses share it
+		for ones > 0 && new(big.Int).Rsh(first, uint(32-ones)).Cmp(new(big.Int).Rsh(ip, uint(32-ones))) != 0 {
+			ones--
+		}
+	}
+	mask := net.CIDRMask(ones, 32)
+	aggregate := &net.IPNet{IP: subnets[0].IP.To4().Mask(mask), Mask: mask}
+	if hasGaps(subnets) {
+		return nil, fmt.Errorf("Pod subnets %v are not contiguous, aggregating them into %s would cover other addresses", subnets, aggregate)
+	}
+	return aggregate, nil
+}
+
+// hasGaps returns true if there are addresses between the IPv4 subnets that
+// none of them contains.
+func hasGaps(subnets []*net.IPNet) bool {
+	type addrRange struct{ first, last uint64 }
+	ranges := make([]addrRange, 0, len(subnets))
+	for _, s := range subnets {
+		first := uint64(binary.BigEndian.Uint32(s.IP.To4()))
+		ones, _ := s.Mask.Size()
+		ranges = append(ranges, addrRange{first, first + uint64(1)<<(32-ones) - 1})
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].first < ranges[j].first
+	})
+	last := ranges[0].last
+	for _, r := range ranges[1:] {
+		if r.first > last+1 {
+			return true
+		}
+		if r.last > last {
+			last = r.last
+		}
+	}
+	return false
+}
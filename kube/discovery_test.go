@@ -0,0 +1,101 @@
+package kube
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestAggregateSubnets(t *testing.T) {
+	aggregate := func(cidrs ...string) string {
+		subnets, _ := parseIPv4Subnets(cidrs)
+		subnet, err := AggregateSubnets(subnets)
+		if err != nil {
+			return err.Error()
+		}
+		return subnet.String()
+	}
+	assert.Equal(t, "10.4.0.0/24", aggregate("10.4.0.0/24"))
+	assert.Equal(t, "10.4.0.0/23", aggregate("10.4.0.0/24", "10.4.1.0/24"))
+	assert.Equal(t, "10.4.0.0/22", aggregate("10.4.0.0/23", "10.4.3.0/24", "10.4.2.0/24", "10.4.2.0/24"))
+	assert.Equal(t, "10.4.0.0/16", aggregate("10.4.0.0/24", "10.4.0.0/16"))
+	assert.Equal(t, "10.4.0.0/24", aggregate("10.4.0.0/24", "fd00::/64"))
+	// Blocks that do not fill the aggregate are fine without gaps
+	assert.Equal(t, "10.4.0.0/22", aggregate("10.4.0.0/24", "10.4.1.0/24", "10.4.2.0/24"))
+	assert.Equal(t, "10.4.0.0/22", aggregate("10.4.1.0/24", "10.4.2.0/24"))
+	assert.Equal(t, "10.4.0.0/21", aggregate("10.4.2.0/23", "10.4.4.0/24", "10.4.0.0/23"))
+	assert.Equal(t, "Pod subnets [10.4.0.0/24 10.4.2.0/24] are not contiguous, aggregating them into 10.4.0.0/22 would cover other addresses", aggregate("10.4.0.0/24", "10.4.2.0/24"))
+	assert.Equal(t, "Pod subnets [10.4.0.0/24 10.4.3.0/24] are not contiguous, aggregating them into 10.4.0.0/22 would cover other addresses", aggregate("10.4.0.0/24", "10.4.3.0/24"))
+	assert.Equal(t, "Pod subnets [10.4.0.0/24 192.168.0.0/24] are not contiguous, aggregating them into 0.0.0.0/0 would cover other addresses", aggregate("10.4.0.0/24", "192.168.0.0/24"))
+}
+
+func TestDiscoverPodSubnet(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		&v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "node-a"},
+			Spec:       v1.NodeSpec{PodCIDR: "10.4.0.0/24", PodCIDRs: []string{"10.4.0.0/24", "fd00::/64"}},
+		},
+		&v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "node-b"},
+			Spec:       v1.NodeSpec{PodCIDR: "10.4.1.0/24"},
+		},
+		&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "kubeadm-config", Namespace: "kube-system"},
+			Data: map[string]string{"ClusterConfiguration": `
+apiVersion: kubeadm.k8s.io/v1beta3
+kind: ClusterConfiguration
+networking:
+  podSubnet: 10.244.0.0/16,fd00:10:244::/56
+`},
+		},
+	)
+	subnet, err := DiscoverPodSubnet(client, PodSubnetDiscoveryNodes)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "10.4.0.0/23", subnet.String())
+
+	// Nodes that do not fill a power of two block
+	_, err = client.CoreV1().Nodes().Create(t.Context(), &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-c"},
+		Spec:       v1.NodeSpec{PodCIDR: "10.4.2.0/24"},
+	}, metav1.CreateOptions{})
+	assert.Equal(t, nil, err)
+	subnet, err = DiscoverPodSubnet(client, PodSubnetDiscoveryNodes)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "10.4.0.0/22", subnet.String())
+
+	// Added nodes extend the subnet
+	for _, n := range []struct{ name, podCIDR string }{{"node-d", "10.4.3.0/24"}, {"node-e", "10.4.4.0/24"}} {
+		_, err = client.CoreV1().Nodes().Create(t.Context(), &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: n.name},
+			Spec:       v1.NodeSpec{PodCIDR: n.podCIDR},
+		}, metav1.CreateOptions{})
+		assert.Equal(t, nil, err)
+	}
+	subnet, err = DiscoverPodSubnet(client, PodSubnetDiscoveryNodes)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "10.4.0.0/21", subnet.String())
+
+	// Removing a node in the middle leaves a gap
+	assert.Equal(t, nil, client.CoreV1().Nodes().Delete(t.Context(), "node-c", metav1.DeleteOptions{}))
+	_, err = DiscoverPodSubnet(client, PodSubnetDiscoveryNodes)
+	assert.NotEqual(t, nil, err)
+
+	subnet, err = DiscoverPodSubnet(client, PodSubnetDiscoveryKubeadm)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "10.244.0.0/16", subnet.String())
+}
+
+func TestCalicoPoolsSubnets(t *testing.T) {
+	data := []byte(`{"items":[
+	  {"spec":{"cidr":"10.4.0.0/16"}},
+	  {"spec":{"cidr":"10.5.0.0/16","disabled":true}},
+	  {"spec":{"cidr":"fd00::/48"}}
+	]}`)
+	subnets, err := calicoPoolsSubnets(data)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(subnets))
+	assert.Equal(t, "10.4.0.0/16", subnets[0].String())
+}
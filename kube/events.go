@@ -0,0 +1,29 @@
+package kube
+
+import (
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// NewEventRecorder returns an EventRecorder that creates events via the passed
+// client, using the given component and host as the events source.
+func NewEventRecorder(client kubernetes.Interface, component, host string) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: component, Host: host})
+}
+
+// NodeReference returns a reference to the named node to record events
+// against. Like the kubelet, it uses the node name as the UID so that the
+// events show up when describing the node.
+func NodeReference(name string) *v1.ObjectReference {
+	return &v1.ObjectReference{
+		Kind: "Node",
+		Name: name,
+		UID:  types.UID(name),
+	}
+}
@@ -0,0 +1,149 @@
+package kube
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/rest"
+
+	"github.com/utilitywarehouse/semaphore-wireguard/log"
+)
+
+const endpointProbeTimeout = 5 * time.Second
+
+type endpointKey struct{}
+
+// EndpointFailover sends the requests of clients to the first healthy API
+// server endpoint of a list, in order of preference. Endpoints are health
+// checked periodically and when requests to the active one fail.
+type EndpointFailover struct {
+	endpoints []*url.URL
+	mu        sync.Mutex
+	active    int
+	check     chan struct{}
+}
+
+// NewEndpointFailover returns a failover for the API server URLs, which must
+// only differ in scheme, host and port. The first URL is active initially.
+func NewEndpointFailover(endpoints []string) (*EndpointFailover, error) {
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("no API server endpoints")
+	}
+	f := &EndpointFailover{check: make(chan struct{}, 1)}
+	for i, e := range endpoints {
+		u, err := url.Parse(e)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse API server URL %s: %v", e, err)
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("API server URL %s must set a scheme and host", e)
+		}
+		if i > 0 && u.Path != f.endpoints[0].Path {
+			return nil, fmt.Errorf("API server URL %s has a different path than %s", e, endpoints[0])
+		}
+		f.endpoints = append(f.endpoints, u)
+	}
+	return f, nil
+}
+
+// Endpoints returns the API server URLs in order of preference.
+func (f *EndpointFailover) Endpoints() []string {
+	var endpoints []string
+	for _, u := range f.endpoints {
+		endpoints = append(endpoints, u.String())
+	}
+	return endpoints
+}
+
+// Active returns the URL of the endpoint that requests are sent to.
+func (f *EndpointFailover) Active() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.endpoints[f.active].String()
+}
+
+// WrapTransport returns a transport that sends requests to the active
+// endpoint, or to the endpoint of a probe. It can be set as the WrapTransport
+// of a client config.
+func (f *EndpointFailover) WrapTransport(rt http.RoundTripper) http.RoundTripper {
+	return &failoverTransport{failover: f, rt: rt}
+}
+
+type failoverTransport struct {
+	failover *EndpointFailover
+	rt       http.RoundTripper
+}
+
+func (t *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	f := t.failover
+	i, probe := req.Context().Value(endpointKey{}).(int)
+	if !probe {
+		f.mu.Lock()
+		i = f.active
+		f.mu.Unlock()
+	}
+	req = req.Clone(req.Context())
+	req.URL.Scheme = f.endpoints[i].Scheme
+	req.URL.Host = f.endpoints[i].Host
+	req.Host = ""
+	resp, err := t.rt.RoundTrip(req)
+	if err != nil && !probe && req.Context().Err() == nil {
+		// Check the endpoints without waiting for the next interval
+		select {
+		case f.check <- struct{}{}:
+		default:
+		}
+	}
+	return resp, err
+}
+
+// Probe checks the readiness of the endpoint at index i. The client must use
+// the failover transport.
+func (f *EndpointFailover) Probe(ctx context.Context, client rest.Interface, i int) error {
+	ctx, cancel := context.WithTimeout(context.WithValue(ctx, endpointKey{}, i), endpointProbeTimeout)
+	defer cancel()
+	_, err := client.Get().AbsPath("/readyz").DoRaw(ctx)
+	return err
+}
+
+// Run probes the endpoints every interval, or when requests to the active
+// endpoint fail, until stop is closed, and activates the first ready one. The
+// active endpoint is kept if none is ready. The client function returns the
+// current client to probe with, and the handler is called when the active
+// endpoint changes.
+func (f *EndpointFailover) Run(stop <-chan struct{}, interval time.Duration, client func() rest.Interface, handler func(old, new string)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		case <-f.check:
+		}
+		f.update(client(), handler)
+	}
+}
+
+// update activates the first ready endpoint.
+func (f *EndpointFailover) update(client rest.Interface, handler func(old, new string)) {
+	for i, u := range f.endpoints {
+		if err := f.Probe(context.Background(), client, i); err != nil {
+			log.Logger.Debug("API server endpoint is not ready", "endpoint", u.String(), "err", err)
+			continue
+		}
+		f.mu.Lock()
+		old := f.active
+		f.active = i
+		f.mu.Unlock()
+		if old != i {
+			handler(f.endpoints[old].String(), u.String())
+		}
+		return
+	}
+	log.Logger.Warn("No API server endpoint is ready, keeping the active one", "endpoint", f.Active())
+}
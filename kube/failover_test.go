@@ -0,0 +1,71 @@
+package kube
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/utilitywarehouse/semaphore-wireguard/log"
+)
+
+func TestNewEndpointFailover(t *testing.T) {
+	_, err := NewEndpointFailover(nil)
+	assert.NotEqual(t, nil, err)
+	_, err = NewEndpointFailover([]string{"api.example.com"})
+	assert.NotEqual(t, nil, err)
+	_, err = NewEndpointFailover([]string{"https://api-a.example.com", "https://api-b.example.com/prefix"})
+	assert.NotEqual(t, nil, err)
+	f, err := NewEndpointFailover([]string{"https://api-a.example.com", "https://api-b.example.com:6443"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"https://api-a.example.com", "https://api-b.example.com:6443"}, f.Endpoints())
+	assert.Equal(t, "https://api-a.example.com", f.Active())
+}
+
+func TestEndpointFailover(t *testing.T) {
+	log.InitLogger("failover-test", "info")
+	ready := map[string]bool{}
+	newServer := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !ready[name] {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			if r.URL.Path == "/api/v1/nodes" {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"kind":"NodeList","apiVersion":"v1","metadata":{"resourceVersion":"` + name + `"},"items":[]}`))
+			}
+		}))
+	}
+	a := newServer("a")
+	defer a.Close()
+	b := newServer("b")
+	defer b.Close()
+
+	f, err := NewEndpointFailover([]string{a.URL, b.URL})
+	assert.Equal(t, nil, err)
+	client, err := ClientFromOptions(ClientOptions{APIURL: a.URL, Failover: f})
+	assert.Equal(t, nil, err)
+	var changes [][2]string
+	handler := func(old, new string) { changes = append(changes, [2]string{old, new}) }
+
+	// The active endpoint is kept when none is ready
+	f.update(client.Discovery().RESTClient(), handler)
+	assert.Equal(t, a.URL, f.Active())
+
+	ready["b"] = true
+	f.update(client.Discovery().RESTClient(), handler)
+	assert.Equal(t, b.URL, f.Active())
+	nodes, err := client.CoreV1().Nodes().List(context.Background(), metav1.ListOptions{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "b", nodes.ResourceVersion)
+
+	// The first endpoint is preferred once ready
+	ready["a"] = true
+	f.update(client.Discovery().RESTClient(), handler)
+	assert.Equal(t, a.URL, f.Active())
+	assert.Equal(t, [][2]string{{a.URL, b.URL}, {b.URL, a.URL}}, changes)
+}
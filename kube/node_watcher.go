@@ -3,6 +3,8 @@ package kube
 import (
 	"context"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	v1 "k8s.io/api/core/v1"
@@ -19,27 +21,45 @@ import (
 // NodeEventHandler is the function to handle new events
 type NodeEventHandler = func(eventType watch.EventType, old *v1.Node, new *v1.Node)
 
+// ErrorHandler is the function to handle list and watch errors
+type ErrorHandler = func(verb string, err error)
+
+// RecoveryHandler is the function to handle recovering from list or watch
+// errors, once the nodes relisted after them are in the store
+type RecoveryHandler = func()
+
 // NodeWatcher has a watch on the clients nodes
 type NodeWatcher struct {
-	ctx          context.Context
-	client       kubernetes.Interface
-	clusterName  string
-	resyncPeriod time.Duration
-	stopChannel  chan struct{}
-	store        cache.Store
-	controller   cache.Controller
-	eventHandler NodeEventHandler
+	ctx             context.Context
+	client          kubernetes.Interface
+	clusterName     string
+	selector        string
+	resyncPeriod    time.Duration
+	stopChannel     chan struct{}
+	stopOnce        sync.Once
+	store           cache.Store
+	controller      cache.Controller
+	eventHandler    NodeEventHandler
+	errorHandler    ErrorHandler
+	recoveryHandler RecoveryHandler
+	failing         atomic.Bool // Set after list or watch errors until the watcher recovers
+	relistMu        sync.Mutex
+	relistPending   map[string]bool // Keys that a relist after errors has yet to update in the store, guarded by relistMu
 }
 
-// NewNodeWatcher returns a new node wathcer.
-func NewNodeWatcher(client kubernetes.Interface, resyncPeriod time.Duration, handler NodeEventHandler, clusterName string) *NodeWatcher {
+// NewNodeWatcher returns a new node wathcer. A non empty label selector limits
+// the watched nodes.
+func NewNodeWatcher(client kubernetes.Interface, resyncPeriod time.Duration, handler NodeEventHandler, errorHandler ErrorHandler, recoveryHandler RecoveryHandler, clusterName, selector string) *NodeWatcher {
 	return &NodeWatcher{
-		ctx:          context.Background(),
-		client:       client,
-		clusterName:  clusterName,
-		resyncPeriod: resyncPeriod,
-		stopChannel:  make(chan struct{}),
-		eventHandler: handler,
+		ctx:             context.Background(),
+		client:          client,
+		clusterName:     clusterName,
+		selector:        selector,
+		resyncPeriod:    resyncPeriod,
+		stopChannel:     make(chan struct{}),
+		eventHandler:    handler,
+		errorHandler:    errorHandler,
+		recoveryHandler: recoveryHandler,
 	}
 }
 
@@ -47,34 +67,175 @@ func NewNodeWatcher(client kubernetes.Interface, resyncPeriod time.Duration, han
 func (nw *NodeWatcher) Init() {
 	listWatch := &cache.ListWatch{
 		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.LabelSelector = nw.selector
 			l, err := nw.client.CoreV1().Nodes().List(nw.ctx, options)
 			if err != nil {
 				log.Logger.Error("nw: list error", "err", err)
 				metrics.IncNodeWatcherFailures(nw.clusterName, "list")
+				nw.onError("list", err)
 			}
+			// On success, the watcher recovers once the listed nodes
+			// replace the store contents
 			return l, err
 		},
 		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.LabelSelector = nw.selector
 			w, err := nw.client.CoreV1().Nodes().Watch(nw.ctx, options)
 			if err != nil {
 				log.Logger.Error("nw: watch error", "err", err)
 				metrics.IncNodeWatcherFailures(nw.clusterName, "watch")
+				nw.onError("watch", err)
+			} else if options.SendInitialEvents == nil || !*options.SendInitialEvents {
+				// A watch that resumes from the last seen resource
+				// version keeps the store up to date, while one that
+				// streams the initial events is a relist
+				nw.onWatchResumed()
 			}
 			return w, err
 		},
 	}
-	eventHandler := cache.ResourceEventHandlerFuncs{
-		AddFunc: func(obj interface{}) {
-			nw.eventHandler(watch.Added, nil, obj.(*v1.Node))
-		},
-		UpdateFunc: func(oldObj, newObj interface{}) {
-			nw.eventHandler(watch.Modified, oldObj.(*v1.Node), newObj.(*v1.Node))
-		},
-		DeleteFunc: func(obj interface{}) {
-			nw.eventHandler(watch.Deleted, obj.(*v1.Node), nil)
+	nw.store = cache.NewStore(cache.DeletionHandlingMetaNamespaceKeyFunc)
+	queue := &relistQueue{
+		DeltaFIFO: cache.NewDeltaFIFOWithOptions(cache.DeltaFIFOOptions{
+			KnownObjects:          nw.store,
+			EmitDeltaTypeReplaced: true,
+		}),
+		onReplace: nw.onReplace,
+	}
+	nw.controller = cache.New(&cache.Config{
+		Queue:            queue,
+		ListerWatcher:    cache.ToListWatcherWithWatchListSemantics(listWatch, nw.client),
+		ObjectType:       &v1.Node{},
+		FullResyncPeriod: nw.resyncPeriod,
+		Process: func(obj interface{}, _ bool) error {
+			deltas, ok := obj.(cache.Deltas)
+			if !ok {
+				return fmt.Errorf("unexpected object in queue: %+v", obj)
+			}
+			return nw.process(deltas)
 		},
+	})
+}
+
+// relistQueue is a DeltaFIFO that reports the items of each relist before
+// queueing them, so that the watcher can tell when they reach the store.
+type relistQueue struct {
+	*cache.DeltaFIFO
+	onReplace func(list []interface{})
+}
+
+// Replace reports the list and replaces the queue contents with it.
+func (q *relistQueue) Replace(list []interface{}, resourceVersion string) error {
+	q.onReplace(list)
+	return q.DeltaFIFO.Replace(list, resourceVersion)
+}
+
+// process applies the deltas of a node to the store and calls the event
+// handler, the same way informers do.
+func (nw *NodeWatcher) process(deltas cache.Deltas) error {
+	for _, d := range deltas {
+		switch d.Type {
+		case cache.Sync, cache.Replaced, cache.Added, cache.Updated:
+			old, exists, err := nw.store.Get(d.Object)
+			if err != nil {
+				return err
+			}
+			if exists {
+				if err := nw.store.Update(d.Object); err != nil {
+					return err
+				}
+				nw.eventHandler(watch.Modified, old.(*v1.Node), d.Object.(*v1.Node))
+			} else {
+				if err := nw.store.Add(d.Object); err != nil {
+					return err
+				}
+				nw.eventHandler(watch.Added, nil, d.Object.(*v1.Node))
+			}
+		case cache.Deleted:
+			if err := nw.store.Delete(d.Object); err != nil {
+				return err
+			}
+			obj := d.Object
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if node, ok := obj.(*v1.Node); ok {
+				nw.eventHandler(watch.Deleted, node, nil)
+			}
+		}
+	}
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(deltas.Newest().Object)
+	if err != nil {
+		return err
+	}
+	nw.onProcessed(key)
+	return nil
+}
+
+// onError marks the watcher as failing and calls the error handler.
+func (nw *NodeWatcher) onError(verb string, err error) {
+	nw.failing.Store(true)
+	nw.errorHandler(verb, err)
+}
+
+// onReplace records the keys that a relist after errors will update in the
+// store: the listed nodes, and the nodes in the store that will be deleted.
+func (nw *NodeWatcher) onReplace(list []interface{}) {
+	if !nw.failing.Load() {
+		return
+	}
+	pending := map[string]bool{}
+	for _, obj := range list {
+		if key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj); err == nil {
+			pending[key] = true
+		}
+	}
+	for _, key := range nw.store.ListKeys() {
+		pending[key] = true
+	}
+	nw.relistMu.Lock()
+	nw.relistPending = pending
+	nw.relistMu.Unlock()
+	if len(pending) == 0 {
+		nw.recover()
+	}
+}
+
+// onProcessed recovers the watcher once the last key of a relist after errors
+// has been processed.
+func (nw *NodeWatcher) onProcessed(key string) {
+	nw.relistMu.Lock()
+	if nw.relistPending == nil {
+		nw.relistMu.Unlock()
+		return
+	}
+	delete(nw.relistPending, key)
+	done := len(nw.relistPending) == 0
+	if done {
+		nw.relistPending = nil
+	}
+	nw.relistMu.Unlock()
+	if done {
+		nw.recover()
+	}
+}
+
+// onWatchResumed recovers the watcher after watch errors, unless a relist is
+// still being processed.
+func (nw *NodeWatcher) onWatchResumed() {
+	nw.relistMu.Lock()
+	relisting := nw.relistPending != nil
+	nw.relistMu.Unlock()
+	if !relisting {
+		nw.recover()
+	}
+}
+
+// recover calls the recovery handler if the watcher was failing.
+func (nw *NodeWatcher) recover() {
+	if nw.failing.Swap(false) {
+		nw.recoveryHandler()
 	}
-	nw.store, nw.controller = cache.NewInformer(listWatch, &v1.Node{}, nw.resyncPeriod, eventHandler)
 }
 
 // Run will not return unless writting in the stop channel
@@ -85,10 +246,13 @@ func (nw *NodeWatcher) Run() {
 	log.Logger.Info("stopped node watcher")
 }
 
-// Stop stop the watcher via the respective channel
+// Stop stop the watcher via the respective channel. It is safe to call more
+// than once.
 func (nw *NodeWatcher) Stop() {
-	log.Logger.Info("stopping node watcher")
-	close(nw.stopChannel)
+	nw.stopOnce.Do(func() {
+		log.Logger.Info("stopping node watcher")
+		close(nw.stopChannel)
+	})
 }
 
 // HasSynced calls controllers HasSync method to determine whether the watcher
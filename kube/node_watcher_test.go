@@ -0,0 +1,74 @@
+package kube
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/utilitywarehouse/semaphore-wireguard/log"
+)
+
+func TestNodeWatcherRecoversAfterRelist(t *testing.T) {
+	log.InitLogger("node-watcher-test", "info")
+	client := fake.NewSimpleClientset(&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-a"}})
+	fail := true
+	client.PrependReactor("list", "nodes", func(k8stesting.Action) (bool, runtime.Object, error) {
+		if fail {
+			fail = false
+			return true, nil, errors.New("remote API unreachable")
+		}
+		return false, nil, nil
+	})
+	var errs []string
+	recovered := make(chan []*v1.Node, 1)
+	var nw *NodeWatcher
+	nw = NewNodeWatcher(
+		client,
+		0,
+		func(watch.EventType, *v1.Node, *v1.Node) {},
+		func(verb string, _ error) { errs = append(errs, verb) },
+		func() {
+			// The relisted nodes must be in the store by now
+			nodes, _ := nw.List()
+			recovered <- nodes
+		},
+		"remote",
+		"",
+	)
+	nw.Init()
+	done := make(chan struct{})
+	go func() {
+		nw.Run()
+		close(done)
+	}()
+	defer func() {
+		nw.Stop()
+		<-done
+	}()
+
+	select {
+	case nodes := <-recovered:
+		assert.Equal(t, 1, len(nodes))
+		assert.Equal(t, "node-a", nodes[0].Name)
+	case <-time.After(10 * time.Second):
+		t.Fatal("node watcher did not recover")
+	}
+	assert.Equal(t, []string{"list"}, errs)
+	assert.Equal(t, false, nw.failing.Load())
+}
+
+func TestNodeWatcherStopTwice(t *testing.T) {
+	log.InitLogger("node-watcher-test", "info")
+	nw := NewNodeWatcher(fake.NewSimpleClientset(), 0, nil, nil, nil, "remote", "")
+	nw.Init()
+	nw.Stop()
+	nw.Stop()
+}
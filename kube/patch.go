@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 
+	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
@@ -33,3 +34,37 @@ func PatchNodeAnnotation(client kubernetes.Interface, nodeName string, annotatio
 	_, err = client.CoreV1().Nodes().Patch(ctx, nodeName, types.StrategicMergePatchType, payloadBytes, metav1.PatchOptions{})
 	return err
 }
+
+// PatchNodeCondition sets a condition in the node status. Conditions are
+// merged by type, so the rest of the node's conditions are left intact.
+func PatchNodeCondition(client kubernetes.Interface, nodeName string, condition v1.NodeCondition) error {
+	ctx := context.Background()
+	patchData := map[string]interface{}{
+		"status": map[string][]v1.NodeCondition{
+			"conditions": {condition},
+		},
+	}
+	payloadBytes, err := json.Marshal(patchData)
+	if err != nil {
+		return err
+	}
+	_, err = client.CoreV1().Nodes().PatchStatus(ctx, nodeName, payloadBytes)
+	return err
+}
+
+// RemoveNodeCondition deletes the condition of the passed type from the node
+// status, leaving the rest of the node's conditions intact.
+func RemoveNodeCondition(client kubernetes.Interface, nodeName string, conditionType v1.NodeConditionType) error {
+	ctx := context.Background()
+	patchData := map[string]interface{}{
+		"status": map[string][]map[string]string{
+			"conditions": {{"type": string(conditionType), "$patch": "delete"}},
+		},
+	}
+	payloadBytes, err := json.Marshal(patchData)
+	if err != nil {
+		return err
+	}
+	_, err = client.CoreV1().Nodes().PatchStatus(ctx, nodeName, payloadBytes)
+	return err
+}
@@ -0,0 +1,25 @@
+package kube
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRemoveNodeCondition(t *testing.T) {
+	client := fake.NewSimpleClientset(&v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-a"},
+		Status: v1.NodeStatus{Conditions: []v1.NodeCondition{
+			{Type: v1.NodeReady, Status: v1.ConditionTrue},
+			{Type: "SemaphoreWireguardReady/r1", Status: v1.ConditionTrue},
+		}},
+	})
+	assert.Equal(t, nil, RemoveNodeCondition(client, "node-a", "SemaphoreWireguardReady/r1"))
+	node, err := client.CoreV1().Nodes().Get(context.Background(), "node-a", metav1.GetOptions{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}, node.Status.Conditions)
+}
@@ -0,0 +1,113 @@
+package kube
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/utilitywarehouse/semaphore-wireguard/log"
+)
+
+// RemoteClusterResource is the cluster scoped custom resource that defines a
+// remote cluster.
+var RemoteClusterResource = schema.GroupVersionResource{
+	Group:    "wireguard.semaphore.uw.io",
+	Version:  "v1alpha1",
+	Resource: "remoteclusters",
+}
+
+// RemoteClusterEventHandler is the function to handle RemoteCluster events
+type RemoteClusterEventHandler = func(eventType watch.EventType, obj *unstructured.Unstructured)
+
+// RemoteClusterStatus is the status reported for a RemoteCluster resource.
+// It only depends on the resource, so that all instances report the same.
+type RemoteClusterStatus struct {
+	ObservedGeneration int64  `json:"observedGeneration"`
+	Accepted           bool   `json:"accepted"`
+	Message            string `json:"message"`
+}
+
+// RemoteClusterWatcher has a watch on the RemoteCluster resources
+type RemoteClusterWatcher struct {
+	informer     cache.SharedIndexInformer
+	eventHandler RemoteClusterEventHandler
+	stopChannel  chan struct{}
+}
+
+// NewRemoteClusterWatcher returns a new RemoteCluster watcher.
+func NewRemoteClusterWatcher(client dynamic.Interface, resyncPeriod time.Duration, handler RemoteClusterEventHandler) *RemoteClusterWatcher {
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(client, resyncPeriod)
+	return &RemoteClusterWatcher{
+		informer:     factory.ForResource(RemoteClusterResource).Informer(),
+		eventHandler: handler,
+		stopChannel:  make(chan struct{}),
+	}
+}
+
+// Run registers the event handler and will not return unless the watcher is
+// stopped.
+func (rw *RemoteClusterWatcher) Run() {
+	rw.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			rw.eventHandler(watch.Added, obj.(*unstructured.Unstructured))
+		},
+		UpdateFunc: func(_, newObj interface{}) {
+			rw.eventHandler(watch.Modified, newObj.(*unstructured.Unstructured))
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if u, ok := obj.(*unstructured.Unstructured); ok {
+				rw.eventHandler(watch.Deleted, u)
+			}
+		},
+	})
+	log.Logger.Info("starting remote cluster watcher")
+	rw.informer.Run(rw.stopChannel)
+	log.Logger.Info("stopped remote cluster watcher")
+}
+
+// HasSynced returns true once the watcher has listed the RemoteCluster
+// resources.
+func (rw *RemoteClusterWatcher) HasSynced() bool {
+	return rw.informer.HasSynced()
+}
+
+// Stop stops the watcher
+func (rw *RemoteClusterWatcher) Stop() {
+	log.Logger.Info("stopping remote cluster watcher")
+	close(rw.stopChannel)
+}
+
+// RemoteClusterStatusOf returns the current status of a RemoteCluster
+// resource.
+func RemoteClusterStatusOf(obj *unstructured.Unstructured) RemoteClusterStatus {
+	var status RemoteClusterStatus
+	if s, ok := obj.Object["status"]; ok {
+		data, err := json.Marshal(s)
+		if err == nil {
+			json.Unmarshal(data, &status)
+		}
+	}
+	return status
+}
+
+// PatchRemoteClusterStatus sets the status of a RemoteCluster resource.
+func PatchRemoteClusterStatus(client dynamic.Interface, name string, status RemoteClusterStatus) error {
+	payloadBytes, err := json.Marshal(map[string]RemoteClusterStatus{"status": status})
+	if err != nil {
+		return err
+	}
+	_, err = client.Resource(RemoteClusterResource).Patch(context.Background(), name, types.MergePatchType, payloadBytes, metav1.PatchOptions{}, "status")
+	return err
+}
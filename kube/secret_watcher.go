@@ -0,0 +1,72 @@
+package kube
+
+import (
+	"context"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/utilitywarehouse/semaphore-wireguard/log"
+)
+
+// SecretHandler is the function to handle a created or updated secret
+type SecretHandler = func(secret *v1.Secret)
+
+// SecretWatcher has a watch on a single secret
+type SecretWatcher struct {
+	controller  cache.Controller
+	stopChannel chan struct{}
+}
+
+// NewSecretWatcher returns a watcher that calls the handler when the named
+// secret is created or updated. Deletions are ignored.
+func NewSecretWatcher(client kubernetes.Interface, namespace, name string, handler SecretHandler) *SecretWatcher {
+	ctx := context.Background()
+	selector := fields.OneTermEqualSelector("metadata.name", name).String()
+	listWatch := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = selector
+			l, err := client.CoreV1().Secrets(namespace).List(ctx, options)
+			if err != nil {
+				log.Logger.Error("sw: list error", "secret", namespace+"/"+name, "err", err)
+			}
+			return l, err
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = selector
+			w, err := client.CoreV1().Secrets(namespace).Watch(ctx, options)
+			if err != nil {
+				log.Logger.Error("sw: watch error", "secret", namespace+"/"+name, "err", err)
+			}
+			return w, err
+		},
+	}
+	eventHandler := cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			handler(obj.(*v1.Secret))
+		},
+		UpdateFunc: func(_, newObj interface{}) {
+			handler(newObj.(*v1.Secret))
+		},
+	}
+	_, controller := cache.NewInformer(listWatch, &v1.Secret{}, 0, eventHandler)
+	return &SecretWatcher{
+		controller:  controller,
+		stopChannel: make(chan struct{}),
+	}
+}
+
+// Run will not return unless the watcher is stopped
+func (sw *SecretWatcher) Run() {
+	sw.controller.Run(sw.stopChannel)
+}
+
+// Stop stops the watcher
+func (sw *SecretWatcher) Stop() {
+	close(sw.stopChannel)
+}
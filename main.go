@@ -1,36 +1,50 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"regexp"
 	"strings"
+	"syscall"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"golang.zx2c4.com/wireguard/wgctrl"
 
-	"github.com/utilitywarehouse/semaphore-wireguard/backoff"
+	"github.com/utilitywarehouse/semaphore-wireguard/firewall"
 	"github.com/utilitywarehouse/semaphore-wireguard/kube"
 	"github.com/utilitywarehouse/semaphore-wireguard/log"
 	"github.com/utilitywarehouse/semaphore-wireguard/metrics"
+	"github.com/utilitywarehouse/semaphore-wireguard/wireguard"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 )
 
 const (
-	annotationWGPublicKeyPattern = "%s.wireguard.semaphore.uw.io/pubKey"
-	annotationWGEndpointPattern  = "%s.wireguard.semaphore.uw.io/endpoint"
-	wgDeviceNamePattern          = "wireguard.%s"
+	annotationWGPublicKeyPattern      = "%s.wireguard.semaphore.uw.io/pubKey"
+	annotationWGEndpointPattern       = "%s.wireguard.semaphore.uw.io/endpoint"
+	annotationWGTunnelAddressPattern  = "%s.wireguard.semaphore.uw.io/tunnelAddress"
+	annotationWGTunnelAddressOverride = "wireguard.semaphore.uw.io/tunnelAddress"
+	annotationWGKeepalivePattern      = "%s.wireguard.semaphore.uw.io/persistentKeepalive"
+	wgDeviceNamePattern               = "wireguard.%s"
 )
 
 var (
 	flagLogLevel          = flag.String("log-level", getEnv("SWG_LOG_LEVEL", "info"), "Log level")
 	flagNodeName          = flag.String("node-name", getEnv("SWG_NODE_NAME", ""), "(Required) The node on which semaphore-wireguard is running")
 	flagWGKeyPath         = flag.String("wg-key-path", getEnv("SWG_WG_KEY_PATH", "/var/lib/semaphore-wireguard"), "Path to store and look for wg private key")
+	flagPeersStatePath    = flag.String("peers-state-path", getEnv("SWG_PEERS_STATE_PATH", "/var/lib/semaphore-wireguard"), "Path to persist the last known good peers of each wg device to, empty to disable")
 	flagSWGListenAddr     = flag.String("listen-address", getEnv("SWG_LISTEN_ADDRESS", ":7773"), "Listen address to serve health and metrics")
-	flagSWGClustersConfig = flag.String("clusters-config", getEnv("SWG_CLUSTERS_CONFIG", ""), "Path to the clusters' json config file")
+	flagSWGClustersConfig = flag.String("clusters-config", getEnv("SWG_CLUSTERS_CONFIG", ""), "Path to the clusters' json or yaml config file")
+	flagWGDeviceNetNS     = flag.String("wg-device-netns", getEnv("SWG_WG_DEVICE_NETNS", ""), "Path to the network namespace to run the wg devices in, defaults to the process' namespace")
+	flagWGSocketNetNS     = flag.String("wg-socket-netns", getEnv("SWG_WG_SOCKET_NETNS", ""), "Path to the network namespace for the wg devices' UDP sockets, defaults to the process' namespace")
+	flagPrintConfigSchema = flag.Bool("print-config-schema", false, "Print the JSON Schema of the clusters' config and exit")
+	flagWGImplementation  = flag.String("wg-implementation", getEnv("SWG_WG_IMPLEMENTATION", wireguard.ImplementationAuto), "WireGuard implementation to use: kernel, userspace or auto to fall back to userspace when the kernel module is unavailable")
 
 	bearerRe = regexp.MustCompile(`[A-Z|a-z0-9\-\._~\+\/]+=*`)
 )
@@ -49,9 +63,29 @@ func getEnv(key, defaultValue string) string {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "validate":
+			os.Exit(runValidate(os.Args[2:], os.Stdout))
+		case "status":
+			os.Exit(runStatus(os.Args[2:], os.Stdout))
+		case "export":
+			os.Exit(runExport(os.Args[2:], os.Stdout))
+		}
+	}
 	flag.Parse()
 	log.InitLogger("semaphore-wireguard", *flagLogLevel)
 
+	if *flagPrintConfigSchema {
+		schema, err := configSchema()
+		if err != nil {
+			log.Logger.Error("Cannot generate config schema", "err", err)
+			os.Exit(1)
+		}
+		os.Stdout.Write(schema)
+		return
+	}
+
 	if *flagNodeName == "" {
 		log.Logger.Error("Must specify the kube node that semaphore-wireguard runs on")
 		usage()
@@ -60,6 +94,10 @@ func main() {
 		log.Logger.Error("Must specify a clusters config file location")
 		usage()
 	}
+	if !wireguard.ValidImplementation(*flagWGImplementation) {
+		log.Logger.Error("Unknown wireguard implementation", "implementation", *flagWGImplementation)
+		usage()
+	}
 	fileContent, err := os.ReadFile(*flagSWGClustersConfig)
 	if err != nil {
 		log.Logger.Error("Cannot read clusters config file", "err", err)
@@ -70,6 +108,10 @@ func main() {
 		log.Logger.Error("Cannot parse clusters config", "err", err)
 		os.Exit(1)
 	}
+	if err := validateNamespaces(config.Local, wireguard.Namespaces{Device: *flagWGDeviceNetNS, Socket: *flagWGSocketNetNS}); err != nil {
+		log.Logger.Error("Invalid network namespaces", "err", err)
+		os.Exit(1)
+	}
 
 	homeClient, err := kube.ClientFromConfig(config.Local.KubeConfigPath)
 	if err != nil {
@@ -80,23 +122,48 @@ func main() {
 		os.Exit(1)
 	}
 
-	var runners []*Runner
-	var wgDeviceNames, rClusterNames []string
-	for _, rConf := range config.Remotes {
-		r, wgDeviceName, err := makeRunner(homeClient, config.Local.Name, rConf)
+	recorder := kube.NewEventRecorder(homeClient, "semaphore-wireguard", *flagNodeName)
+
+	var localTunnelRange *net.IPNet
+	if config.Local.TunnelAddressRange != "" {
+		_, localTunnelRange, err = net.ParseCIDR(config.Local.TunnelAddressRange)
 		if err != nil {
+			log.Logger.Error("Cannot parse local tunnel address range", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	var localPodSubnet *net.IPNet
+	if config.Local.PodSubnet != "" {
+		_, localPodSubnet, err = net.ParseCIDR(config.Local.PodSubnet)
+		if err != nil {
+			log.Logger.Error("Cannot parse local pod subnet", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	var dynamicClient dynamic.Interface
+	if config.Local.RemoteClusterResources {
+		dynamicClient, err = kube.DynamicClientFromConfig(config.Local.KubeConfigPath)
+		if err != nil {
+			log.Logger.Error("Cannot create dynamic kube client for homecluster", "err", err)
+			os.Exit(1)
+		}
+	}
+	remotes := newRemoteManager(homeClient, dynamicClient, recorder, config.Local, localPodSubnet, localTunnelRange)
+	for _, rConf := range config.Remotes {
+		if err := remotes.addStatic(rConf); err != nil {
 			log.Logger.Error("Failed to create runner", "err", err)
 			os.Exit(1)
 		}
-		wgDeviceNames = append(wgDeviceNames, wgDeviceName)
-		runners = append(runners, r)
-		rClusterNames = append(rClusterNames, rConf.Name)
-		go func() {
-			backoff.Retry(r.Run, "start runner")
-		}()
+	}
+	var remoteClusterWatcher *kube.RemoteClusterWatcher
+	if dynamicClient != nil {
+		remoteClusterWatcher = kube.NewRemoteClusterWatcher(dynamicClient, 0, remotes.onRemoteClusterEvent)
+		go remoteClusterWatcher.Run()
 	}
 
-	wgMetricsClient, err := wgctrl.New()
+	wgMetricsClient, err := wireguard.NewClient(*flagWGDeviceNetNS)
 	if err != nil {
 		log.Logger.Error("Failed to start wg client for metrics collection", "err", err)
 		os.Exit(1)
@@ -107,61 +174,150 @@ func main() {
 		}
 	}()
 
-	metrics.Register(wgMetricsClient, wgDeviceNames, rClusterNames)
-	listenAndServe(runners)
+	metrics.Register(wgMetricsClient, remotes.DeviceNames)
+	serverDone := make(chan struct{})
+	go func() {
+		listenAndServe(remotes.Runners)
+		close(serverDone)
+	}()
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case s := <-quit:
+		log.Logger.Info("Received signal, stopping", "signal", s)
+	case <-serverDone:
+	}
 
 	// Stop runners before finishing
-	for _, r := range runners {
-		r.stop <- struct{}{}
+	if remoteClusterWatcher != nil {
+		remoteClusterWatcher.Stop()
 	}
+	remotes.Stop()
 }
 
-func makeRunner(homeClient kubernetes.Interface, localName string, rConf *remoteClusterConfig) (*Runner, string, error) {
-	data, err := os.ReadFile(rConf.RemoteSATokenPath)
+// readSAToken reads and checks the service account token from the passed
+// path.
+func readSAToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return nil, "", fmt.Errorf("Cannot read file: %s: %v", rConf.RemoteSATokenPath, err)
+		return "", fmt.Errorf("Cannot read file: %s: %v", path, err)
 	}
 	saToken := string(data)
 	if saToken != "" {
 		saToken = strings.TrimSpace(saToken)
 		if !bearerRe.Match([]byte(saToken)) {
-			return nil, "", fmt.Errorf("The provided token does not match regex: %s", bearerRe.String())
+			return "", fmt.Errorf("The provided token does not match regex: %s", bearerRe.String())
 		}
 	}
+	return saToken, nil
+}
+
+// makeRemoteClient returns a client for the remote cluster, using the
+// kubeconfig file if set, the credentials secret in the local cluster if set,
+// or else the remote API URL, CA and credentials in the config. The home
+// client is only used to read the credentials secret, and the data of the
+// secret the client was created from is also returned. The failover, if not
+// nil, selects which of the remote API URLs requests are sent to.
+func makeRemoteClient(homeClient kubernetes.Interface, rConf *remoteClusterConfig, failover *kube.EndpointFailover) (*kubernetes.Clientset, string, error) {
 	var remoteClient *kubernetes.Clientset
+	var credentials string
+	var err error
 	if rConf.KubeConfigPath != "" {
 		remoteClient, err = kube.ClientFromConfig(rConf.KubeConfigPath)
+	} else if rConf.CredentialsSecret != nil {
+		remoteClient, credentials, err = remoteClientFromSecret(homeClient, rConf, failover)
 	} else {
-		remoteClient, err = kube.Client(saToken, rConf.RemoteAPIURL, rConf.RemoteCAURL)
+		remoteClient, err = remoteClientFromInlineConfig(rConf, failover)
 	}
 	if err != nil {
 		return nil, "", fmt.Errorf("cannot create kube client for remotecluster %v", err)
 	}
-	_, podSubnet, err := net.ParseCIDR(rConf.PodSubnet)
+	return remoteClient, credentials, nil
+}
+
+func makeRunner(homeClient kubernetes.Interface, recorder record.EventRecorder, localName string, localPodSubnet, localTunnelRange *net.IPNet, firewallBackend string, rConf *remoteClusterConfig, claimPodSubnet func(*net.IPNet) error) (*Runner, string, error) {
+	failover, err := newEndpointFailover(rConf)
 	if err != nil {
-		return nil, "", fmt.Errorf("Cannot parse remote pod subnet: %s", err)
+		return nil, "", err
+	}
+	remoteClient, credentials, err := makeRemoteClient(homeClient, rConf, failover)
+	if err != nil {
+		return nil, "", err
+	}
+	var podSubnet *net.IPNet
+	if rConf.PodSubnet != "" {
+		_, podSubnet, err = net.ParseCIDR(rConf.PodSubnet)
+		if err != nil {
+			return nil, "", fmt.Errorf("Cannot parse remote pod subnet: %s", err)
+		}
+	}
+	var remoteTunnelRange *net.IPNet
+	if rConf.TunnelAddressRange != "" {
+		_, remoteTunnelRange, err = net.ParseCIDR(rConf.TunnelAddressRange)
+		if err != nil {
+			return nil, "", fmt.Errorf("Cannot parse remote tunnel address range: %s", err)
+		}
 	}
 	wgDeviceName := fmt.Sprintf(wgDeviceNamePattern, rConf.Name)
-	if err := verifyInterfaceName(wgDeviceName); err != nil {
-		return nil, "", fmt.Errorf("Interface name validation failed for %s : %s", wgDeviceName, err)
-	}
-	r := newRunner(
-		homeClient,
-		remoteClient,
-		*flagNodeName,
-		wgDeviceName,
-		fmt.Sprintf("%s/%s.key", *flagWGKeyPath, wgDeviceName),
-		localName,
-		rConf.Name,
-		rConf.WGDeviceMTU,
-		rConf.WGListenPort,
-		podSubnet,
-		rConf.ResyncPeriod.Duration,
-	)
+	var peersFile string
+	if *flagPeersStatePath != "" {
+		peersFile = filepath.Join(*flagPeersStatePath, fmt.Sprintf(peersStatePattern, wgDeviceName))
+	}
+	namespaces := wireguard.Namespaces{Device: *flagWGDeviceNetNS, Socket: *flagWGSocketNetNS}
+	var fw firewall.Manager
+	if firewallBackend != "" || rConf.Masquerade {
+		backend := firewallBackend
+		if backend == "" {
+			backend = firewall.BackendAuto
+		}
+		fw, err = firewall.NewManager(backend, wgDeviceName, namespaces.InDevice)
+		if err != nil {
+			return nil, "", fmt.Errorf("Cannot create firewall manager for %s: %v", wgDeviceName, err)
+		}
+	}
+	routes := wireguard.RouteConfig{
+		Table:        rConf.RouteTable,
+		Metric:       rConf.RouteMetric,
+		Src:          net.ParseIP(rConf.RouteSrc),
+		RulePriority: rConf.IPRulePriority,
+	}
+	r := newRunner(runnerConfig{
+		client:             homeClient,
+		remoteClient:       remoteClient,
+		credentials:        credentials,
+		failover:           failover,
+		recorder:           recorder,
+		nodeName:           *flagNodeName,
+		localClusterName:   localName,
+		remoteClusterName:  rConf.Name,
+		wgDeviceName:       wgDeviceName,
+		wgKeyPath:          fmt.Sprintf("%s/%s.key", *flagWGKeyPath, wgDeviceName),
+		wgDeviceMTU:        rConf.WGDeviceMTU,
+		wgListenPort:       rConf.WGListenPort,
+		wgFwMark:           rConf.WGFwMark,
+		wgImplementation:   *flagWGImplementation,
+		wgNamespaces:       namespaces,
+		autoMTU:            rConf.WGDeviceMTUAuto,
+		routes:             routes,
+		peersFile:          peersFile,
+		podSubnet:          podSubnet,
+		podSubnetDiscovery: rConf.PodSubnetDiscovery,
+		claimPodSubnet:     claimPodSubnet,
+		localPodSubnet:     localPodSubnet,
+		localTunnelRange:   localTunnelRange,
+		remoteTunnelRange:  remoteTunnelRange,
+		nodeSelector:       rConf.NodeSelector,
+		firewall:           fw,
+		filter:             firewallBackend != "",
+		masquerade:         rConf.Masquerade,
+		keepalive:          rConf.PersistentKeepalive.Duration,
+		resolveInterval:    rConf.ResolveInterval.Duration,
+		resyncPeriod:       rConf.ResyncPeriod.Duration,
+	})
 	return r, wgDeviceName, nil
 }
 
-func listenAndServe(runners []*Runner) {
+func listenAndServe(runners func() []*Runner) {
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", promhttp.Handler())
 	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
@@ -169,14 +325,24 @@ func listenAndServe(runners []*Runner) {
 		// been intialised and running. One could use the ruuners'
 		// initialised flag for a liveness probe to kick the deployment
 		// after some time
-		for _, r := range runners {
-			if !r.initialised {
+		for _, r := range runners() {
+			if !r.Initialised() {
 				w.WriteHeader(http.StatusServiceUnavailable)
 				return
 			}
 		}
 		w.WriteHeader(http.StatusOK)
 	})
+	mux.HandleFunc("/debug/peers", func(w http.ResponseWriter, _ *http.Request) {
+		statuses := []RunnerStatus{}
+		for _, r := range runners() {
+			statuses = append(statuses, r.Status())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(statuses); err != nil {
+			log.Logger.Error("Failed to encode peers status", "err", err)
+		}
+	})
 	server := http.Server{
 		Addr:    *flagSWGListenAddr,
 		Handler: mux,
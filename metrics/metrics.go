@@ -1,6 +1,9 @@
 package metrics
 
 import (
+	"errors"
+	"os"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/utilitywarehouse/semaphore-wireguard/log"
 	"golang.zx2c4.com/wireguard/wgctrl"
@@ -29,6 +32,34 @@ var (
 		},
 		[]string{"device"},
 	)
+	deviceMTU = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "semaphore_wg_device_mtu",
+			Help: "The MTU set on the wg device.",
+		},
+		[]string{"device"},
+	)
+	invalidPeers = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "semaphore_wg_invalid_peers",
+			Help: "Number of remote nodes skipped during the last peers sync because of invalid config.",
+		},
+		[]string{"device"},
+	)
+	peerCollisions = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "semaphore_wg_peer_collisions",
+			Help: "Number of public key or allowed IPs collisions between remote nodes found during the last peers sync.",
+		},
+		[]string{"device"},
+	)
+	endpointResolutionFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "semaphore_wg_endpoint_resolution_failures_total",
+			Help: "Number of failed attempts to resolve a peer hostname endpoint.",
+		},
+		[]string{"device"},
+	)
 	nodeWatcherFailures = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "semaphore_wg_node_watcher_failures_total",
@@ -36,49 +67,100 @@ var (
 		},
 		[]string{"cluster", "verb"},
 	)
+	remoteDegraded = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "semaphore_wg_remote_degraded",
+			Help: "Whether listing or watching the remote nodes fails (1), in which case peers are not removed, or not (0).",
+		},
+		[]string{"device"},
+	)
+	apiEndpointActive = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "semaphore_wg_remote_api_endpoint_active",
+			Help: "Whether a remote cluster API server endpoint is the one requests are sent to (1) or not (0).",
+		},
+		[]string{"cluster", "endpoint"},
+	)
 )
 
-// Register registers all the prometheus collectors
-func Register(wgMetricsClient *wgctrl.Client, wgDeviceNames, rClusterNames []string) {
-	// Initialize counters with a value of 0
-	for _, d := range wgDeviceNames {
-		for _, s := range []string{"0", "1"} {
-			syncPeersAttempt.With(prometheus.Labels{"device": d, "success": s})
-		}
-		syncQueueFullFailures.With(prometheus.Labels{"device": d})
-		syncRequeue.With(prometheus.Labels{"device": d})
-	}
-
+// Register registers all the prometheus collectors. The device names function
+// returns the wg devices to collect metrics for, which may change over time.
+func Register(wgMetricsClient *wgctrl.Client, wgDeviceNames func() []string) {
 	mc := newMetricsCollector(func() ([]*wgtypes.Device, error) {
-		var devices []*wgtypes.Device
-		for _, name := range wgDeviceNames {
-			device, err := wgMetricsClient.Device(name)
-			if err != nil {
-				return nil, err
-			}
-			devices = append(devices, device)
-		}
-		return devices, nil
+		return devices(wgMetricsClient.Device, wgDeviceNames())
 	})
 
-	// Retrieving a Counter from a CounterVec will initialize it with a 0 value if it
-	// doesn't already have a value. This ensures that all possible counters
-	// start with a 0 value.
-	for _, c := range rClusterNames {
-		for _, v := range []string{"get", "list", "create", "update", "patch", "watch", "delete"} {
-			nodeWatcherFailures.With(prometheus.Labels{"cluster": c, "verb": v})
-		}
-	}
-
 	prometheus.MustRegister(
 		mc,
 		syncPeersAttempt,
 		syncQueueFullFailures,
 		syncRequeue,
+		deviceMTU,
+		endpointResolutionFailures,
+		invalidPeers,
+		peerCollisions,
 		nodeWatcherFailures,
+		remoteDegraded,
+		apiEndpointActive,
 	)
 }
 
+// InitRunner initializes the counters of a runner's device and remote
+// cluster with a value of 0.
+func InitRunner(device, cluster string) {
+	// Retrieving a Counter from a CounterVec will initialize it with a 0 value if it
+	// doesn't already have a value. This ensures that all possible counters
+	// start with a 0 value.
+	for _, s := range []string{"0", "1"} {
+		syncPeersAttempt.With(prometheus.Labels{"device": device, "success": s})
+	}
+	syncQueueFullFailures.With(prometheus.Labels{"device": device})
+	syncRequeue.With(prometheus.Labels{"device": device})
+	endpointResolutionFailures.With(prometheus.Labels{"device": device})
+	invalidPeers.With(prometheus.Labels{"device": device})
+	peerCollisions.With(prometheus.Labels{"device": device})
+	remoteDegraded.With(prometheus.Labels{"device": device})
+	for _, v := range []string{"get", "list", "create", "update", "patch", "watch", "delete"} {
+		nodeWatcherFailures.With(prometheus.Labels{"cluster": cluster, "verb": v})
+	}
+}
+
+// DeleteRunner removes the metrics of a runner that was removed.
+func DeleteRunner(device, cluster string) {
+	for _, vec := range []*prometheus.MetricVec{
+		syncPeersAttempt.MetricVec,
+		syncQueueFullFailures.MetricVec,
+		syncRequeue.MetricVec,
+		deviceMTU.MetricVec,
+		endpointResolutionFailures.MetricVec,
+		invalidPeers.MetricVec,
+		peerCollisions.MetricVec,
+		remoteDegraded.MetricVec,
+	} {
+		vec.DeletePartialMatch(prometheus.Labels{"device": device})
+	}
+	nodeWatcherFailures.DeletePartialMatch(prometheus.Labels{"cluster": cluster})
+	apiEndpointActive.DeletePartialMatch(prometheus.Labels{"cluster": cluster})
+}
+
+// devices returns the named wg devices. Devices are created by their runners
+// in the background and removed along with them, so missing ones are skipped.
+func devices(device func(string) (*wgtypes.Device, error), names []string) ([]*wgtypes.Device, error) {
+	var devices []*wgtypes.Device
+	for _, name := range names {
+		d, err := device(name)
+		if errors.Is(err, os.ErrNotExist) {
+			log.Logger.Debug("Skipping metrics for missing device", "device", name)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+	return devices, nil
+}
+
 // A collector is a prometheus.Collector for a WireGuard device.
 type collector struct {
 	DeviceInfo         *prometheus.Desc
@@ -251,6 +333,34 @@ func IncSyncRequeue(device string) {
 	}).Inc()
 }
 
+// SetDeviceMTU sets the device MTU gauge
+func SetDeviceMTU(device string, mtu int) {
+	deviceMTU.With(prometheus.Labels{
+		"device": device,
+	}).Set(float64(mtu))
+}
+
+// SetInvalidPeers sets the invalid peers gauge
+func SetInvalidPeers(device string, count int) {
+	invalidPeers.With(prometheus.Labels{
+		"device": device,
+	}).Set(float64(count))
+}
+
+// SetPeerCollisions sets the peer collisions gauge
+func SetPeerCollisions(device string, count int) {
+	peerCollisions.With(prometheus.Labels{
+		"device": device,
+	}).Set(float64(count))
+}
+
+// IncEndpointResolutionFailures increases endpoint resolution failures counter
+func IncEndpointResolutionFailures(device string) {
+	endpointResolutionFailures.With(prometheus.Labels{
+		"device": device,
+	}).Inc()
+}
+
 // IncNodeWatcherFailures increases node watcher failures counter
 func IncNodeWatcherFailures(c, v string) {
 	nodeWatcherFailures.With(prometheus.Labels{
@@ -258,3 +368,29 @@ func IncNodeWatcherFailures(c, v string) {
 		"verb":    v,
 	}).Inc()
 }
+
+// SetRemoteDegraded sets the remote degraded gauge
+func SetRemoteDegraded(device string, degraded bool) {
+	v := 0.0
+	if degraded {
+		v = 1
+	}
+	remoteDegraded.With(prometheus.Labels{
+		"device": device,
+	}).Set(v)
+}
+
+// SetActiveAPIEndpoint sets the active endpoint gauge of each of the remote
+// cluster API server endpoints
+func SetActiveAPIEndpoint(c string, endpoints []string, active string) {
+	for _, e := range endpoints {
+		v := 0.0
+		if e == active {
+			v = 1
+		}
+		apiEndpointActive.With(prometheus.Labels{
+			"cluster":  c,
+			"endpoint": e,
+		}).Set(v)
+	}
+}
@@ -1,12 +1,15 @@
 package metrics
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"os"
 	"testing"
 	"time"
 
 	"github.com/mdlayher/promtest"
+	"github.com/utilitywarehouse/semaphore-wireguard/log"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
@@ -93,6 +96,29 @@ func TestCollector(t *testing.T) {
 }
 
 // return a wg key or panic
+func TestDevicesSkipsMissing(t *testing.T) {
+	log.InitLogger("metrics-test", "info")
+	device := func(name string) (*wgtypes.Device, error) {
+		switch name {
+		case "wg0":
+			return &wgtypes.Device{Name: name}, nil
+		case "wg2":
+			return nil, errors.New("permission denied")
+		}
+		return nil, fmt.Errorf("device %s: %w", name, os.ErrNotExist)
+	}
+	devs, err := devices(device, []string{"wg0", "wg1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(devs) != 1 || devs[0].Name != "wg0" {
+		t.Errorf("expected only the wg0 device, got %v", devs)
+	}
+	if _, err := devices(device, []string{"wg0", "wg2"}); err == nil {
+		t.Error("expected an error for devices that cannot be read")
+	}
+}
+
 func newWgKey() wgtypes.Key {
 	key, err := wgtypes.GenerateKey()
 	if err != nil {
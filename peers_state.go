@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// peersStatePattern is the name of the file that keeps a device's last known
+// good peers, in the peers state path.
+const peersStatePattern = "%s.peers.json"
+
+// peerState is the persisted config of a peer.
+type peerState struct {
+	Node                string   `json:"node"`
+	PublicKey           string   `json:"publicKey"`
+	PodCIDR             string   `json:"podCIDR"`
+	AllowedIPs          []string `json:"allowedIPs"`
+	Endpoint            string   `json:"endpoint"`
+	PersistentKeepalive Duration `json:"persistentKeepalive"`
+}
+
+// savePeers writes the peers to the file, replacing it atomically so that a
+// crash does not leave a partial peer set behind.
+func savePeers(path string, peers map[string]Peer) error {
+	states := []peerState{}
+	for _, p := range peers {
+		// The reason would be lost, and the peer configured on restore
+		if p.invalid != "" {
+			continue
+		}
+		states = append(states, peerState{
+			Node:                p.nodeName,
+			PublicKey:           p.publicKey,
+			PodCIDR:             p.podCIDR,
+			AllowedIPs:          p.allowedIPs,
+			Endpoint:            p.endpoint,
+			PersistentKeepalive: Duration{p.persistentKeepalive},
+		})
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Node < states[j].Node
+	})
+	data, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("Cannot create peers state file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Cannot write peers state file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("Cannot write peers state file: %v", err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// loadPeers reads the peers from the file, keyed by public key. A missing file
+// results in no peers.
+func loadPeers(path string) (map[string]Peer, error) {
+	peers := map[string]Peer{}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return peers, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read peers state file: %v", err)
+	}
+	var states []peerState
+	if err := json.Unmarshal(data, &states); err != nil {
+		return nil, fmt.Errorf("Cannot parse peers state file %s: %v", path, err)
+	}
+	for _, s := range states {
+		peers[s.PublicKey] = Peer{
+			nodeName:            s.Node,
+			publicKey:           s.PublicKey,
+			podCIDR:             s.PodCIDR,
+			allowedIPs:          s.AllowedIPs,
+			endpoint:            s.Endpoint,
+			persistentKeepalive: s.PersistentKeepalive.Duration,
+		}
+	}
+	return peers, nil
+}
+
+// keepPeers returns the peers with the previous peers added, apart from those
+// of nodes that are still present with a different public key. It is used to
+// avoid removing peers while the remote nodes list cannot be trusted.
+func keepPeers(peers, previous map[string]Peer) map[string]Peer {
+	nodes := map[string]bool{}
+	merged := map[string]Peer{}
+	for key, p := range peers {
+		nodes[p.nodeName] = true
+		merged[key] = p
+	}
+	for key, p := range previous {
+		if _, ok := merged[key]; !ok && !nodes[p.nodeName] {
+			merged[key] = p
+		}
+	}
+	return merged
+}
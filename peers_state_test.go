@@ -0,0 +1,62 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeersState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wireguard.r1.peers.json")
+	peers, err := loadPeers(path)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, map[string]Peer{}, peers)
+
+	peers = map[string]Peer{
+		"key-a": {
+			nodeName:            "node-a",
+			publicKey:           "key-a",
+			podCIDR:             "10.2.0.0/24",
+			allowedIPs:          []string{"10.2.0.0/24", "100.64.0.1/32"},
+			endpoint:            "10.0.0.1:51820",
+			persistentKeepalive: 25 * time.Second,
+		},
+		"key-b": {
+			nodeName:   "node-b",
+			publicKey:  "key-b",
+			podCIDR:    "10.2.1.0/24",
+			allowedIPs: []string{"10.2.1.0/24"},
+			endpoint:   "node-b.example.com:51820",
+		},
+	}
+	assert.Equal(t, nil, savePeers(path, peers))
+	restored, err := loadPeers(path)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, peers, restored)
+
+	assert.Equal(t, nil, savePeers(path, map[string]Peer{}))
+	restored, err = loadPeers(path)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, map[string]Peer{}, restored)
+}
+
+func TestKeepPeers(t *testing.T) {
+	previous := map[string]Peer{
+		"key-a": {nodeName: "node-a", publicKey: "key-a", endpoint: "10.0.0.1:51820"},
+		"key-b": {nodeName: "node-b", publicKey: "key-b", endpoint: "10.0.0.2:51820"},
+		"key-c": {nodeName: "node-c", publicKey: "key-c", endpoint: "10.0.0.3:51820"},
+	}
+	peers := map[string]Peer{
+		// Updated endpoint
+		"key-a": {nodeName: "node-a", publicKey: "key-a", endpoint: "10.0.0.4:51820"},
+		// Rotated key
+		"key-d": {nodeName: "node-c", publicKey: "key-d", endpoint: "10.0.0.3:51820"},
+	}
+	assert.Equal(t, map[string]Peer{
+		"key-a": {nodeName: "node-a", publicKey: "key-a", endpoint: "10.0.0.4:51820"},
+		"key-b": {nodeName: "node-b", publicKey: "key-b", endpoint: "10.0.0.2:51820"},
+		"key-d": {nodeName: "node-c", publicKey: "key-d", endpoint: "10.0.0.3:51820"},
+	}, keepPeers(peers, previous))
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/utilitywarehouse/semaphore-wireguard/backoff"
+	"github.com/utilitywarehouse/semaphore-wireguard/kube"
+	"github.com/utilitywarehouse/semaphore-wireguard/log"
+	"github.com/utilitywarehouse/semaphore-wireguard/metrics"
+)
+
+const (
+	// remoteRetryMin and remoteRetryMax bound the backoff between attempts
+	// to create the runner of an accepted RemoteCluster resource.
+	remoteRetryMin = 10 * time.Second
+	remoteRetryMax = 5 * time.Minute
+)
+
+// remoteManager keeps a runner per remote cluster, for the remotes in the
+// config and the RemoteCluster resources in the local cluster. Remotes in the
+// config are never removed.
+type remoteManager struct {
+	homeClient       kubernetes.Interface
+	dynamicClient    dynamic.Interface
+	recorder         record.EventRecorder
+	local            localClusterConfig
+	localPodSubnet   *net.IPNet
+	localTunnelRange *net.IPNet
+	static           map[string]bool // Names of the remotes in the config
+	remotes          map[string]*remoteClusterConfig
+	runners          map[string]*Runner
+	secretWatchers   map[string]*kube.SecretWatcher // Credentials secret watchers by remote name
+	retries          map[string]*remoteRetry        // Resources whose runner could not be created, by remote name
+	removals         map[string]chan struct{}       // Closed when the removed runner's teardown is done, by remote name
+	mu               sync.RWMutex                   // Guards remotes, runners, secretWatchers, retries and removals
+	teardowns        sync.WaitGroup                 // Tracks the teardowns of removed runners
+	podSubnets       map[string]*net.IPNet          // Configured or discovered pod subnets by remote name
+	podSubnetsMu     sync.Mutex                     // Guards podSubnets, separately since runners update them
+}
+
+func newRemoteManager(homeClient kubernetes.Interface, dynamicClient dynamic.Interface, recorder record.EventRecorder, local localClusterConfig, localPodSubnet, localTunnelRange *net.IPNet) *remoteManager {
+	return &remoteManager{
+		homeClient:       homeClient,
+		dynamicClient:    dynamicClient,
+		recorder:         recorder,
+		local:            local,
+		localPodSubnet:   localPodSubnet,
+		localTunnelRange: localTunnelRange,
+		static:           make(map[string]bool),
+		remotes:          make(map[string]*remoteClusterConfig),
+		runners:          make(map[string]*Runner),
+		secretWatchers:   make(map[string]*kube.SecretWatcher),
+		retries:          make(map[string]*remoteRetry),
+		removals:         make(map[string]chan struct{}),
+		podSubnets:       make(map[string]*net.IPNet),
+	}
+}
+
+// remoteRetry is a scheduled retry of a RemoteCluster resource whose config was
+// accepted, but whose runner could not be created, for example because the
+// credentials secret does not exist yet.
+type remoteRetry struct {
+	obj     *unstructured.Unstructured
+	backoff *backoff.Backoff
+	timer   *time.Timer
+}
+
+// addStatic starts a runner for a remote in the config.
+func (m *remoteManager) addStatic(rConf *remoteClusterConfig) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.add(rConf); err != nil {
+		return err
+	}
+	m.static[rConf.Name] = true
+	return nil
+}
+
+// add creates a runner for the remote and starts it in the background, in
+// place of the remote's current runner, if any. The current runner is kept if
+// the new one cannot be created. The caller must hold the lock.
+func (m *remoteManager) add(rConf *remoteClusterConfig) error {
+	claim := func(subnet *net.IPNet) error {
+		return m.claimPodSubnet(rConf.Name, subnet)
+	}
+	r, wgDeviceName, err := makeRunner(m.homeClient, m.recorder, m.local.Name, m.localPodSubnet, m.localTunnelRange, m.local.FirewallBackend, rConf, claim)
+	if err != nil {
+		return err
+	}
+	m.remove(rConf.Name)
+	if rConf.PodSubnet != "" {
+		_, podSubnet, _ := net.ParseCIDR(rConf.PodSubnet)
+		m.podSubnetsMu.Lock()
+		m.podSubnets[rConf.Name] = podSubnet
+		m.podSubnetsMu.Unlock()
+	}
+	metrics.InitRunner(wgDeviceName, rConf.Name)
+	m.remotes[rConf.Name] = rConf
+	m.runners[rConf.Name] = r
+	// The new runner uses the same device as the removed one
+	r.Start(m.removals[rConf.Name])
+	if rConf.CredentialsSecret != nil {
+		m.watchCredentials(rConf, r)
+	}
+	return nil
+}
+
+// watchCredentials watches the credentials secret of the remote and replaces
+// the runner's remote client when the credentials change. The caller must hold
+// the lock.
+func (m *remoteManager) watchCredentials(rConf *remoteClusterConfig, r *Runner) {
+	ref := rConf.CredentialsSecret
+	sw := kube.NewSecretWatcher(m.homeClient, ref.Namespace, ref.Name, func(secret *v1.Secret) {
+		onCredentialsSecret(rConf, r, secret)
+	})
+	m.secretWatchers[rConf.Name] = sw
+	go sw.Run()
+}
+
+// onCredentialsSecret replaces the runner's remote client if the credentials
+// in the secret differ from the ones the client was created from.
+func onCredentialsSecret(rConf *remoteClusterConfig, r *Runner, secret *v1.Secret) {
+	ref := rConf.CredentialsSecret
+	data := credentialsData(secret, ref)
+	if data == r.currentCredentials() {
+		return
+	}
+	client, err := remoteClientFromSecretData(secret, rConf, r.failover)
+	if err != nil {
+		log.Logger.Error("Cannot create client from updated credentials secret, keeping current one", "name", rConf.Name, "err", err)
+		r.event(v1.EventTypeWarning, "CredentialsInvalid", "Cannot use updated credentials secret %s/%s: %v", ref.Namespace, ref.Name, err)
+		return
+	}
+	log.Logger.Info("Credentials secret updated, replacing remote client", "name", rConf.Name)
+	r.SetRemoteClient(client, data)
+	r.event(v1.EventTypeNormal, "CredentialsRotated", "Using updated credentials secret %s/%s", ref.Namespace, ref.Name)
+}
+
+// remove stops the runner of the remote and removes its device in the
+// background, so that the lock is not held during the teardown. The caller
+// must hold the lock.
+func (m *remoteManager) remove(name string) {
+	r, ok := m.runners[name]
+	if !ok {
+		return
+	}
+	log.Logger.Info("Removing remote cluster", "name", name)
+	if sw, ok := m.secretWatchers[name]; ok {
+		sw.Stop()
+		delete(m.secretWatchers, name)
+	}
+	m.podSubnetsMu.Lock()
+	delete(m.podSubnets, name)
+	m.podSubnetsMu.Unlock()
+	metrics.DeleteRunner(r.device.Name(), name)
+	delete(m.remotes, name)
+	delete(m.runners, name)
+	done := make(chan struct{})
+	m.removals[name] = done
+	m.teardowns.Go(func() {
+		r.Remove()
+		close(done)
+		m.mu.Lock()
+		if m.removals[name] == done {
+			delete(m.removals, name)
+		}
+		m.mu.Unlock()
+	})
+}
+
+// claimPodSubnet checks a discovered pod subnet of the remote against the
+// local pod subnet and the pod subnets of the other remotes, and records it if
+// it does not overlap with any of them. Runners call it from their own
+// goroutines, so it must not take the lock.
+func (m *remoteManager) claimPodSubnet(name string, subnet *net.IPNet) error {
+	m.podSubnetsMu.Lock()
+	defer m.podSubnetsMu.Unlock()
+	if err := m.checkPodSubnet(name, subnet); err != nil {
+		return err
+	}
+	m.podSubnets[name] = subnet
+	return nil
+}
+
+// checkPodSubnet returns an error if the pod subnet of the remote overlaps
+// with the local pod subnet or the pod subnets of the other remotes. The
+// caller must hold podSubnetsMu.
+func (m *remoteManager) checkPodSubnet(name string, subnet *net.IPNet) error {
+	if m.local.PodSubnet != "" {
+		_, localPodSubnet, _ := net.ParseCIDR(m.local.PodSubnet)
+		if subnetsOverlap(subnet, localPodSubnet) {
+			return fmt.Errorf("Pod subnet %s of remote cluster %s overlaps with the local pod subnet", subnet, name)
+		}
+	}
+	var others []string
+	for n := range m.podSubnets {
+		if n != name {
+			others = append(others, n)
+		}
+	}
+	sort.Strings(others)
+	for _, n := range others {
+		if subnetsOverlap(subnet, m.podSubnets[n]) {
+			return fmt.Errorf("Pod subnets of remote clusters %s and %s overlap", n, name)
+		}
+	}
+	return nil
+}
+
+// Runners returns the current runners sorted by remote cluster name.
+func (m *remoteManager) Runners() []*Runner {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var runners []*Runner
+	for _, r := range m.runners {
+		runners = append(runners, r)
+	}
+	sort.Slice(runners, func(i, j int) bool {
+		return runners[i].cluster < runners[j].cluster
+	})
+	return runners
+}
+
+// DeviceNames returns the wg device names of the current runners.
+func (m *remoteManager) DeviceNames() []string {
+	var names []string
+	for _, r := range m.Runners() {
+		names = append(names, r.device.Name())
+	}
+	return names
+}
+
+// Stop stops all runners, leaving their devices in place, and waits for the
+// teardowns of removed runners.
+func (m *remoteManager) Stop() {
+	m.mu.Lock()
+	for _, sw := range m.secretWatchers {
+		sw.Stop()
+	}
+	m.secretWatchers = map[string]*kube.SecretWatcher{}
+	for name := range m.retries {
+		m.cancelRetry(name)
+	}
+	m.mu.Unlock()
+	for _, r := range m.Runners() {
+		r.Stop()
+	}
+	m.teardowns.Wait()
+}
+
+// onRemoteClusterEvent starts, restarts or removes the runner of a
+// RemoteCluster resource and reports whether the resource was accepted in
+// its status. Runners keep their last accepted config when an update is
+// rejected.
+func (m *remoteManager) onRemoteClusterEvent(eventType watch.EventType, obj *unstructured.Unstructured) {
+	name := obj.GetName()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if eventType == watch.Deleted {
+		m.cancelRetry(name)
+		if !m.static[name] {
+			m.remove(name)
+		}
+		return
+	}
+	m.handle(obj)
+}
+
+// handle applies a RemoteCluster resource, schedules a retry if its runner
+// could not be created and updates its status. The caller must hold the lock.
+func (m *remoteManager) handle(obj *unstructured.Unstructured) {
+	name := obj.GetName()
+	retry, err := m.apply(obj)
+	if retry {
+		m.scheduleRetry(obj)
+	} else {
+		m.cancelRetry(name)
+	}
+	if err != nil {
+		log.Logger.Error("Rejected remote cluster resource", "name", name, "err", err)
+	}
+	status := kube.RemoteClusterStatus{
+		ObservedGeneration: obj.GetGeneration(),
+		Accepted:           err == nil,
+	}
+	if err != nil {
+		status.Message = err.Error()
+	}
+	if status == kube.RemoteClusterStatusOf(obj) {
+		return
+	}
+	if err := kube.PatchRemoteClusterStatus(m.dynamicClient, name, status); err != nil {
+		log.Logger.Error("Failed to update remote cluster status", "name", name, "err", err)
+	}
+}
+
+// apply validates the config of a RemoteCluster resource and (re)starts its
+// runner if the config changed. It returns true along with the error if the
+// config is valid but the runner could not be created, so that it can be
+// retried. The caller must hold the lock.
+func (m *remoteManager) apply(obj *unstructured.Unstructured) (bool, error) {
+	name := obj.GetName()
+	if m.static[name] {
+		return false, fmt.Errorf("Remote cluster %s is defined in the config", name)
+	}
+	rConf, err := remoteClusterFromObject(obj)
+	if err != nil {
+		return false, err
+	}
+	if err := validateRemote(m.local, rConf); err != nil {
+		return false, err
+	}
+	var others []string
+	for n := range m.remotes {
+		if n != name {
+			others = append(others, n)
+		}
+	}
+	sort.Strings(others)
+	for _, n := range others {
+		if err := checkRemoteConflicts(m.remotes[n], rConf); err != nil {
+			return false, err
+		}
+	}
+	// Configured pod subnets must also not overlap with the discovered ones
+	if rConf.PodSubnet != "" {
+		_, podSubnet, _ := net.ParseCIDR(rConf.PodSubnet)
+		m.podSubnetsMu.Lock()
+		err := m.checkPodSubnet(name, podSubnet)
+		m.podSubnetsMu.Unlock()
+		if err != nil {
+			return false, err
+		}
+	}
+	if reflect.DeepEqual(m.remotes[name], rConf) {
+		return false, nil
+	}
+	log.Logger.Info("Applying remote cluster", "name", name)
+	if err := m.add(rConf); err != nil {
+		return true, err
+	}
+	return false, nil
+}
+
+// scheduleRetry applies the resource again after a backoff, unless it is
+// updated or deleted in the meantime. The caller must hold the lock.
+func (m *remoteManager) scheduleRetry(obj *unstructured.Unstructured) {
+	name := obj.GetName()
+	rr, ok := m.retries[name]
+	if !ok {
+		rr = &remoteRetry{backoff: &backoff.Backoff{Min: remoteRetryMin, Max: remoteRetryMax, Factor: 2, Jitter: true}}
+		m.retries[name] = rr
+	}
+	if rr.timer != nil {
+		rr.timer.Stop()
+	}
+	rr.obj = obj
+	d := rr.backoff.Duration()
+	log.Logger.Info("Retrying remote cluster", "name", name, "after", d)
+	rr.timer = time.AfterFunc(d, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if current, ok := m.retries[name]; !ok || current.obj != obj {
+			return
+		}
+		m.handle(obj)
+	})
+}
+
+// cancelRetry stops the scheduled retry of the resource, if any. The caller
+// must hold the lock.
+func (m *remoteManager) cancelRetry(name string) {
+	rr, ok := m.retries[name]
+	if !ok {
+		return
+	}
+	rr.timer.Stop()
+	delete(m.retries, name)
+}
+
+// configOnlyRemoteFields are the remote fields that RemoteCluster resources
+// cannot set, since anyone who can create a resource could otherwise run
+// commands in the pods or make them read any of their files.
+var configOnlyRemoteFields = []string{
+	"exec",
+	"kubeConfigPath",
+	"remoteSATokenPath",
+	"remoteCAPath",
+	"clientCertPath",
+	"clientKeyPath",
+}
+
+// remoteClusterFromObject returns the remote cluster config in the spec of a
+// RemoteCluster resource. The spec has the same fields as the remotes in the
+// config, apart from the name, which is the resource name, and the config only
+// fields. Credentials can only be read from a secret, and kubeconfigs in it
+// cannot use exec plugins.
+func remoteClusterFromObject(obj *unstructured.Unstructured) (*remoteClusterConfig, error) {
+	spec, _ := obj.Object["spec"].(map[string]interface{})
+	for _, f := range configOnlyRemoteFields {
+		if _, ok := spec[f]; ok {
+			return nil, fmt.Errorf("Field %s can only be set for remotes in the config", f)
+		}
+	}
+	data, err := json.Marshal(obj.Object["spec"])
+	if err != nil {
+		return nil, err
+	}
+	rConf := &remoteClusterConfig{}
+	if err := json.Unmarshal(data, rConf); err != nil {
+		return nil, fmt.Errorf("error unmarshalling spec: %v", err)
+	}
+	if rConf.Name != "" {
+		return nil, fmt.Errorf("The remote cluster name is the resource name and cannot be set in the spec")
+	}
+	if rConf.CredentialsSecret == nil {
+		return nil, fmt.Errorf("RemoteCluster resources must set credentialsSecret")
+	}
+	rConf.Name = obj.GetName()
+	rConf.FromResource = true
+	return rConf, nil
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/yaml"
+
+	"github.com/utilitywarehouse/semaphore-wireguard/firewall"
+	"github.com/utilitywarehouse/semaphore-wireguard/kube"
+	"github.com/utilitywarehouse/semaphore-wireguard/log"
+	"github.com/utilitywarehouse/semaphore-wireguard/wireguard"
+)
+
+var secretSpec = map[string]interface{}{
+	"namespace": "sys-semaphore",
+	"name":      "remote-credentials",
+}
+
+func remoteClusterObject(name string, spec map[string]interface{}) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": kube.RemoteClusterResource.GroupVersion().String(),
+		"kind":       "RemoteCluster",
+		"metadata":   map[string]interface{}{"name": name},
+		"spec":       spec,
+	}}
+	obj.SetGeneration(1)
+	return obj
+}
+
+func TestRemoteClusterFromObject(t *testing.T) {
+	rConf, err := remoteClusterFromObject(remoteClusterObject("r1", map[string]interface{}{
+		"credentialsSecret": secretSpec,
+		"podSubnet":         "10.1.0.0/16",
+		"wgDeviceMTU":       "auto",
+	}))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "r1", rConf.Name)
+	assert.Equal(t, true, rConf.WGDeviceMTUAuto)
+
+	_, err = remoteClusterFromObject(remoteClusterObject("r1", map[string]interface{}{
+		"name": "r2",
+	}))
+	assert.NotEqual(t, nil, err)
+
+	_, err = remoteClusterFromObject(remoteClusterObject("r1", map[string]interface{}{
+		"podSubnets": "10.1.0.0/16",
+	}))
+	assert.NotEqual(t, nil, err)
+
+	_, err = remoteClusterFromObject(remoteClusterObject("r1", map[string]interface{}{
+		"remoteAPIURL": "https://api.r1.example.com",
+		"remoteCA":     "-----BEGIN CERTIFICATE-----",
+		"exec":         map[string]interface{}{"command": "token-helper"},
+		"podSubnet":    "10.1.0.0/16",
+	}))
+	assert.Equal(t, fmt.Errorf("Field exec can only be set for remotes in the config"), err)
+
+	_, err = remoteClusterFromObject(remoteClusterObject("r1", map[string]interface{}{
+		"kubeConfigPath": "/path/to/kube/config",
+		"podSubnet":      "10.1.0.0/16",
+	}))
+	assert.Equal(t, fmt.Errorf("Field kubeConfigPath can only be set for remotes in the config"), err)
+
+	_, err = remoteClusterFromObject(remoteClusterObject("r1", map[string]interface{}{
+		"remoteAPIURL": "https://api.r1.example.com",
+		"remoteCAURL":  "https://ca.r1.example.com",
+		"podSubnet":    "10.1.0.0/16",
+	}))
+	assert.Equal(t, fmt.Errorf("RemoteCluster resources must set credentialsSecret"), err)
+}
+
+func TestRemoteManagerRejectsConflicts(t *testing.T) {
+	log.InitLogger("remotes-test", "info")
+	static := &remoteClusterConfig{Name: "r1", KubeConfigPath: "/path/to/kube/config", PodSubnet: "10.1.0.0/16"}
+	assert.Equal(t, nil, validateRemote(localClusterConfig{Name: "local"}, static))
+
+	objects := []runtime.Object{
+		remoteClusterObject("r1", map[string]interface{}{
+			"credentialsSecret": secretSpec,
+			"podSubnet":         "10.1.0.0/16",
+		}),
+		remoteClusterObject("r2", map[string]interface{}{
+			"credentialsSecret": secretSpec,
+			"podSubnet":         "10.1.128.0/24",
+			"wgListenPort":      int64(51821),
+		}),
+		remoteClusterObject("r3", map[string]interface{}{
+			"credentialsSecret": secretSpec,
+			"podSubnet":         "10.3.0.0/16",
+		}),
+	}
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(
+		runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{kube.RemoteClusterResource: "RemoteClusterList"},
+		objects...,
+	)
+	m := newRemoteManager(nil, client, nil, localClusterConfig{Name: "local"}, nil, nil)
+	m.remotes[static.Name] = static
+	m.static[static.Name] = true
+
+	for _, obj := range objects {
+		m.onRemoteClusterEvent(watch.Added, obj.(*unstructured.Unstructured))
+	}
+	statuses := map[string]kube.RemoteClusterStatus{}
+	for _, name := range []string{"r1", "r2", "r3"} {
+		obj, err := client.Resource(kube.RemoteClusterResource).Get(t.Context(), name, metav1.GetOptions{})
+		assert.Equal(t, nil, err)
+		statuses[name] = kube.RemoteClusterStatusOf(obj)
+	}
+	assert.Equal(t, kube.RemoteClusterStatus{ObservedGeneration: 1, Message: "Remote cluster r1 is defined in the config"}, statuses["r1"])
+	assert.Equal(t, kube.RemoteClusterStatus{ObservedGeneration: 1, Message: "Pod subnets of remote clusters r1 and r2 overlap"}, statuses["r2"])
+	assert.Equal(t, kube.RemoteClusterStatus{ObservedGeneration: 1, Message: "Remote clusters r1 and r3 use the same wg listen port 51820"}, statuses["r3"])
+	assert.Equal(t, 0, len(m.runners))
+
+	// Deleting the resource of a remote in the config keeps the remote
+	m.onRemoteClusterEvent(watch.Deleted, objects[0].(*unstructured.Unstructured))
+	assert.Equal(t, static, m.remotes["r1"])
+}
+
+func TestRemoteManagerRetriesFailedRunners(t *testing.T) {
+	log.InitLogger("remotes-test", "info")
+	obj := remoteClusterObject("r1", map[string]interface{}{
+		"credentialsSecret": secretSpec,
+		"podSubnet":         "10.1.0.0/16",
+	})
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(
+		runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{kube.RemoteClusterResource: "RemoteClusterList"},
+		obj,
+	)
+	m := newRemoteManager(fake.NewSimpleClientset(), client, nil, localClusterConfig{Name: "local"}, nil, nil)
+
+	// The credentials secret does not exist yet
+	m.onRemoteClusterEvent(watch.Added, obj)
+	assert.Equal(t, 0, len(m.runners))
+	assert.Equal(t, 1, len(m.retries))
+	assert.Equal(t, obj, m.retries["r1"].obj)
+	updated, err := client.Resource(kube.RemoteClusterResource).Get(t.Context(), "r1", metav1.GetOptions{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, kube.RemoteClusterStatusOf(updated).Accepted)
+
+	// Rejected updates are not retried
+	invalid := remoteClusterObject("r1", map[string]interface{}{
+		"credentialsSecret": secretSpec,
+	})
+	m.onRemoteClusterEvent(watch.Modified, invalid)
+	assert.Equal(t, 0, len(m.retries))
+
+	m.onRemoteClusterEvent(watch.Modified, obj)
+	assert.Equal(t, 1, len(m.retries))
+	m.onRemoteClusterEvent(watch.Deleted, obj)
+	assert.Equal(t, 0, len(m.retries))
+}
+
+func TestRemoteManagerRemoveOutsideLock(t *testing.T) {
+	log.InitLogger("remotes-test", "info")
+	m := newRemoteManager(nil, nil, nil, localClusterConfig{Name: "local"}, nil, nil)
+	fw := &blockingFirewall{release: make(chan struct{})}
+	r := &Runner{
+		cluster:  "r1",
+		client:   fake.NewSimpleClientset(),
+		device:   wireguard.NewDevice("wireguard.r1", "", 0, 0, 0, wireguard.RouteConfig{}, "", wireguard.Namespaces{}),
+		firewall: fw,
+		stop:     make(chan struct{}),
+	}
+	r.nodeWatcher = r.newNodeWatcher(fake.NewSimpleClientset())
+	m.remotes["r1"] = &remoteClusterConfig{Name: "r1"}
+	m.runners["r1"] = r
+
+	m.mu.Lock()
+	m.remove("r1")
+	done := m.removals["r1"]
+	m.mu.Unlock()
+	// The manager is usable while the runner is torn down
+	assert.Equal(t, 0, len(m.Runners()))
+	select {
+	case <-done:
+		t.Fatal("teardown finished before the firewall cleanup")
+	default:
+	}
+	// A replacing runner stopped while waiting for the teardown does not start
+	next := &Runner{stop: make(chan struct{})}
+	next.Start(done)
+	close(next.stop)
+	next.loops.Wait()
+
+	close(fw.release)
+	m.Stop()
+	<-done
+	m.mu.RLock()
+	assert.Equal(t, 0, len(m.removals))
+	m.mu.RUnlock()
+}
+
+type blockingFirewall struct {
+	release chan struct{}
+}
+
+func (f *blockingFirewall) Apply(firewall.Rules) error {
+	return nil
+}
+
+func (f *blockingFirewall) Cleanup() error {
+	<-f.release
+	return nil
+}
+
+func TestRemoteManagerClaimPodSubnet(t *testing.T) {
+	m := newRemoteManager(nil, nil, nil, localClusterConfig{Name: "local", PodSubnet: "10.0.0.0/16"}, nil, nil)
+	_, r1Subnet, _ := net.ParseCIDR("10.1.0.0/16")
+	m.podSubnets["r1"] = r1Subnet
+
+	_, subnet, _ := net.ParseCIDR("10.0.0.0/8")
+	assert.Equal(t, fmt.Errorf("Pod subnet 10.0.0.0/8 of remote cluster r2 overlaps with the local pod subnet"), m.claimPodSubnet("r2", subnet))
+	_, subnet, _ = net.ParseCIDR("10.1.128.0/17")
+	assert.Equal(t, fmt.Errorf("Pod subnets of remote clusters r1 and r2 overlap"), m.claimPodSubnet("r2", subnet))
+	_, subnet, _ = net.ParseCIDR("10.2.0.0/16")
+	assert.Equal(t, nil, m.claimPodSubnet("r2", subnet))
+	assert.Equal(t, subnet, m.podSubnets["r2"])
+	// A remote's own previous subnet is replaced
+	_, subnet, _ = net.ParseCIDR("10.2.0.0/15")
+	assert.Equal(t, fmt.Errorf("Pod subnets of remote clusters r2 and r1 overlap"), m.claimPodSubnet("r1", subnet))
+	_, subnet, _ = net.ParseCIDR("10.3.0.0/16")
+	assert.Equal(t, nil, m.claimPodSubnet("r1", subnet))
+}
+
+// TestRemoteClusterCRD checks that the CRD schema has the same spec fields as
+// the remotes in the config, apart from the name and the config only fields.
+func TestRemoteClusterCRD(t *testing.T) {
+	data, err := os.ReadFile("deploy/example/kube-system/semaphore-wireguard-remotecluster-crd.yaml")
+	assert.Equal(t, nil, err)
+	var crd struct {
+		Spec struct {
+			Versions []struct {
+				Schema struct {
+					OpenAPIV3Schema struct {
+						Properties struct {
+							Spec struct {
+								Properties map[string]interface{} `json:"properties"`
+							} `json:"spec"`
+						} `json:"properties"`
+					} `json:"openAPIV3Schema"`
+				} `json:"schema"`
+			} `json:"versions"`
+		} `json:"spec"`
+	}
+	assert.Equal(t, nil, yaml.Unmarshal(data, &crd))
+	var crdFields []string
+	for name := range crd.Spec.Versions[0].Schema.OpenAPIV3Schema.Properties.Spec.Properties {
+		crdFields = append(crdFields, name)
+	}
+	sort.Strings(crdFields)
+	var configFields []string
+	rt := reflect.TypeOf(remoteClusterConfig{})
+	for i := 0; i < rt.NumField(); i++ {
+		name := strings.Split(rt.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" && name != "name" && !slices.Contains(configOnlyRemoteFields, name) {
+			configFields = append(configFields, name)
+		}
+	}
+	sort.Strings(configFields)
+	assert.Equal(t, configFields, crdFields)
+}
+
+func TestOnCredentialsSecret(t *testing.T) {
+	log.InitLogger("remotes-test", "info")
+	rConf := &remoteClusterConfig{
+		Name:         "r1",
+		RemoteAPIURL: "https://remote.example.com",
+		RemoteCAURL:  "https://ca.example.com",
+		CredentialsSecret: &secretReference{
+			Namespace:     "sys-semaphore",
+			Name:          "r1-credentials",
+			KubeConfigKey: "kubeconfig",
+			TokenKey:      "token",
+			CAKey:         "ca.crt",
+		},
+	}
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "sys-semaphore", Name: "r1-credentials"},
+		Data:       map[string][]byte{"token": []byte("token-a")},
+	}
+	client := fake.NewSimpleClientset()
+	recorder := record.NewFakeRecorder(10)
+	r := &Runner{
+		cluster:      "r1",
+		device:       wireguard.NewDevice("wireguard.r1", "", 0, 0, 0, wireguard.RouteConfig{}, "", wireguard.Namespaces{}),
+		recorder:     recorder,
+		remoteClient: client,
+		credentials:  credentialsData(secret, rConf.CredentialsSecret),
+		stop:         make(chan struct{}),
+	}
+	r.nodeWatcher = r.newNodeWatcher(client)
+
+	// The secret the client was created from is not swapped
+	onCredentialsSecret(rConf, r, secret)
+	assert.Equal(t, kubernetes.Interface(client), r.remoteClient)
+	assert.Equal(t, 0, len(recorder.Events))
+
+	secret.Data["token"] = []byte("token-b")
+	onCredentialsSecret(rConf, r, secret)
+	assert.NotEqual(t, kubernetes.Interface(client), r.remoteClient)
+	assert.Equal(t, credentialsData(secret, rConf.CredentialsSecret), r.currentCredentials())
+	assert.Equal(t, "Normal CredentialsRotated wireguard.r1: Using updated credentials secret sys-semaphore/r1-credentials", <-recorder.Events)
+
+	// Stopped runners keep their client
+	close(r.stop)
+	rotated := r.remoteClient
+	secret.Data["token"] = []byte("token-c")
+	onCredentialsSecret(rConf, r, secret)
+	assert.Equal(t, rotated, r.remoteClient)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net"
+	"sync"
+
+	"github.com/utilitywarehouse/semaphore-wireguard/log"
+	"github.com/utilitywarehouse/semaphore-wireguard/metrics"
+)
+
+// endpointResolver resolves peer endpoints that use a hostname and caches the
+// results, so that peers can keep their last known address while DNS is
+// failing. Endpoints with a literal IP address bypass the cache.
+type endpointResolver struct {
+	device  string
+	addrs   map[string]*net.UDPAddr
+	failed  map[string]bool // Hostname endpoints that have never been resolved
+	mu      sync.Mutex
+	resolve func(endpoint string) (*net.UDPAddr, error) // to allow testing
+}
+
+func newEndpointResolver(device string) *endpointResolver {
+	return &endpointResolver{
+		device: device,
+		addrs:  make(map[string]*net.UDPAddr),
+		failed: make(map[string]bool),
+		resolve: func(endpoint string) (*net.UDPAddr, error) {
+			return net.ResolveUDPAddr("udp", endpoint)
+		},
+	}
+}
+
+// isHostnameEndpoint returns true if the endpoint host is not an IP address.
+func isHostnameEndpoint(endpoint string) bool {
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return false
+	}
+	return net.ParseIP(host) == nil
+}
+
+// Resolve returns the address of the endpoint. Hostname endpoints are only
+// looked up the first time they are seen, after that the cached address is
+// returned until it is updated by Refresh.
+func (er *endpointResolver) Resolve(endpoint string) (*net.UDPAddr, error) {
+	if !isHostnameEndpoint(endpoint) {
+		return er.resolve(endpoint)
+	}
+	er.mu.Lock()
+	defer er.mu.Unlock()
+	if addr, ok := er.addrs[endpoint]; ok {
+		return addr, nil
+	}
+	addr, err := er.resolve(endpoint)
+	if err != nil {
+		metrics.IncEndpointResolutionFailures(er.device)
+		er.failed[endpoint] = true
+		return nil, err
+	}
+	delete(er.failed, endpoint)
+	er.addrs[endpoint] = addr
+	return addr, nil
+}
+
+// Refresh looks up all the known hostname endpoints again, including the ones
+// that failed to resolve so far, and returns true if any of the addresses
+// changed. Endpoints that fail to resolve keep their last known address.
+func (er *endpointResolver) Refresh() bool {
+	er.mu.Lock()
+	endpoints := make([]string, 0, len(er.addrs)+len(er.failed))
+	for endpoint := range er.addrs {
+		endpoints = append(endpoints, endpoint)
+	}
+	for endpoint := range er.failed {
+		endpoints = append(endpoints, endpoint)
+	}
+	er.mu.Unlock()
+
+	changed := false
+	for _, endpoint := range endpoints {
+		addr, err := er.resolve(endpoint)
+		if err != nil {
+			log.Logger.Warn("Failed to re-resolve peer endpoint, keeping last known address", "endpoint", endpoint, "err", err)
+			metrics.IncEndpointResolutionFailures(er.device)
+			continue
+		}
+		er.mu.Lock()
+		old, ok := er.addrs[endpoint]
+		if !ok || !old.IP.Equal(addr.IP) || old.Port != addr.Port {
+			log.Logger.Info("Peer endpoint address changed", "endpoint", endpoint, "old", old, "new", addr)
+			delete(er.failed, endpoint)
+			er.addrs[endpoint] = addr
+			changed = true
+		}
+		er.mu.Unlock()
+	}
+	return changed
+}
+
+// Prune drops the cached addresses of endpoints that are not in the passed
+// list.
+func (er *endpointResolver) Prune(endpoints []string) {
+	keep := make(map[string]bool, len(endpoints))
+	for _, endpoint := range endpoints {
+		keep[endpoint] = true
+	}
+	er.mu.Lock()
+	defer er.mu.Unlock()
+	for endpoint := range er.addrs {
+		if !keep[endpoint] {
+			delete(er.addrs, endpoint)
+		}
+	}
+	for endpoint := range er.failed {
+		if !keep[endpoint] {
+			delete(er.failed, endpoint)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/utilitywarehouse/semaphore-wireguard/log"
+)
+
+func TestIsHostnameEndpoint(t *testing.T) {
+	assert.Equal(t, true, isHostnameEndpoint("node.example.com:51820"))
+	assert.Equal(t, false, isHostnameEndpoint("10.0.0.1:51820"))
+	assert.Equal(t, false, isHostnameEndpoint("[fd00::1]:51820"))
+	assert.Equal(t, false, isHostnameEndpoint("node.example.com"))
+}
+
+func TestEndpointResolver(t *testing.T) {
+	log.InitLogger("resolver-test", "info")
+	records := map[string]string{"node.example.com": "10.0.0.1"}
+	lookups := 0
+	er := newEndpointResolver("wireguard.test")
+	er.resolve = func(endpoint string) (*net.UDPAddr, error) {
+		host, port, _ := net.SplitHostPort(endpoint)
+		if ip := net.ParseIP(host); ip != nil {
+			return net.ResolveUDPAddr("udp4", endpoint)
+		}
+		lookups++
+		ip, ok := records[host]
+		if !ok {
+			return nil, fmt.Errorf("no such host")
+		}
+		return net.ResolveUDPAddr("udp4", net.JoinHostPort(ip, port))
+	}
+
+	addr, err := er.Resolve("node.example.com:51820")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "10.0.0.1:51820", addr.String())
+	// Cached addresses are returned without a lookup
+	addr, err = er.Resolve("node.example.com:51820")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "10.0.0.1:51820", addr.String())
+	assert.Equal(t, 1, lookups)
+	// Literal addresses are not cached
+	addr, err = er.Resolve("10.0.0.2:51820")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "10.0.0.2:51820", addr.String())
+	assert.Equal(t, 1, len(er.addrs))
+
+	_, err = er.Resolve("missing.example.com:51820")
+	assert.NotEqual(t, nil, err)
+
+	// Unchanged records
+	assert.Equal(t, false, er.Refresh())
+	// Failed lookups keep the last known address
+	delete(records, "node.example.com")
+	assert.Equal(t, false, er.Refresh())
+	addr, _ = er.Resolve("node.example.com:51820")
+	assert.Equal(t, "10.0.0.1:51820", addr.String())
+	// Changed records
+	records["node.example.com"] = "10.0.0.3"
+	assert.Equal(t, true, er.Refresh())
+	addr, _ = er.Resolve("node.example.com:51820")
+	assert.Equal(t, "10.0.0.3:51820", addr.String())
+	// Endpoints that failed to resolve are retried
+	records["missing.example.com"] = "10.0.0.4"
+	assert.Equal(t, true, er.Refresh())
+	addr, err = er.Resolve("missing.example.com:51820")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "10.0.0.4:51820", addr.String())
+
+	er.Prune([]string{"node.example.com:51820"})
+	assert.Equal(t, 1, len(er.addrs))
+	assert.Equal(t, 0, len(er.failed))
+}
@@ -2,8 +2,14 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
@@ -11,128 +17,354 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 
+	"github.com/utilitywarehouse/semaphore-wireguard/backoff"
+	"github.com/utilitywarehouse/semaphore-wireguard/firewall"
 	"github.com/utilitywarehouse/semaphore-wireguard/kube"
 	"github.com/utilitywarehouse/semaphore-wireguard/log"
 	"github.com/utilitywarehouse/semaphore-wireguard/metrics"
 	"github.com/utilitywarehouse/semaphore-wireguard/wireguard"
 )
 
+// podSubnetDiscoveryPeriod is the interval to rediscover the remote pod subnet,
+// when discovery is enabled.
+const podSubnetDiscoveryPeriod = 5 * time.Minute
+
+// apiEndpointCheckPeriod is the interval to health check the remote API server
+// endpoints, when more than one is configured.
+const apiEndpointCheckPeriod = 30 * time.Second
+
+// degradedHoldDown is how long the remote nodes must be listed and watched
+// without errors after an outage before peers can be removed again, so that a
+// flapping remote API does not churn them.
+const degradedHoldDown = 30 * time.Second
+
+// errNodeWatcherNotSynced is returned when syncing peers before the node
+// watcher has synced.
+var errNodeWatcherNotSynced = errors.New("node watcher has not synced")
+
 // Peer keeps the config for a wireguard peer.
 type Peer struct {
-	allowedIPs []string
-	endpoint   string
+	nodeName            string
+	publicKey           string
+	podCIDR             string
+	allowedIPs          []string
+	endpoint            string
+	persistentKeepalive time.Duration
+	invalid             string // Reason the node's annotations are invalid, if they are
 }
 
 // RunnerAnnotations contains the annotations that each runner should use for
 // updating its local node and watching a remote cluster.
 type RunnerAnnotations struct {
-	watchAnnotationWGPublicKey      string
-	watchAnnotationWGEndpoint       string
-	advertisedAnnotationWGPublicKey string
-	advertisedAnnotationWGEndpoint  string
+	watchAnnotationWGPublicKey          string
+	watchAnnotationWGEndpoint           string
+	watchAnnotationWGTunnelAddress      string
+	watchAnnotationWGKeepalive          string
+	advertisedAnnotationWGPublicKey     string
+	advertisedAnnotationWGEndpoint      string
+	advertisedAnnotationWGTunnelAddress string
 }
 
 func constructRunnerAnnotations(localClusterName, remoteClusterName string) RunnerAnnotations {
 	return RunnerAnnotations{
-		watchAnnotationWGPublicKey:      fmt.Sprintf(annotationWGPublicKeyPattern, localClusterName),
-		watchAnnotationWGEndpoint:       fmt.Sprintf(annotationWGEndpointPattern, localClusterName),
-		advertisedAnnotationWGPublicKey: fmt.Sprintf(annotationWGPublicKeyPattern, remoteClusterName),
-		advertisedAnnotationWGEndpoint:  fmt.Sprintf(annotationWGEndpointPattern, remoteClusterName),
+		watchAnnotationWGPublicKey:          fmt.Sprintf(annotationWGPublicKeyPattern, localClusterName),
+		watchAnnotationWGEndpoint:           fmt.Sprintf(annotationWGEndpointPattern, localClusterName),
+		watchAnnotationWGTunnelAddress:      fmt.Sprintf(annotationWGTunnelAddressPattern, localClusterName),
+		watchAnnotationWGKeepalive:          fmt.Sprintf(annotationWGKeepalivePattern, localClusterName),
+		advertisedAnnotationWGPublicKey:     fmt.Sprintf(annotationWGPublicKeyPattern, remoteClusterName),
+		advertisedAnnotationWGEndpoint:      fmt.Sprintf(annotationWGEndpointPattern, remoteClusterName),
+		advertisedAnnotationWGTunnelAddress: fmt.Sprintf(annotationWGTunnelAddressPattern, remoteClusterName),
 	}
 }
 
 // Runner is the main runner that keeps a watch on the remote cluster's nodes
 // and adds/removes local peers.
 type Runner struct {
-	nodeName    string
-	client      kubernetes.Interface
-	podSubnet   *net.IPNet
-	device      *wireguard.Device
-	nodeWatcher *kube.NodeWatcher
-	peers       map[string]Peer
-	canSync     bool // Flag to allow updating wireguard peers only after initial node watcher sync
-	initialised bool // Flag to turn on after the successful initialisation of the runner to report healthy
-	annotations RunnerAnnotations
-	sync        chan struct{}
-	stop        chan struct{}
-}
-
-func newRunner(client, watchClient kubernetes.Interface, nodeName, wgDeviceName, wgKeyPath, localClusterName, remoteClusterName string, wgDeviceMTU, wgListenPort int, podSubnet *net.IPNet, resyncPeriod time.Duration) *Runner {
+	nodeName          string
+	cluster           string // The remote cluster name
+	client            kubernetes.Interface
+	recorder          record.EventRecorder
+	remoteClient      kubernetes.Interface // Replaced to rotate credentials
+	credentials       string               // Data of the credentials secret that remoteClient was created from, if any
+	podSubnet         *net.IPNet
+	podSubnetConfig   *net.IPNet // Explicitly configured pod subnet, takes precedence over discovery
+	subnetDiscovery   string     // Method to discover the remote pod subnet, empty to disable discovery
+	localPodSubnet    *net.IPNet // Local cluster's pod subnet, which the node's pod CIDR block index is taken from
+	localTunnelRange  *net.IPNet // Range to allocate the local node's tunnel address from
+	remoteTunnelRange *net.IPNet // Range of the remote nodes' tunnel addresses
+	tunnelAddress     net.IP
+	localPodCIDR      *net.IPNet
+	claimPodSubnet    func(*net.IPNet) error // Checks a discovered pod subnet against the other pod subnets and reserves it
+	device            *wireguard.Device
+	firewall          firewall.Manager // Optional, nil when neither filtering nor masquerading is enabled
+	filter            bool             // Flag to install filtering rules for the listen port and forwarding
+	masquerade        bool             // Flag to install SNAT rules for traffic leaving via the device
+	autoMTU           bool             // Flag to derive the device MTU from the egress interfaces towards the peers
+	keepalive         time.Duration    // Default peers persistent keepalive interval, 0 disables keepalives
+	resolver          *endpointResolver
+	resolveInterval   time.Duration // Interval to re-resolve hostname endpoints, 0 disables re-resolution
+	nodeWatcher       *kube.NodeWatcher
+	failover          *kube.EndpointFailover
+	nodeSelector      string
+	resyncPeriod      time.Duration
+	peersFile         string     // File to persist the last known good peers to, empty to disable
+	watching          bool       // Flag set once the node watcher is started, guarded by clientMu
+	clientMu          sync.Mutex // Guards remoteClient, credentials, nodeWatcher and watching
+	peers             map[string]Peer
+	invalidPeers      map[string]string // Reasons for skipping invalid peers keyed by node name
+	collisions        []PeerCollision
+	lastSync          time.Time    // Time of the last successful peers sync
+	syncErr           error        // Error of the last peers sync attempt
+	degraded          bool         // Flag set while listing or watching the remote nodes fails
+	outages           uint64       // Count of times degraded was set, to cancel pending recoveries
+	startErr          error        // Permanent error that Run failed with, so it is not retried
+	mu                sync.RWMutex // Guards initialised, podSubnet, peers, invalidPeers, collisions, lastSync, syncErr, degraded, outages and startErr
+	canSync           atomic.Bool  // Flag to allow updating wireguard peers only after initial node watcher sync
+	initialised       bool         // Flag to turn on after the successful initialisation of the runner to report healthy
+	annotations       RunnerAnnotations
+	condition         v1.NodeCondition
+	lastTransmit      map[string]int64 // Bytes sent to each peer at the last node condition update
+	sync              chan struct{}
+	stop              chan struct{}
+	loops             sync.WaitGroup // Tracks the background loops and Run, so that Stop can wait for them to exit
+}
+
+// runnerConfig is the config of a runner, built from the config of its remote
+// cluster and of the local cluster.
+type runnerConfig struct {
+	client             kubernetes.Interface // Client of the local cluster
+	remoteClient       kubernetes.Interface
+	credentials        string // Data of the credentials secret that remoteClient was created from, if any
+	failover           *kube.EndpointFailover
+	recorder           record.EventRecorder
+	nodeName           string
+	localClusterName   string
+	remoteClusterName  string
+	wgDeviceName       string
+	wgKeyPath          string
+	wgDeviceMTU        int
+	wgListenPort       int
+	wgFwMark           int
+	wgImplementation   string
+	wgNamespaces       wireguard.Namespaces
+	autoMTU            bool
+	routes             wireguard.RouteConfig
+	peersFile          string
+	podSubnet          *net.IPNet // Configured remote pod subnet, nil to discover it
+	podSubnetDiscovery string
+	claimPodSubnet     func(*net.IPNet) error
+	localPodSubnet     *net.IPNet
+	localTunnelRange   *net.IPNet
+	remoteTunnelRange  *net.IPNet
+	nodeSelector       string
+	firewall           firewall.Manager
+	filter             bool
+	masquerade         bool
+	keepalive          time.Duration
+	resolveInterval    time.Duration
+	resyncPeriod       time.Duration
+}
+
+func newRunner(conf runnerConfig) *Runner {
 	runner := &Runner{
-		nodeName:    nodeName,
-		client:      client,
-		podSubnet:   podSubnet,
-		peers:       make(map[string]Peer),
-		canSync:     false,
-		initialised: false,
-		annotations: constructRunnerAnnotations(localClusterName, remoteClusterName),
-		sync:        make(chan struct{}),
-		stop:        make(chan struct{}),
-	}
-	runner.device = wireguard.NewDevice(wgDeviceName, wgKeyPath, wgDeviceMTU, wgListenPort)
-	nw := kube.NewNodeWatcher(
-		watchClient,
-		resyncPeriod,
-		runner.nodeEventHandler,
-		remoteClusterName,
-	)
-	runner.nodeWatcher = nw
-	runner.nodeWatcher.Init()
-	go runner.syncLoop()
+		nodeName:          conf.nodeName,
+		cluster:           conf.remoteClusterName,
+		client:            conf.client,
+		recorder:          conf.recorder,
+		remoteClient:      conf.remoteClient,
+		credentials:       conf.credentials,
+		failover:          conf.failover,
+		podSubnet:         conf.podSubnet,
+		podSubnetConfig:   conf.podSubnet,
+		subnetDiscovery:   conf.podSubnetDiscovery,
+		claimPodSubnet:    conf.claimPodSubnet,
+		localPodSubnet:    conf.localPodSubnet,
+		localTunnelRange:  conf.localTunnelRange,
+		remoteTunnelRange: conf.remoteTunnelRange,
+		firewall:          conf.firewall,
+		filter:            conf.filter,
+		masquerade:        conf.masquerade,
+		autoMTU:           conf.autoMTU,
+		keepalive:         conf.keepalive,
+		resolver:          newEndpointResolver(conf.wgDeviceName),
+		resolveInterval:   conf.resolveInterval,
+		nodeSelector:      conf.nodeSelector,
+		resyncPeriod:      conf.resyncPeriod,
+		peersFile:         conf.peersFile,
+		peers:             make(map[string]Peer),
+		invalidPeers:      make(map[string]string),
+		initialised:       false,
+		annotations:       constructRunnerAnnotations(conf.localClusterName, conf.remoteClusterName),
+		sync:              make(chan struct{}),
+		stop:              make(chan struct{}),
+	}
+	runner.device = wireguard.NewDevice(conf.wgDeviceName, conf.wgKeyPath, conf.wgDeviceMTU, conf.wgListenPort, conf.wgFwMark, conf.routes, conf.wgImplementation, conf.wgNamespaces)
+	runner.nodeWatcher = runner.newNodeWatcher(conf.remoteClient)
+	runner.loops.Go(runner.syncLoop)
+	runner.loops.Go(runner.resolveLoop)
+	runner.loops.Go(runner.conditionLoop)
+	if conf.failover != nil {
+		runner.loops.Go(runner.failoverLoop)
+	}
 
 	return runner
 }
 
+// Start runs the runner in the background, retrying until it succeeds, fails
+// permanently or the runner is stopped. Stop waits for it to return. If after
+// is not nil, the runner only starts once it is closed.
+func (r *Runner) Start(after <-chan struct{}) {
+	r.loops.Go(func() {
+		if after != nil {
+			select {
+			case <-after:
+			case <-r.stop:
+				return
+			}
+		}
+		backoff.RetryUntil(r.Run, r.stop, "start runner")
+	})
+}
+
 // Run will set up local interface and route, and start the nodes watcher.
-func (r *Runner) Run() error {
+// Failures are also recorded as events against the local node.
+func (r *Runner) Run() (err error) {
+	defer func() {
+		if err != nil {
+			r.event(v1.EventTypeWarning, "RunnerFailed", "Failed to start runner: %v", err)
+		}
+		// Permanent errors are reported by the node condition, since
+		// the runner will not become ready
+		if backoff.IsPermanent(err) {
+			r.mu.Lock()
+			r.startErr = err
+			r.mu.Unlock()
+		}
+	}()
 	if err := r.device.Run(); err != nil {
 		return err
 	}
+	if r.device.Created() {
+		r.event(v1.EventTypeNormal, "DeviceCreated", "Created wg device")
+	}
+	metrics.SetDeviceMTU(r.device.Name(), r.device.MTU())
 	if err := r.device.Configure(); err != nil {
 		return err
 	}
+	if r.device.KeyGenerated() {
+		r.event(v1.EventTypeNormal, "KeyGenerated", "Generated new wg private key, public key: %s", r.device.PublicKey())
+	}
+	if r.subnetDiscovery != "" {
+		if _, err := r.discoverPodSubnet(); err != nil {
+			if r.currentPodSubnet() == nil {
+				return err
+			}
+			log.Logger.Warn("Failed to discover remote pod subnet, using configured one", "err", err)
+		}
+	}
 	if err := r.patchLocalNode(); err != nil {
 		return err
 	}
-	if err := r.device.FlushAddresses(); err != nil {
-		return err
+	if r.tunnelAddress != nil {
+		if err := r.device.UpdateAddress(hostIPNet(r.tunnelAddress)); err != nil {
+			return err
+		}
+	} else {
+		if err := r.device.FlushAddresses(); err != nil {
+			return err
+		}
 	}
 	if err := r.device.EnsureLinkUp(); err != nil {
 		return err
 	}
 	// Static route to the whole subnet cidr
-	if err := r.device.AddRouteToNet(r.podSubnet); err != nil {
+	podSubnet := r.currentPodSubnet()
+	if err := r.device.AddRouteToNet(podSubnet); err != nil {
+		return err
+	}
+	if err := r.device.EnsureRuleToNet(podSubnet); err != nil {
+		return err
+	}
+	// Static route to the remote nodes' tunnel addresses
+	if r.remoteTunnelRange != nil {
+		if err := r.device.AddRouteToNet(r.remoteTunnelRange); err != nil {
+			return err
+		}
+		if err := r.device.EnsureRuleToNet(r.remoteTunnelRange); err != nil {
+			return err
+		}
+	}
+	// Forwarding and masquerading must not wait for the first peers sync,
+	// which needs the remote API. The listen port only accepts the peers'
+	// endpoints, starting with the restored ones below.
+	if err := r.applyFirewallRules(nil); err != nil {
 		return err
 	}
 	// At this point the runner should be considered successfully initialised
+	r.mu.Lock()
 	r.initialised = true
+	r.mu.Unlock()
+
+	// Keep the remote nodes reachable until the node watcher syncs
+	if err := r.restorePeers(); err != nil {
+		log.Logger.Warn("Failed to restore persisted peers", "device", r.device.Name(), "err", err)
+	}
 
-	go r.nodeWatcher.Run()
-	// wait for node watcher to sync. TODO: atm dummy and could run forever
-	// if node cache fails to sync
-	stopCh := make(chan struct{})
-	if ok := cache.WaitForNamedCacheSync("nodeWatcher", stopCh, r.nodeWatcher.HasSynced); !ok {
+	r.clientMu.Lock()
+	if !r.watching {
+		go r.nodeWatcher.Run()
+		r.watching = true
+	}
+	r.clientMu.Unlock()
+	// wait for node watcher to sync, or for the runner to stop. The
+	// watcher may be replaced in the meantime to rotate credentials.
+	if ok := cache.WaitForNamedCacheSync("nodeWatcher", r.stop, r.nodeWatcherSynced); !ok {
 		return fmt.Errorf("failed to wait for nodes cache to sync")
 	}
-	r.canSync = true
+	r.canSync.Store(true)
 	r.enqueuePeersSync()
 	return nil
 }
 
 func (r *Runner) syncLoop() {
+	var discover <-chan time.Time
+	if r.subnetDiscovery != "" {
+		ticker := time.NewTicker(podSubnetDiscoveryPeriod)
+		defer ticker.Stop()
+		discover = ticker.C
+	}
 	for {
 		select {
+		case <-discover:
+			if !r.canSync.Load() {
+				continue
+			}
+			r.rediscoverPodSubnet()
 		case <-r.sync:
-			if !r.canSync {
+			if !r.canSync.Load() {
 				log.Logger.Warn("Cannot sync peers while canSync flag is not set")
 				continue
 			}
 			err := r.syncPeers()
+			// A sync is queued once the replaced watcher syncs
+			if errors.Is(err, errNodeWatcherNotSynced) {
+				log.Logger.Debug("Skipping peers sync until the node watcher syncs", "device", r.device.Name())
+				continue
+			}
 			metrics.SyncPeerAttempt(r.device.Name(), err)
+			r.mu.Lock()
+			r.syncErr = err
+			if err == nil {
+				r.lastSync = time.Now()
+			}
+			r.mu.Unlock()
 			if err != nil {
 				log.Logger.Warn("Failed to sync wg peers", "err", err)
+				r.event(v1.EventTypeWarning, "SyncFailed", "Failed to sync wg peers: %v", err)
 				r.requeuePeersSync()
 			}
 		case <-r.stop:
@@ -142,30 +374,568 @@ func (r *Runner) syncLoop() {
 	}
 }
 
+// discoverPodSubnet derives the remote pod subnet from the remote cluster and
+// returns true if it changed. An explicitly configured pod subnet takes
+// precedence, and is only compared against the discovered one.
+func (r *Runner) discoverPodSubnet() (bool, error) {
+	r.clientMu.Lock()
+	client := r.remoteClient
+	r.clientMu.Unlock()
+	subnet, err := kube.DiscoverPodSubnet(client, r.subnetDiscovery)
+	if err != nil {
+		return false, fmt.Errorf("Failed to discover remote pod subnet: %v", err)
+	}
+	if r.podSubnetConfig != nil {
+		if subnet.String() != r.podSubnetConfig.String() {
+			log.Logger.Warn(
+				"Discovered remote pod subnet differs from the configured one",
+				"device", r.device.Name(),
+				"configured", r.podSubnetConfig,
+				"discovered", subnet,
+			)
+		}
+		return false, nil
+	}
+	old := r.currentPodSubnet()
+	if old != nil && old.String() == subnet.String() {
+		return false, nil
+	}
+	// Discovered subnets are checked like the configured ones before
+	// routing to them
+	if r.localPodCIDR != nil && subnetsOverlap(subnet, r.localPodCIDR) {
+		return false, fmt.Errorf("Discovered remote pod subnet %s overlaps with the local node pod CIDR %s", subnet, r.localPodCIDR)
+	}
+	if r.claimPodSubnet != nil {
+		if err := r.claimPodSubnet(subnet); err != nil {
+			return false, err
+		}
+	}
+	log.Logger.Info("Discovered remote pod subnet", "device", r.device.Name(), "old", old, "new", subnet)
+	r.mu.Lock()
+	r.podSubnet = subnet
+	r.mu.Unlock()
+	return true, nil
+}
+
+// currentPodSubnet returns the remote pod subnet, which may be rediscovered.
+func (r *Runner) currentPodSubnet() *net.IPNet {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.podSubnet
+}
+
+// rediscoverPodSubnet runs the pod subnet discovery and, if the subnet has
+// changed, replaces the route to it and triggers a peers sync.
+func (r *Runner) rediscoverPodSubnet() {
+	old := r.currentPodSubnet()
+	changed, err := r.discoverPodSubnet()
+	if err != nil {
+		log.Logger.Warn("Keeping current remote pod subnet", "device", r.device.Name(), "err", err)
+		return
+	}
+	if !changed {
+		return
+	}
+	podSubnet := r.currentPodSubnet()
+	if err := r.device.AddRouteToNet(podSubnet); err != nil {
+		log.Logger.Error("Failed to add route to the remote pod subnet", "device", r.device.Name(), "err", err)
+		return
+	}
+	if err := r.device.EnsureRuleToNet(podSubnet); err != nil {
+		log.Logger.Error("Failed to add rule for the remote pod subnet", "device", r.device.Name(), "err", err)
+		return
+	}
+	if old != nil {
+		if err := r.device.RemoveRouteToNet(old); err != nil {
+			log.Logger.Error("Failed to remove route to the old remote pod subnet", "device", r.device.Name(), "err", err)
+		}
+	}
+	// The sync loop calls this, so queue the sync asynchronously
+	go r.enqueuePeersSync()
+}
+
+// resolveLoop periodically re-resolves the peers' hostname endpoints and
+// triggers a peers sync when an address changes.
+func (r *Runner) resolveLoop() {
+	if r.resolveInterval == 0 {
+		return
+	}
+	ticker := time.NewTicker(r.resolveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if r.canSync.Load() && r.resolver.Refresh() {
+				r.enqueuePeersSync()
+			}
+		case <-r.stop:
+			log.Logger.Debug("Stopping resolve loop")
+			return
+		}
+	}
+}
+
+// conditionLoop periodically reports the health of the mesh with the remote
+// cluster as a condition of the local node. It is the only user of the
+// runner's last reported condition and of the peers' transmitted bytes.
+func (r *Runner) conditionLoop() {
+	ticker := time.NewTicker(nodeConditionPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.updateNodeCondition(); err != nil {
+				log.Logger.Warn("Failed to update node condition", "device", r.device.Name(), "err", err)
+			}
+		case <-r.stop:
+			log.Logger.Debug("Stopping condition loop")
+			return
+		}
+	}
+}
+
+// failoverLoop health checks the remote API server endpoints and switches the
+// remote client to the first ready one.
+func (r *Runner) failoverLoop() {
+	metrics.SetActiveAPIEndpoint(r.cluster, r.failover.Endpoints(), r.failover.Active())
+	client := func() rest.Interface {
+		r.clientMu.Lock()
+		defer r.clientMu.Unlock()
+		return r.remoteClient.Discovery().RESTClient()
+	}
+	r.failover.Run(r.stop, apiEndpointCheckPeriod, client, func(old, new string) {
+		log.Logger.Warn("Switched remote API server endpoint", "device", r.device.Name(), "old", old, "new", new)
+		r.event(v1.EventTypeWarning, "APIEndpointChanged", "Switched remote API server endpoint from %s to %s", old, new)
+		metrics.SetActiveAPIEndpoint(r.cluster, r.failover.Endpoints(), new)
+	})
+	log.Logger.Debug("Stopping failover loop")
+}
+
+// updateNodeCondition patches the local node's condition for the remote
+// cluster, keeping the transition time unless the status or reason changed.
+func (r *Runner) updateNodeCondition() error {
+	now := time.Now()
+	r.mu.RLock()
+	health := meshHealth{
+		startErr:     r.startErr,
+		initialised:  r.initialised,
+		lastSync:     r.lastSync,
+		syncErr:      r.syncErr,
+		invalidPeers: len(r.invalidPeers),
+	}
+	peers := r.peers
+	r.mu.RUnlock()
+	if health.initialised {
+		devicePeers, err := r.device.Peers()
+		if err != nil {
+			return fmt.Errorf("Failed to get device peers: %v", err)
+		}
+		for _, dp := range devicePeers {
+			if _, ok := peers[dp.PublicKey.String()]; ok {
+				health.peers++
+			}
+		}
+		health.stalePeers = stalePeers(peers, devicePeers, r.lastTransmit, now)
+		r.lastTransmit = map[string]int64{}
+		for _, dp := range devicePeers {
+			r.lastTransmit[dp.PublicKey.String()] = dp.TransmitBytes
+		}
+	}
+	condition := nodeCondition(r.cluster, health, now)
+	condition.LastTransitionTime = r.condition.LastTransitionTime
+	if condition.Status != r.condition.Status || condition.Reason != r.condition.Reason {
+		condition.LastTransitionTime.Time = now
+	}
+	if err := kube.PatchNodeCondition(r.client, r.nodeName, condition); err != nil {
+		return err
+	}
+	r.condition = condition
+	return nil
+}
+
 // syncPeers will try to get a list of peers based on the nodes list and set wg
-// peers based on the nodes annotations. It also updates the runner's peer
-// variable.
+// peers based on the nodes annotations. While the remote API is unreachable,
+// peers are only added or updated, never removed, and the peers are persisted
+// otherwise.
 func (r *Runner) syncPeers() error {
-	peers, err := r.calculatePeersFromNodeList()
+	peers, collisions, err := r.calculatePeersFromNodeList()
 	if err != nil {
-		return fmt.Errorf("Failed to get peers list: %v", err)
+		return fmt.Errorf("Failed to get peers list: %w", err)
+	}
+	r.reportCollisions(collisions)
+	r.mu.RLock()
+	degraded := r.degraded
+	if degraded {
+		peers = keepPeers(peers, r.peers)
+	}
+	r.mu.RUnlock()
+	if err := r.setPeers(peers); err != nil {
+		return err
+	}
+	if r.peersFile != "" && !degraded {
+		if err := savePeers(r.peersFile, peers); err != nil {
+			log.Logger.Warn("Failed to persist peers", "device", r.device.Name(), "err", err)
+		}
 	}
+	return nil
+}
+
+// restorePeers sets the peers persisted by a previous run, if the runner has
+// no peers yet.
+func (r *Runner) restorePeers() error {
+	r.mu.RLock()
+	empty := len(r.peers) == 0
+	r.mu.RUnlock()
+	if r.peersFile == "" || !empty {
+		return nil
+	}
+	peers, err := loadPeers(r.peersFile)
+	if err != nil || len(peers) == 0 {
+		return err
+	}
+	log.Logger.Info("Restoring persisted peers", "device", r.device.Name(), "peers", len(peers))
+	return r.setPeers(peers)
+}
+
+// setPeers sets wg peers and updates the runner's peer variable with the peers
+// that were configured. Peers with hostname endpoints that cannot be resolved
+// are skipped, and will be added once their endpoints resolve. Peers with
+// invalid annotations or pod CIDR are skipped and reported, without affecting
+// the rest.
+func (r *Runner) setPeers(peers map[string]Peer) error {
+	var endpoints []string
+	for _, peer := range peers {
+		endpoints = append(endpoints, peer.endpoint)
+	}
+	valid, peersConfig, invalidPeers := r.validPeers(peers)
+	r.resolver.Prune(endpoints)
+	r.reportInvalidPeers(invalidPeers)
+	log.Logger.Debug("Updating wg peers", "peers", peersConfig)
+	if err := r.device.SetPeers(peersConfig); err != nil {
+		return err
+	}
+	r.reportPeerChanges(valid)
+	r.mu.Lock()
+	r.peers = valid
+	r.mu.Unlock()
+	if err := r.updateMTU(peersConfig); err != nil {
+		return err
+	}
+	return r.applyFirewallRules(peersConfig)
+}
+
+// reportPeerChanges records events for the remote nodes added and removed as
+// peers, compared to the last sync.
+func (r *Runner) reportPeerChanges(peers map[string]Peer) {
+	var added, removed []string
+	for key, p := range peers {
+		if _, ok := r.peers[key]; !ok {
+			added = append(added, p.nodeName)
+		}
+	}
+	for key, p := range r.peers {
+		if _, ok := peers[key]; !ok {
+			removed = append(removed, p.nodeName)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	if len(added) > 0 {
+		r.event(v1.EventTypeNormal, "PeersAdded", "Added peers for remote nodes: %s", strings.Join(added, ", "))
+	}
+	if len(removed) > 0 {
+		r.event(v1.EventTypeNormal, "PeersRemoved", "Removed peers for remote nodes: %s", strings.Join(removed, ", "))
+	}
+}
+
+// event records an event about the runner's device against the local node.
+func (r *Runner) event(eventType, reason, messageFmt string, args ...interface{}) {
+	r.recorder.Eventf(
+		kube.NodeReference(r.nodeName),
+		eventType,
+		reason,
+		"%s: %s", r.device.Name(), fmt.Sprintf(messageFmt, args...),
+	)
+}
+
+// reportCollisions logs the nodes that were refused as peers because of
+// conflicting config and updates the collisions metric. An event is recorded
+// against the local node the first time a collision is detected.
+func (r *Runner) reportCollisions(collisions []PeerCollision) {
+	known := map[string]bool{}
+	for _, c := range r.collisions {
+		known[c.String()] = true
+	}
+	for _, c := range collisions {
+		log.Logger.Warn("Refusing colliding peers", "reason", c.Reason, "value", c.Value, "nodes", c.Nodes)
+		if known[c.String()] {
+			continue
+		}
+		r.event(v1.EventTypeWarning, "PeerCollision", "Refusing colliding remote nodes: %s", c)
+	}
+	r.mu.Lock()
+	r.collisions = collisions
+	r.mu.Unlock()
+	metrics.SetPeerCollisions(r.device.Name(), len(collisions))
+}
+
+// reportInvalidPeers logs the peers that were skipped because of invalid
+// config and updates the invalid peers metric. An event is recorded against
+// the local node the first time a remote node is found invalid for a reason.
+func (r *Runner) reportInvalidPeers(invalidPeers map[string]string) {
+	for node, reason := range invalidPeers {
+		log.Logger.Warn("Skipping invalid peer", "node", node, "reason", reason)
+		if r.invalidPeers[node] == reason {
+			continue
+		}
+		r.event(v1.EventTypeWarning, "InvalidPeer", "Skipping remote node %s: %s", node, reason)
+	}
+	r.mu.Lock()
+	r.invalidPeers = invalidPeers
+	r.mu.Unlock()
+	metrics.SetInvalidPeers(r.device.Name(), len(invalidPeers))
+}
+
+// validPeers returns the peers that can be configured and their wg configs,
+// along with the reasons for skipping invalid peers keyed by node name. Peers
+// with hostname endpoints that cannot be resolved are skipped without a
+// reason, since they may resolve later.
+func (r *Runner) validPeers(peers map[string]Peer) (map[string]Peer, []wgtypes.PeerConfig, map[string]string) {
+	valid := map[string]Peer{}
 	var peersConfig []wgtypes.PeerConfig
+	invalidPeers := map[string]string{}
 	for pubKey, peer := range peers {
-		pc, err := wireguard.NewPeerConfig(pubKey, "", peer.endpoint, peer.allowedIPs)
+		if peer.invalid != "" {
+			invalidPeers[peer.nodeName] = peer.invalid
+			continue
+		}
+		if err := r.checkPodCIDR(peer.podCIDR); err != nil {
+			invalidPeers[peer.nodeName] = err.Error()
+			continue
+		}
+		endpoint, err := r.resolveEndpoint(peer.endpoint)
 		if err != nil {
-			return err
+			if isHostnameEndpoint(peer.endpoint) {
+				log.Logger.Warn("Skipping peer with unresolvable endpoint", "peer", pubKey, "endpoint", peer.endpoint, "err", err)
+				continue
+			}
+			invalidPeers[peer.nodeName] = fmt.Sprintf("invalid endpoint %q: %v", peer.endpoint, err)
+			continue
+		}
+		pc, err := wireguard.NewPeerConfig(pubKey, "", endpoint, peer.allowedIPs, peer.persistentKeepalive)
+		if err != nil {
+			invalidPeers[peer.nodeName] = fmt.Sprintf("invalid peer config: %v", err)
+			continue
 		}
+		valid[pubKey] = peer
 		peersConfig = append(peersConfig, *pc)
 	}
-	log.Logger.Debug("Updating wg peers", "peers", peersConfig)
-	if err := wireguard.SetPeers(r.device.Name(), peersConfig); err != nil {
+	return valid, peersConfig, invalidPeers
+}
+
+// checkPodCIDR verifies that a remote node's pod CIDR is part of the remote
+// cluster's pod subnet, so that it is routed via the device.
+func (r *Runner) checkPodCIDR(podCIDR string) error {
+	_, cidr, err := net.ParseCIDR(podCIDR)
+	if err != nil {
+		return fmt.Errorf("invalid pod CIDR %q: %v", podCIDR, err)
+	}
+	podSubnet := r.currentPodSubnet()
+	if !subnetContains(podSubnet, cidr) {
+		return fmt.Errorf("pod CIDR %s is not part of the pod subnet %s", cidr, podSubnet)
+	}
+	return nil
+}
+
+// resolveEndpoint returns the peer endpoint with its host resolved to an IP
+// address. Empty endpoints are returned as is.
+func (r *Runner) resolveEndpoint(endpoint string) (string, error) {
+	if endpoint == "" {
+		return "", nil
+	}
+	addr, err := r.resolver.Resolve(endpoint)
+	if err != nil {
+		return "", err
+	}
+	return addr.String(), nil
+}
+
+// updateMTU sets the device MTU based on the egress interfaces towards the
+// peers' endpoints, if automatic MTU is enabled. The MTU is left unchanged
+// when no peer endpoint has a route.
+func (r *Runner) updateMTU(peersConfig []wgtypes.PeerConfig) error {
+	if !r.autoMTU {
+		return nil
+	}
+	var endpoints []net.IP
+	for _, pc := range peersConfig {
+		if pc.Endpoint != nil {
+			endpoints = append(endpoints, pc.Endpoint.IP)
+		}
+	}
+	mtu, err := r.device.EndpointsMTU(endpoints)
+	if err != nil {
+		return fmt.Errorf("Failed to calculate device MTU: %v", err)
+	}
+	if mtu == 0 || mtu == r.device.MTU() {
+		return nil
+	}
+	log.Logger.Info("Updating device MTU", "device", r.device.Name(), "old", r.device.MTU(), "new", mtu)
+	if err := r.device.SetMTU(mtu); err != nil {
 		return err
 	}
-	r.peers = peers
+	metrics.SetDeviceMTU(r.device.Name(), mtu)
+	return nil
+}
+
+// applyFirewallRules allows traffic to the device listen port only from the
+// peers' endpoints and forwarding from and to the remote pod subnet, if
+// filtering is enabled, and masquerades traffic leaving via the device from
+// sources outside the local node's pod CIDR, if masquerading is enabled.
+func (r *Runner) applyFirewallRules(peersConfig []wgtypes.PeerConfig) error {
+	if r.firewall == nil {
+		return nil
+	}
+	rules := firewall.Rules{}
+	if r.filter {
+		rules.ListenPort = r.device.ListenPort()
+		rules.PodSubnet = r.currentPodSubnet()
+		for _, pc := range peersConfig {
+			if pc.Endpoint != nil {
+				rules.Endpoints = append(rules.Endpoints, pc.Endpoint.IP)
+			}
+		}
+	}
+	if r.masquerade {
+		addr, err := r.snatAddress()
+		if err != nil {
+			return err
+		}
+		rules.SNATAddress = addr
+		rules.LocalPodCIDR = r.localPodCIDR
+	}
+	if err := r.firewall.Apply(rules); err != nil {
+		return fmt.Errorf("Failed to apply firewall rules: %v", err)
+	}
 	return nil
 }
 
+// snatAddress returns the address to masquerade traffic leaving via the
+// device to, which is the node's tunnel address. Addresses of the node's pod
+// CIDR are not used, since the IPAM may assign any of them to pods.
+func (r *Runner) snatAddress() (net.IP, error) {
+	if r.tunnelAddress == nil {
+		return nil, fmt.Errorf("Cannot masquerade without a tunnel address")
+	}
+	return r.tunnelAddress, nil
+}
+
+// Stop stops the node watcher and the runner's loops, removes the runner's
+// firewall rules and stops the device if it runs in userspace.
+func (r *Runner) Stop() {
+	close(r.stop)
+	r.clientMu.Lock()
+	r.nodeWatcher.Stop()
+	r.clientMu.Unlock()
+	// An in-flight peers sync could otherwise apply the firewall rules
+	// again after they are cleaned up
+	r.loops.Wait()
+	if r.firewall != nil {
+		if err := r.firewall.Cleanup(); err != nil {
+			log.Logger.Error("Failed to clean up firewall rules", "device", r.device.Name(), "err", err)
+		}
+	}
+	if err := r.device.Close(); err != nil {
+		log.Logger.Error("Failed to close device", "device", r.device.Name(), "err", err)
+	}
+}
+
+// Remove stops the runner and removes its device, along with the routes and
+// rules to the remote cluster, the persisted peers and the node condition.
+func (r *Runner) Remove() {
+	r.Stop()
+	conditionType := v1.NodeConditionType(fmt.Sprintf(nodeConditionPattern, r.cluster))
+	if err := kube.RemoveNodeCondition(r.client, r.nodeName, conditionType); err != nil {
+		log.Logger.Error("Failed to remove node condition", "device", r.device.Name(), "err", err)
+	}
+	if r.peersFile != "" {
+		if err := os.Remove(r.peersFile); err != nil && !os.IsNotExist(err) {
+			log.Logger.Error("Failed to remove persisted peers", "device", r.device.Name(), "err", err)
+		}
+	}
+	for _, subnet := range []*net.IPNet{r.currentPodSubnet(), r.remoteTunnelRange} {
+		if subnet == nil {
+			continue
+		}
+		if err := r.device.RemoveRouteToNet(subnet); err != nil {
+			log.Logger.Error("Failed to remove route", "device", r.device.Name(), "subnet", subnet, "err", err)
+		}
+	}
+	if err := r.device.Delete(); err != nil {
+		log.Logger.Error("Failed to delete device", "device", r.device.Name(), "err", err)
+	}
+}
+
+// PeerStatus is the config of a wg peer as reported by the debug API.
+type PeerStatus struct {
+	Node                string   `json:"node"`
+	PublicKey           string   `json:"publicKey"`
+	Endpoint            string   `json:"endpoint"`
+	AllowedIPs          []string `json:"allowedIPs"`
+	PersistentKeepalive string   `json:"persistentKeepalive"`
+}
+
+// RunnerStatus is a snapshot of the runner's peers as reported by the debug
+// API.
+type RunnerStatus struct {
+	Cluster      string            `json:"cluster"`
+	Device       string            `json:"device"`
+	PublicKey    string            `json:"publicKey"`
+	ListenPort   int               `json:"listenPort"`
+	Initialised  bool              `json:"initialised"`
+	Degraded     bool              `json:"degraded"`
+	Peers        []PeerStatus      `json:"peers"`
+	InvalidPeers map[string]string `json:"invalidPeers"`
+	Collisions   []PeerCollision   `json:"collisions"`
+}
+
+// Initialised returns true once the runner has set up its device.
+func (r *Runner) Initialised() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.initialised
+}
+
+// Status returns a snapshot of the runner's peers, as of the last sync.
+func (r *Runner) Status() RunnerStatus {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	status := RunnerStatus{
+		Cluster:      r.cluster,
+		Device:       r.device.Name(),
+		PublicKey:    r.device.PublicKey(),
+		ListenPort:   r.device.ListenPort(),
+		Initialised:  r.initialised,
+		Degraded:     r.degraded,
+		Peers:        []PeerStatus{},
+		InvalidPeers: r.invalidPeers,
+		Collisions:   r.collisions,
+	}
+	for _, peer := range r.peers {
+		status.Peers = append(status.Peers, PeerStatus{
+			Node:                peer.nodeName,
+			PublicKey:           peer.publicKey,
+			Endpoint:            peer.endpoint,
+			AllowedIPs:          peer.allowedIPs,
+			PersistentKeepalive: peer.persistentKeepalive.String(),
+		})
+	}
+	sort.Slice(status.Peers, func(i, j int) bool {
+		return status.Peers[i].Node < status.Peers[j].Node
+	})
+	return status
+}
+
 func (r *Runner) enqueuePeersSync() {
 	select {
 	case r.sync <- struct{}{}:
@@ -174,6 +944,7 @@ func (r *Runner) enqueuePeersSync() {
 		log.Logger.Error("Timed out trying to queue a sync action for netset, sync queue is full")
 		metrics.IncSyncQueueFullFailures(r.device.Name())
 		r.requeuePeersSync()
+	case <-r.stop:
 	}
 }
 
@@ -186,23 +957,102 @@ func (r *Runner) requeuePeersSync() {
 	}()
 }
 
-func (r *Runner) calculatePeersFromNodeList() (map[string]Peer, error) {
-	nodes, err := r.nodeWatcher.List()
+// calculatePeersFromNodeList returns the peers for the remote nodes keyed by
+// public key, and the collisions found between them. Colliding nodes are not
+// included in the peers. It fails with errNodeWatcherNotSynced while the node
+// watcher has not synced, for example after it was replaced, so that peers are
+// not removed based on a partial list.
+func (r *Runner) calculatePeersFromNodeList() (map[string]Peer, []PeerCollision, error) {
+	r.clientMu.Lock()
+	nw := r.nodeWatcher
+	r.clientMu.Unlock()
+	if !nw.HasSynced() {
+		return nil, nil, errNodeWatcherNotSynced
+	}
+	nodes, err := nw.List()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	peers := map[string]Peer{}
+	peers, collisions := r.peersFromNodes(nodes)
+	return peers, collisions, nil
+}
+
+// peersFromNodes returns the peers for the passed remote nodes keyed by public
+// key, and the collisions found between them.
+func (r *Runner) peersFromNodes(nodes []*v1.Node) (map[string]Peer, []PeerCollision) {
+	nodePeers := map[string]Peer{}
 	for _, node := range nodes {
 		if r.checkWSAnnotationsExist(node.Annotations) {
-			pubKey := node.Annotations[r.annotations.watchAnnotationWGPublicKey]
-			peer := Peer{
-				allowedIPs: []string{node.Spec.PodCIDR},
-				endpoint:   node.Annotations[r.annotations.watchAnnotationWGEndpoint],
-			}
-			peers[pubKey] = peer
+			nodePeers[node.Name] = r.peerFromNode(node)
 		}
 	}
-	return peers, nil
+	return filterCollisions(nodePeers)
+}
+
+// peerFromNode returns the wg peer config for a remote node. The node's
+// advertised tunnel address is added to the allowed IPs only if it is part of
+// the remote tunnel range. The persistent keepalive interval can be overridden
+// per node via annotation, and peers with an invalid override are marked
+// invalid.
+func (r *Runner) peerFromNode(node *v1.Node) Peer {
+	peer := Peer{
+		nodeName:            node.Name,
+		publicKey:           node.Annotations[r.annotations.watchAnnotationWGPublicKey],
+		podCIDR:             node.Spec.PodCIDR,
+		allowedIPs:          []string{node.Spec.PodCIDR},
+		endpoint:            node.Annotations[r.annotations.watchAnnotationWGEndpoint],
+		persistentKeepalive: r.keepalive,
+	}
+	if v, ok := node.Annotations[r.annotations.watchAnnotationWGKeepalive]; ok {
+		keepalive, err := time.ParseDuration(v)
+		if err != nil || keepalive < 0 {
+			peer.invalid = fmt.Sprintf("invalid persistent keepalive %q", v)
+		} else {
+			peer.persistentKeepalive = keepalive
+		}
+	}
+	if r.remoteTunnelRange == nil {
+		return peer
+	}
+	if v, ok := node.Annotations[r.annotations.watchAnnotationWGTunnelAddress]; ok {
+		addr := net.ParseIP(v)
+		if addr == nil || !r.remoteTunnelRange.Contains(addr) {
+			log.Logger.Warn(
+				"Ignoring invalid tunnel address",
+				"node", node.Name,
+				"address", v,
+				"range", r.remoteTunnelRange,
+			)
+			return peer
+		}
+		peer.allowedIPs = append(peer.allowedIPs, hostIPNet(addr).String())
+	}
+	return peer
+}
+
+// localTunnelAddress returns the tunnel address for the local node. An
+// address set via the node annotation takes precedence over the one
+// calculated from the node's pod CIDR. Returns nil if no local tunnel range is
+// configured.
+func (r *Runner) localTunnelAddress(node *v1.Node) (net.IP, error) {
+	if r.localTunnelRange == nil {
+		return nil, nil
+	}
+	if v, ok := node.Annotations[annotationWGTunnelAddressOverride]; ok {
+		addr := net.ParseIP(v)
+		if addr == nil {
+			return nil, fmt.Errorf("Cannot parse tunnel address from annotation %s: %s", annotationWGTunnelAddressOverride, v)
+		}
+		if !r.localTunnelRange.Contains(addr) {
+			return nil, fmt.Errorf("Tunnel address %s is not part of the tunnel range %s", addr, r.localTunnelRange)
+		}
+		return addr, nil
+	}
+	_, podCIDR, err := net.ParseCIDR(node.Spec.PodCIDR)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot calculate tunnel address from node pod CIDR: %v", err)
+	}
+	return tunnelAddressFromPodCIDR(podCIDR, r.localPodSubnet, r.localTunnelRange)
 }
 
 // patchLocalNode will make sure we set the needed annotations on the node and
@@ -223,13 +1073,33 @@ func (r *Runner) patchLocalNode() error {
 	if wgEndpoint == "" {
 		return fmt.Errorf("Could not calculate wg endpoint, node internal address not found")
 	}
+	tunnelAddress, err := r.localTunnelAddress(node)
+	if err != nil {
+		return err
+	}
 	annotations := map[string]string{
 		r.annotations.advertisedAnnotationWGPublicKey: r.device.PublicKey(),
 		r.annotations.advertisedAnnotationWGEndpoint:  wgEndpoint,
 	}
+	if tunnelAddress != nil {
+		annotations[r.annotations.advertisedAnnotationWGTunnelAddress] = tunnelAddress.String()
+	}
+	if node.Spec.PodCIDR != "" {
+		_, podCIDR, err := net.ParseCIDR(node.Spec.PodCIDR)
+		if err != nil {
+			return fmt.Errorf("Cannot parse local node pod CIDR: %v", err)
+		}
+		// Retrying cannot resolve the overlap, only a config change can
+		if podSubnet := r.currentPodSubnet(); subnetsOverlap(podCIDR, podSubnet) {
+			return backoff.Permanent(fmt.Errorf("Local node pod CIDR %s overlaps with the remote pod subnet %s", podCIDR, podSubnet))
+		}
+		r.localPodCIDR = podCIDR
+	}
 	if err := kube.PatchNodeAnnotation(r.client, r.nodeName, annotations); err != nil {
-		return err
+		return fmt.Errorf("Failed to patch local node annotations: %v", err)
 	}
+	r.event(v1.EventTypeNormal, "AnnotationsPatched", "Advertised wg config via node annotations")
+	r.tunnelAddress = tunnelAddress
 	return nil
 }
 
@@ -245,17 +1115,158 @@ func (r *Runner) checkWSAnnotationsExist(annotations map[string]string) bool {
 	return true
 }
 
+func (r *Runner) newNodeWatcher(client kubernetes.Interface) *kube.NodeWatcher {
+	nw := kube.NewNodeWatcher(
+		client,
+		r.resyncPeriod,
+		r.nodeEventHandler,
+		r.nodeWatcherErrorHandler,
+		r.nodeWatcherRecoveryHandler,
+		r.cluster,
+		r.nodeSelector,
+	)
+	nw.Init()
+	return nw
+}
+
+// SetRemoteClient replaces the client for the remote cluster, created from the
+// passed credentials data, and restarts the node watcher with it. Peers are
+// kept until the new watcher syncs, and then synced against its nodes. It is a
+// no-op once the runner is stopped.
+func (r *Runner) SetRemoteClient(client kubernetes.Interface, credentials string) {
+	nw := r.newNodeWatcher(client)
+	// Stop closes the stop channel before stopping the current watcher
+	// under the lock, so checking it under the lock ensures that the new
+	// watcher is either stopped by Stop or never started.
+	r.clientMu.Lock()
+	defer r.clientMu.Unlock()
+	select {
+	case <-r.stop:
+		return
+	default:
+	}
+	old := r.nodeWatcher
+	r.remoteClient = client
+	r.credentials = credentials
+	r.nodeWatcher = nw
+	watching := r.watching
+	if watching {
+		go nw.Run()
+	}
+	old.Stop()
+	log.Logger.Info("Replaced remote cluster client", "device", r.device.Name())
+	if !watching {
+		// Run starts the new watcher
+		return
+	}
+	go func() {
+		if !cache.WaitForNamedCacheSync("nodeWatcher", r.stop, nw.HasSynced) {
+			return
+		}
+		// The errors of the replaced watcher no longer apply
+		r.setDegraded(false)
+		if r.canSync.Load() {
+			r.enqueuePeersSync()
+		}
+	}()
+}
+
+// currentCredentials returns the data of the credentials secret that the
+// remote client was created from.
+func (r *Runner) currentCredentials() string {
+	r.clientMu.Lock()
+	defer r.clientMu.Unlock()
+	return r.credentials
+}
+
+// nodeWatcherSynced returns true if the current node watcher has synced.
+func (r *Runner) nodeWatcherSynced() bool {
+	r.clientMu.Lock()
+	defer r.clientMu.Unlock()
+	return r.nodeWatcher.HasSynced()
+}
+
+// nodeWatcherErrorHandler records remote node list and watch errors, which
+// include authentication and CA verification failures, as events.
+func (r *Runner) nodeWatcherErrorHandler(verb string, err error) {
+	r.event(v1.EventTypeWarning, "RemoteWatchFailed", "Failed to %s remote nodes: %v", verb, err)
+	r.setDegraded(true)
+}
+
+// nodeWatcherRecoveryHandler clears the degraded flag once the relisted remote
+// nodes have been in the store for the hold-down period without further
+// errors, and then syncs the peers to remove the ones kept while degraded.
+func (r *Runner) nodeWatcherRecoveryHandler() {
+	r.mu.RLock()
+	degraded, outage := r.degraded, r.outages
+	r.mu.RUnlock()
+	if !degraded {
+		return
+	}
+	log.Logger.Info("Remote nodes relisted, waiting before removing peers", "device", r.device.Name(), "holdDown", degradedHoldDown)
+	time.AfterFunc(degradedHoldDown, func() {
+		r.recover(outage)
+	})
+}
+
+// recover clears the degraded flag set by the passed outage, unless the
+// remote API has been unreachable again since, and syncs the peers.
+func (r *Runner) recover(outage uint64) {
+	select {
+	case <-r.stop:
+		return
+	default:
+	}
+	r.mu.Lock()
+	if r.outages != outage || !r.degraded {
+		r.mu.Unlock()
+		return
+	}
+	r.degraded = false
+	r.mu.Unlock()
+	r.reportDegraded(false)
+	if r.canSync.Load() {
+		r.enqueuePeersSync()
+	}
+}
+
+// setDegraded sets whether the remote API is unreachable.
+func (r *Runner) setDegraded(degraded bool) {
+	r.mu.Lock()
+	changed := r.degraded != degraded
+	r.degraded = degraded
+	if degraded {
+		r.outages++
+	}
+	r.mu.Unlock()
+	if changed {
+		r.reportDegraded(degraded)
+	}
+}
+
+// reportDegraded reports a change of the degraded flag.
+func (r *Runner) reportDegraded(degraded bool) {
+	metrics.SetRemoteDegraded(r.device.Name(), degraded)
+	if degraded {
+		log.Logger.Warn("Remote API is unreachable, keeping current peers", "device", r.device.Name())
+		r.event(v1.EventTypeWarning, "RemoteDegraded", "Remote API is unreachable, keeping current peers")
+	} else {
+		log.Logger.Info("Remote API is reachable again", "device", r.device.Name())
+		r.event(v1.EventTypeNormal, "RemoteRecovered", "Remote API is reachable again")
+	}
+}
+
 func (r *Runner) nodeEventHandler(eventType watch.EventType, old *v1.Node, new *v1.Node) {
 	switch eventType {
 	case watch.Added:
 		if r.checkWSAnnotationsExist(new.Annotations) {
-			r.onPeerNodeUpdate(new)
+			r.onPeerNodeUpdate(nil, new)
 		} else {
 			log.Logger.Debug("Added node missing the needed ws annotations", "node", new.Name)
 		}
 	case watch.Modified:
 		if r.checkWSAnnotationsExist(new.Annotations) {
-			r.onPeerNodeUpdate(new)
+			r.onPeerNodeUpdate(old, new)
 		} else {
 			log.Logger.Debug("Modified node missing the needed ws annotations", "node", new.Name)
 		}
@@ -288,27 +1299,43 @@ func equalSlices(a, b []string) bool {
 	}
 	return true
 }
-func (r *Runner) onPeerNodeUpdate(node *v1.Node) {
+
+// onPeerNodeUpdate syncs the peers if the node's peer config changed. The old
+// node is nil for added nodes.
+func (r *Runner) onPeerNodeUpdate(old, node *v1.Node) {
 	log.Logger.Debug("On peer node update", "namename", node.Name)
 	pubKey := node.Annotations[r.annotations.watchAnnotationWGPublicKey]
-	peer := Peer{
-		allowedIPs: []string{node.Spec.PodCIDR},
-		endpoint:   node.Annotations[r.annotations.watchAnnotationWGEndpoint],
-	}
+	peer := r.peerFromNode(node)
 	// Check if peer needs to be updated
-	if oldPeer, ok := r.peers[pubKey]; ok {
-		if equalSlices(oldPeer.allowedIPs, peer.allowedIPs) && oldPeer.endpoint == peer.endpoint {
-			return
-		}
+	r.mu.RLock()
+	oldPeer, ok := r.peers[pubKey]
+	r.mu.RUnlock()
+	if ok && sameAdvertisedPeer(oldPeer, peer) {
+		return
+	}
+	// Colliding or skipped nodes are not peers, so only sync when they change
+	// what they advertise, rather than on every status update
+	if !ok && old != nil && sameAdvertisedPeer(r.peerFromNode(old), peer) {
+		return
 	}
 	r.enqueuePeersSync()
 }
 
+// sameAdvertisedPeer returns true if the peers have the same config.
+func sameAdvertisedPeer(a, b Peer) bool {
+	return a.publicKey == b.publicKey && equalSlices(a.allowedIPs, b.allowedIPs) && a.endpoint == b.endpoint && a.persistentKeepalive == b.persistentKeepalive && a.invalid == b.invalid
+}
+
 func (r *Runner) onPeerNodeDelete(node *v1.Node) {
 	log.Logger.Debug("On peer node delete", "namename", node.Name)
 	pubKey := node.Annotations[r.annotations.watchAnnotationWGPublicKey]
-	if _, ok := r.peers[pubKey]; !ok {
-		// if peer is not in the list we do not need to update anything
+	r.mu.RLock()
+	_, ok := r.peers[pubKey]
+	colliding := inCollision(r.collisions, node.Name)
+	r.mu.RUnlock()
+	if !ok && !colliding {
+		// if peer is not in the list we do not need to update anything,
+		// unless its removal resolves a collision
 		return
 	}
 	r.enqueuePeersSync()
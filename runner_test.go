@@ -0,0 +1,309 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/utilitywarehouse/semaphore-wireguard/firewall"
+	"github.com/utilitywarehouse/semaphore-wireguard/log"
+	"github.com/utilitywarehouse/semaphore-wireguard/wireguard"
+)
+
+func TestRunnerDegradedRecovery(t *testing.T) {
+	log.InitLogger("runner-test", "info")
+	recorder := record.NewFakeRecorder(10)
+	r := &Runner{
+		cluster:  "r1",
+		device:   wireguard.NewDevice("wireguard.r1", "", 0, 0, 0, wireguard.RouteConfig{}, "", wireguard.Namespaces{}),
+		recorder: recorder,
+		sync:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+	}
+	r.canSync.Store(true)
+	degraded := func() bool {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		return r.degraded
+	}
+
+	r.nodeWatcherErrorHandler("list", errors.New("remote API unreachable"))
+	assert.Equal(t, true, degraded())
+	assert.Equal(t, "Warning RemoteWatchFailed wireguard.r1: Failed to list remote nodes: remote API unreachable", <-recorder.Events)
+	assert.Equal(t, "Warning RemoteDegraded wireguard.r1: Remote API is unreachable, keeping current peers", <-recorder.Events)
+
+	// Peers are kept during the hold-down after the relist
+	r.nodeWatcherRecoveryHandler()
+	assert.Equal(t, true, degraded())
+
+	// Errors during the hold-down cancel the pending recovery
+	r.nodeWatcherErrorHandler("watch", errors.New("remote API unreachable"))
+	<-recorder.Events
+	r.recover(1)
+	assert.Equal(t, true, degraded())
+
+	r.recover(2)
+	assert.Equal(t, false, degraded())
+	assert.Equal(t, "Normal RemoteRecovered wireguard.r1: Remote API is reachable again", <-recorder.Events)
+	select {
+	case <-r.sync:
+	default:
+		t.Error("expected a peers sync after recovering")
+	}
+}
+
+func TestRunnerCollidingNodeEvents(t *testing.T) {
+	log.InitLogger("runner-test", "info")
+	r := &Runner{
+		cluster:     "r1",
+		annotations: constructRunnerAnnotations("local", "r1"),
+		peers:       map[string]Peer{},
+		collisions: []PeerCollision{
+			{Reason: collisionPublicKey, Value: "key-a", Nodes: []string{"node-a", "node-b"}},
+		},
+		sync: make(chan struct{}, 1),
+	}
+	node := func(name, endpoint, heartbeat string) *v1.Node {
+		return &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: name,
+				Annotations: map[string]string{
+					r.annotations.watchAnnotationWGPublicKey: "key-a",
+					r.annotations.watchAnnotationWGEndpoint:  endpoint,
+					"heartbeat":                              heartbeat,
+				},
+			},
+			Spec: v1.NodeSpec{PodCIDR: "10.2.0.0/24"},
+		}
+	}
+	synced := func() bool {
+		select {
+		case <-r.sync:
+			return true
+		default:
+			return false
+		}
+	}
+
+	// Status updates of colliding nodes do not trigger syncs
+	r.nodeEventHandler(watch.Modified, node("node-a", "10.0.0.1:51820", "1"), node("node-a", "10.0.0.1:51820", "2"))
+	assert.Equal(t, false, synced())
+	// Changes of what they advertise do
+	r.nodeEventHandler(watch.Modified, node("node-a", "10.0.0.1:51820", "2"), node("node-a", "10.0.0.2:51820", "2"))
+	assert.Equal(t, true, synced())
+	// Deleting a colliding node may resolve the collision
+	r.nodeEventHandler(watch.Deleted, node("node-b", "10.0.0.3:51820", "1"), nil)
+	assert.Equal(t, true, synced())
+	// Deleting an unknown node is a no-op
+	r.nodeEventHandler(watch.Deleted, node("node-c", "10.0.0.4:51820", "1"), nil)
+	assert.Equal(t, false, synced())
+}
+
+func TestRunnerValidPeers(t *testing.T) {
+	log.InitLogger("runner-test", "info")
+	recorder := record.NewFakeRecorder(10)
+	_, podSubnet, _ := net.ParseCIDR("10.2.0.0/16")
+	r := &Runner{
+		cluster:   "r1",
+		device:    wireguard.NewDevice("wireguard.r1", "", 0, 0, 0, wireguard.RouteConfig{}, "", wireguard.Namespaces{}),
+		recorder:  recorder,
+		resolver:  newEndpointResolver("wireguard.r1"),
+		podSubnet: podSubnet,
+	}
+	key := func() string {
+		k, err := wgtypes.GeneratePrivateKey()
+		assert.Equal(t, nil, err)
+		return k.PublicKey().String()
+	}
+	good := key()
+	badEndpoint := key()
+	outside := key()
+	peers := map[string]Peer{
+		good:        {nodeName: "node-a", publicKey: good, podCIDR: "10.2.0.0/24", allowedIPs: []string{"10.2.0.0/24"}, endpoint: "10.0.0.1:51820"},
+		"not-a-key": {nodeName: "node-b", publicKey: "not-a-key", podCIDR: "10.2.1.0/24", allowedIPs: []string{"10.2.1.0/24"}, endpoint: "10.0.0.2:51820"},
+		badEndpoint: {nodeName: "node-c", publicKey: badEndpoint, podCIDR: "10.2.2.0/24", allowedIPs: []string{"10.2.2.0/24"}, endpoint: "10.0.0.3"},
+		outside:     {nodeName: "node-d", publicKey: outside, podCIDR: "10.3.0.0/24", allowedIPs: []string{"10.3.0.0/24"}, endpoint: "10.0.0.4:51820"},
+	}
+
+	valid, peersConfig, invalidPeers := r.validPeers(peers)
+	// The remaining peer is still configured
+	assert.Equal(t, map[string]Peer{good: peers[good]}, valid)
+	assert.Equal(t, 1, len(peersConfig))
+	assert.Equal(t, good, peersConfig[0].PublicKey.String())
+	assert.Equal(t, "10.0.0.1:51820", peersConfig[0].Endpoint.String())
+	assert.Equal(t, 3, len(invalidPeers))
+	assert.Contains(t, invalidPeers["node-b"], "invalid peer config")
+	assert.Contains(t, invalidPeers["node-c"], `invalid endpoint "10.0.0.3"`)
+	assert.Equal(t, "pod CIDR 10.3.0.0/24 is not part of the pod subnet 10.2.0.0/16", invalidPeers["node-d"])
+
+	// Invalid peers are reported once per reason
+	r.reportInvalidPeers(invalidPeers)
+	assert.Equal(t, 3, len(recorder.Events))
+	assert.Equal(t, "Warning InvalidPeer wireguard.r1: Skipping remote node node-d: pod CIDR 10.3.0.0/24 is not part of the pod subnet 10.2.0.0/16", eventFor(recorder, "node-d"))
+	r.reportInvalidPeers(invalidPeers)
+	assert.Equal(t, 0, len(recorder.Events))
+	assert.Equal(t, invalidPeers, r.Status().InvalidPeers)
+}
+
+func TestPeerFromNodeKeepalive(t *testing.T) {
+	log.InitLogger("runner-test", "info")
+	_, podSubnet, _ := net.ParseCIDR("10.2.0.0/16")
+	r := &Runner{
+		cluster:     "r1",
+		annotations: constructRunnerAnnotations("local", "r1"),
+		keepalive:   25 * time.Second,
+		resolver:    newEndpointResolver("wireguard.r1"),
+		podSubnet:   podSubnet,
+	}
+	node := func(name, podCIDR string, keepalive *string) *v1.Node {
+		k, err := wgtypes.GeneratePrivateKey()
+		assert.Equal(t, nil, err)
+		n := &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: name,
+				Annotations: map[string]string{
+					r.annotations.watchAnnotationWGPublicKey: k.PublicKey().String(),
+					r.annotations.watchAnnotationWGEndpoint:  "10.0.0.1:51820",
+				},
+			},
+			Spec: v1.NodeSpec{PodCIDR: podCIDR},
+		}
+		if keepalive != nil {
+			n.Annotations[r.annotations.watchAnnotationWGKeepalive] = *keepalive
+		}
+		return n
+	}
+	override, disabled, unparsable, negative := "10s", "0s", "foo", "-1s"
+
+	// The remote default applies without the annotation
+	assert.Equal(t, 25*time.Second, r.peerFromNode(node("node-a", "10.2.0.0/24", nil)).persistentKeepalive)
+	// The annotation overrides it
+	assert.Equal(t, 10*time.Second, r.peerFromNode(node("node-a", "10.2.0.0/24", &override)).persistentKeepalive)
+
+	peers := map[string]Peer{}
+	for _, n := range []*v1.Node{
+		node("node-b", "10.2.1.0/24", &disabled),
+		node("node-c", "10.2.2.0/24", &unparsable),
+		node("node-d", "10.2.3.0/24", &negative),
+	} {
+		p := r.peerFromNode(n)
+		peers[p.publicKey] = p
+	}
+	valid, peersConfig, invalidPeers := r.validPeers(peers)
+	// 0s disables the keepalive of the peer
+	assert.Equal(t, 1, len(valid))
+	assert.Equal(t, 1, len(peersConfig))
+	assert.Equal(t, time.Duration(0), *peersConfig[0].PersistentKeepaliveInterval)
+	// Invalid values are reported rather than ignored
+	assert.Equal(t, map[string]string{
+		"node-c": `invalid persistent keepalive "foo"`,
+		"node-d": `invalid persistent keepalive "-1s"`,
+	}, invalidPeers)
+}
+
+// eventFor drains the recorded events and returns the one about the node.
+func eventFor(recorder *record.FakeRecorder, node string) string {
+	var event string
+	for len(recorder.Events) > 0 {
+		e := <-recorder.Events
+		if strings.Contains(e, "remote node "+node+":") {
+			event = e
+		}
+	}
+	return event
+}
+
+type fakeFirewall struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (f *fakeFirewall) Apply(firewall.Rules) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, "apply")
+	return nil
+}
+
+func (f *fakeFirewall) Cleanup() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, "cleanup")
+	return nil
+}
+
+func TestRunnerStopWaitsForLoops(t *testing.T) {
+	log.InitLogger("runner-test", "info")
+	fw := &fakeFirewall{}
+	r := &Runner{
+		cluster:  "r1",
+		device:   wireguard.NewDevice("wireguard.r1", "", 0, 0, 0, wireguard.RouteConfig{}, "", wireguard.Namespaces{}),
+		firewall: fw,
+		stop:     make(chan struct{}),
+	}
+	r.nodeWatcher = r.newNodeWatcher(fake.NewSimpleClientset())
+	// A peers sync that is still applying rules when the runner stops
+	r.loops.Go(func() {
+		<-r.stop
+		time.Sleep(10 * time.Millisecond)
+		fw.Apply(firewall.Rules{})
+	})
+	r.Stop()
+	assert.Equal(t, []string{"apply", "cleanup"}, fw.calls)
+}
+
+func TestRunnerStopWaitsForStart(t *testing.T) {
+	log.InitLogger("runner-test", "info")
+	fw := &fakeFirewall{}
+	r := &Runner{
+		cluster:  "r1",
+		device:   wireguard.NewDevice("wireguard.r1", "", 0, 0, 0, wireguard.RouteConfig{}, "", wireguard.Namespaces{}),
+		firewall: fw,
+		stop:     make(chan struct{}),
+	}
+	r.nodeWatcher = r.newNodeWatcher(fake.NewSimpleClientset())
+	// A runner removed before its start goroutine is scheduled never runs
+	r.Stop()
+	r.Start(nil)
+	r.loops.Wait()
+	assert.Equal(t, false, r.Initialised())
+	assert.Equal(t, []string{"cleanup"}, fw.calls)
+}
+
+func TestRunnerSkipsSyncsUntilWatcherSyncs(t *testing.T) {
+	log.InitLogger("runner-test", "info")
+	recorder := record.NewFakeRecorder(10)
+	r := &Runner{
+		cluster:  "r1",
+		device:   wireguard.NewDevice("wireguard.r1", "", 0, 0, 0, wireguard.RouteConfig{}, "", wireguard.Namespaces{}),
+		recorder: recorder,
+		sync:     make(chan struct{}),
+		stop:     make(chan struct{}),
+	}
+	r.canSync.Store(true)
+	// The watcher is never run, as after a replacement that does not sync
+	r.nodeWatcher = r.newNodeWatcher(fake.NewSimpleClientset())
+	r.loops.Go(r.syncLoop)
+	r.sync <- struct{}{}
+	// The skipped sync is not requeued, so the loop is free again
+	select {
+	case r.sync <- struct{}{}:
+	case <-time.After(time.Second):
+		t.Fatal("sync loop did not receive the second sync")
+	}
+	close(r.stop)
+	r.loops.Wait()
+	assert.Equal(t, nil, r.syncErr)
+	assert.Equal(t, 0, len(recorder.Events))
+}
@@ -0,0 +1,128 @@
+package main
+
+//go:generate sh -c "go run . -print-config-schema > config.schema.json"
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+
+	"github.com/utilitywarehouse/semaphore-wireguard/firewall"
+	"github.com/utilitywarehouse/semaphore-wireguard/kube"
+)
+
+const configSchemaID = "https://github.com/utilitywarehouse/semaphore-wireguard/config.schema.json"
+
+var durationType = reflect.TypeOf(Duration{})
+
+// configSchemaRequired lists the mandatory properties of the config objects,
+// by their type.
+var configSchemaRequired = map[reflect.Type][]string{
+	reflect.TypeOf(Config{}):              {"local"},
+	reflect.TypeOf(localClusterConfig{}):  {"name"},
+	reflect.TypeOf(remoteClusterConfig{}): {"name"},
+	reflect.TypeOf(secretReference{}):     {"namespace", "name"},
+	reflect.TypeOf(execConfig{}):          {"command"},
+	reflect.TypeOf(execEnvVar{}):          {"name", "value"},
+}
+
+// configSchemaOverrides replaces the schema derived from the field types for
+// properties that accept a restricted set of values, by their json path.
+var configSchemaOverrides = map[string]map[string]interface{}{
+	"local.firewallBackend": {
+		"type": "string",
+		"enum": []string{firewall.BackendAuto, firewall.BackendNftables, firewall.BackendIptables},
+	},
+	"remotes.podSubnetDiscovery": {
+		"type": "string",
+		"enum": []string{kube.PodSubnetDiscoveryCalico, kube.PodSubnetDiscoveryKubeadm, kube.PodSubnetDiscoveryNodes},
+	},
+	"remotes.wgListenPort": {
+		"type":    "integer",
+		"minimum": 0,
+		"maximum": 65535,
+	},
+	"remotes.wgDeviceMTU": {
+		"oneOf": []map[string]interface{}{
+			{"type": "integer", "minimum": 0},
+			{"const": wgDeviceMTUAuto},
+		},
+	},
+}
+
+// configSchema returns a JSON Schema for the Config type, derived from the
+// types and json tags of its fields.
+func configSchema() ([]byte, error) {
+	schema := schemaForType(reflect.TypeOf(Config{}), "")
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["$id"] = configSchemaID
+	schema["title"] = "semaphore-wireguard config"
+	// Remotes are only optional when they are read from RemoteCluster
+	// resources
+	schema["anyOf"] = []map[string]interface{}{
+		{
+			"required":   []string{"remotes"},
+			"properties": map[string]interface{}{"remotes": map[string]interface{}{"minItems": 1}},
+		},
+		{
+			"required": []string{"local"},
+			"properties": map[string]interface{}{"local": map[string]interface{}{
+				"required":   []string{"remoteClusterResources"},
+				"properties": map[string]interface{}{"remoteClusterResources": map[string]interface{}{"const": true}},
+			}},
+		},
+	}
+	out, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(out, '\n'), nil
+}
+
+func schemaForType(t reflect.Type, path string) map[string]interface{} {
+	if override, ok := configSchemaOverrides[path]; ok {
+		return override
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == durationType {
+		return map[string]interface{}{
+			"type":        []string{"string", "number"},
+			"description": "Duration string, e.g. 10s, or nanoseconds",
+		}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Slice:
+		return map[string]interface{}{
+			"type":  "array",
+			"items": schemaForType(t.Elem(), path),
+		}
+	case reflect.Struct:
+		properties := map[string]interface{}{}
+		for i := 0; i < t.NumField(); i++ {
+			name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+			if name == "" || name == "-" {
+				continue
+			}
+			properties[name] = schemaForType(t.Field(i).Type, strings.TrimPrefix(path+"."+name, "."))
+		}
+		schema := map[string]interface{}{
+			"type":                 "object",
+			"properties":           properties,
+			"additionalProperties": false,
+		}
+		if required, ok := configSchemaRequired[t]; ok {
+			schema["required"] = required
+		}
+		return schema
+	default:
+		return map[string]interface{}{}
+	}
+}
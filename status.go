@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/utilitywarehouse/semaphore-wireguard/log"
+	"github.com/utilitywarehouse/semaphore-wireguard/wireguard"
+)
+
+// Peer states reported by the status command.
+const (
+	peerStateDesired    = "desired"    // Expected by the runner and configured on the device
+	peerStateMissing    = "missing"    // Expected by the runner but not configured on the device
+	peerStateUnexpected = "unexpected" // Configured on the device but not expected by the runner
+)
+
+// statusRow is a line of the status command output.
+type statusRow struct {
+	node          string
+	publicKey     string
+	endpoint      string
+	allowedIPs    string
+	lastHandshake string
+	transfer      string
+	state         string
+}
+
+// runStatus implements the status command, which combines the runners' peers
+// reported by the debug API of the running daemon with the state of the local
+// wg devices. It returns the process exit code.
+func runStatus(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("status", flag.ContinueOnError)
+	fs.SetOutput(out)
+	address := fs.String("address", "http://localhost:7773", "Address of the running semaphore-wireguard health and metrics server")
+	netns := fs.String("wg-device-netns", getEnv("SWG_WG_DEVICE_NETNS", ""), "Path to the network namespace the wg devices run in")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	log.InitLogger("semaphore-wireguard", "error")
+
+	statuses, err := fetchRunnerStatuses(*address)
+	if err != nil {
+		fmt.Fprintf(out, "Cannot get peers from %s: %v\n", *address, err)
+		return 1
+	}
+	wg, err := wireguard.NewClient(*netns)
+	if err != nil {
+		fmt.Fprintf(out, "Cannot open wg client, device state is not available: %v\n", err)
+	} else {
+		defer wg.Close()
+	}
+	for _, s := range statuses {
+		fmt.Fprintf(out, "Remote %s, device %s, public key %s, listen port %d\n", s.Cluster, s.Device, s.PublicKey, s.ListenPort)
+		var device *wgtypes.Device
+		if wg != nil {
+			device, err = wg.Device(s.Device)
+			if err != nil {
+				fmt.Fprintf(out, "Cannot get device %s: %v\n", s.Device, err)
+			}
+		}
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NODE\tPUBLIC KEY\tENDPOINT\tALLOWED IPS\tLAST HANDSHAKE\tTRANSFER\tSTATE")
+		for _, row := range statusRows(s, device, time.Now()) {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", row.node, row.publicKey, row.endpoint, row.allowedIPs, row.lastHandshake, row.transfer, row.state)
+		}
+		w.Flush()
+		var invalid []string
+		for node := range s.InvalidPeers {
+			invalid = append(invalid, node)
+		}
+		sort.Strings(invalid)
+		for _, node := range invalid {
+			fmt.Fprintf(out, "Invalid peer %s: %s\n", node, s.InvalidPeers[node])
+		}
+		for _, c := range s.Collisions {
+			fmt.Fprintf(out, "Collision: %s\n", c)
+		}
+		fmt.Fprintln(out)
+	}
+	return 0
+}
+
+func fetchRunnerStatuses(address string) ([]RunnerStatus, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(strings.TrimSuffix(address, "/") + "/debug/peers")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	var statuses []RunnerStatus
+	if err := json.NewDecoder(resp.Body).Decode(&statuses); err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+// statusRows merges the peers expected by a runner with the peers configured
+// on its device, which may be nil if the device state is not available.
+func statusRows(status RunnerStatus, device *wgtypes.Device, now time.Time) []statusRow {
+	devicePeers := map[string]wgtypes.Peer{}
+	if device != nil {
+		for _, p := range device.Peers {
+			devicePeers[p.PublicKey.String()] = p
+		}
+	}
+	var rows []statusRow
+	for _, p := range status.Peers {
+		row := statusRow{
+			node:          p.Node,
+			publicKey:     p.PublicKey,
+			endpoint:      p.Endpoint,
+			allowedIPs:    strings.Join(p.AllowedIPs, ","),
+			lastHandshake: "-",
+			transfer:      "-",
+			state:         "-",
+		}
+		if device != nil {
+			row.state = peerStateMissing
+		}
+		if dp, ok := devicePeers[p.PublicKey]; ok {
+			row.lastHandshake = handshakeAge(dp.LastHandshakeTime, now)
+			row.transfer = transfer(dp)
+			row.state = peerStateDesired
+			delete(devicePeers, p.PublicKey)
+		}
+		rows = append(rows, row)
+	}
+	var unexpected []statusRow
+	for key, dp := range devicePeers {
+		var ips []string
+		for _, ip := range dp.AllowedIPs {
+			ips = append(ips, ip.String())
+		}
+		endpoint := ""
+		if dp.Endpoint != nil {
+			endpoint = dp.Endpoint.String()
+		}
+		unexpected = append(unexpected, statusRow{
+			node:          "-",
+			publicKey:     key,
+			endpoint:      endpoint,
+			allowedIPs:    strings.Join(ips, ","),
+			lastHandshake: handshakeAge(dp.LastHandshakeTime, now),
+			transfer:      transfer(dp),
+			state:         peerStateUnexpected,
+		})
+	}
+	sort.Slice(unexpected, func(i, j int) bool {
+		return unexpected[i].publicKey < unexpected[j].publicKey
+	})
+	return append(rows, unexpected...)
+}
+
+func handshakeAge(t, now time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return now.Sub(t).Round(time.Second).String() + " ago"
+}
+
+func transfer(p wgtypes.Peer) string {
+	return fmt.Sprintf("rx %s, tx %s", formatBytes(p.ReceiveBytes), formatBytes(p.TransmitBytes))
+}
+
+// formatBytes returns a human readable size using binary prefixes.
+func formatBytes(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
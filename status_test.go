@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestStatusRows(t *testing.T) {
+	keyA, _ := wgtypes.GeneratePrivateKey()
+	keyB, _ := wgtypes.GeneratePrivateKey()
+	keyC, _ := wgtypes.GeneratePrivateKey()
+	now := time.Now()
+	status := RunnerStatus{
+		Peers: []PeerStatus{
+			{Node: "node-a", PublicKey: keyA.PublicKey().String(), Endpoint: "10.0.0.1:51820", AllowedIPs: []string{"10.4.0.0/24"}},
+			{Node: "node-b", PublicKey: keyB.PublicKey().String(), Endpoint: "10.0.0.2:51820", AllowedIPs: []string{"10.4.1.0/24"}},
+		},
+	}
+	_, allowed, _ := net.ParseCIDR("10.4.2.0/24")
+	device := &wgtypes.Device{
+		Peers: []wgtypes.Peer{
+			{
+				PublicKey:         keyA.PublicKey(),
+				LastHandshakeTime: now.Add(-90 * time.Second),
+				ReceiveBytes:      2048,
+				TransmitBytes:     100,
+			},
+			{
+				PublicKey:  keyC.PublicKey(),
+				Endpoint:   &net.UDPAddr{IP: net.ParseIP("10.0.0.3"), Port: 51820},
+				AllowedIPs: []net.IPNet{*allowed},
+			},
+		},
+	}
+	rows := statusRows(status, device, now)
+	assert.Equal(t, []statusRow{
+		{node: "node-a", publicKey: keyA.PublicKey().String(), endpoint: "10.0.0.1:51820", allowedIPs: "10.4.0.0/24", lastHandshake: "1m30s ago", transfer: "rx 2.0 KiB, tx 100 B", state: peerStateDesired},
+		{node: "node-b", publicKey: keyB.PublicKey().String(), endpoint: "10.0.0.2:51820", allowedIPs: "10.4.1.0/24", lastHandshake: "-", transfer: "-", state: peerStateMissing},
+		{node: "-", publicKey: keyC.PublicKey().String(), endpoint: "10.0.0.3:51820", allowedIPs: "10.4.2.0/24", lastHandshake: "never", transfer: "rx 0 B, tx 0 B", state: peerStateUnexpected},
+	}, rows)
+
+	rows = statusRows(status, nil, now)
+	assert.Equal(t, "-", rows[0].state)
+	assert.Equal(t, 2, len(rows))
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"math/big"
+	"net"
 	"strings"
 )
 
@@ -25,3 +27,58 @@ func verifyInterfaceName(name string) error {
 	}
 	return nil
 }
+
+// tunnelAddressFromPodCIDR deterministically picks an address from the tunnel
+// range for a node based on its pod CIDR. The index of the node's pod CIDR
+// block within the cluster's pod subnet is used as the offset within the
+// range, skipping the network and broadcast addresses, so that addresses are
+// unique. Returns an error if the range is too small to hold the index.
+func tunnelAddressFromPodCIDR(podCIDR, podSubnet, tunnelRange *net.IPNet) (net.IP, error) {
+	if (podCIDR.IP.To4() == nil) != (tunnelRange.IP.To4() == nil) {
+		return nil, fmt.Errorf("Pod CIDR %s and tunnel range %s are not of the same address family", podCIDR, tunnelRange)
+	}
+	if !subnetContains(podSubnet, podCIDR) {
+		return nil, fmt.Errorf("Pod CIDR %s is not part of the pod subnet %s", podCIDR, podSubnet)
+	}
+	podIP, subnetIP, rangeIP := podCIDR.IP.To4(), podSubnet.IP.To4(), tunnelRange.IP.To4()
+	if podIP == nil {
+		podIP, subnetIP, rangeIP = podCIDR.IP.To16(), podSubnet.IP.To16(), tunnelRange.IP.To16()
+	}
+	podOnes, podBits := podCIDR.Mask.Size()
+	rangeOnes, rangeBits := tunnelRange.Mask.Size()
+	index := new(big.Int).Sub(new(big.Int).SetBytes(podIP), new(big.Int).SetBytes(subnetIP.Mask(podSubnet.Mask)))
+	index.Rsh(index, uint(podBits-podOnes))
+	// The first and last addresses of the range are not assigned
+	usable := new(big.Int).Lsh(big.NewInt(1), uint(rangeBits-rangeOnes))
+	usable.Sub(usable, big.NewInt(2))
+	if index.Cmp(usable) >= 0 {
+		return nil, fmt.Errorf("Tunnel range %s is too small for pod CIDR %s, block %s of pod subnet %s", tunnelRange, podCIDR, index, podSubnet)
+	}
+	offset := new(big.Int).Add(index, big.NewInt(1))
+	ip := new(big.Int).Add(new(big.Int).SetBytes(rangeIP.Mask(tunnelRange.Mask)), offset).Bytes()
+	// Left pad the result to the address length
+	addr := make(net.IP, len(rangeIP))
+	copy(addr[len(addr)-len(ip):], ip)
+	return addr, nil
+}
+
+// hostIPNet returns a single address network for the passed ip.
+func hostIPNet(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// subnetsOverlap returns true if the passed networks share any addresses.
+func subnetsOverlap(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// subnetContains returns true if the inner network is fully contained in the
+// outer one.
+func subnetContains(outer, inner *net.IPNet) bool {
+	outerOnes, outerBits := outer.Mask.Size()
+	innerOnes, innerBits := inner.Mask.Size()
+	return outerBits == innerBits && outerOnes <= innerOnes && outer.Contains(inner.IP)
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"fmt"
+	"net"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -20,3 +22,52 @@ func TestVerifyInterfaceName(t *testing.T) {
 	err = verifyInterfaceName("wireguard.test")
 	assert.Equal(t, nil, err)
 }
+
+func TestTunnelAddressFromPodCIDR(t *testing.T) {
+	_, tunnelRange, _ := net.ParseCIDR("100.64.0.0/24")
+	_, podSubnet, _ := net.ParseCIDR("10.2.0.0/16")
+	_, podCIDR, _ := net.ParseCIDR("10.2.0.0/24")
+	// The network address is skipped
+	addr, err := tunnelAddressFromPodCIDR(podCIDR, podSubnet, tunnelRange)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "100.64.0.1", addr.String())
+	_, podCIDR, _ = net.ParseCIDR("10.2.5.0/24")
+	addr, err = tunnelAddressFromPodCIDR(podCIDR, podSubnet, tunnelRange)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "100.64.0.6", addr.String())
+	// The broadcast address is skipped
+	_, podCIDR, _ = net.ParseCIDR("10.2.253.0/24")
+	addr, err = tunnelAddressFromPodCIDR(podCIDR, podSubnet, tunnelRange)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "100.64.0.254", addr.String())
+	_, podCIDR, _ = net.ParseCIDR("10.2.254.0/24")
+	_, err = tunnelAddressFromPodCIDR(podCIDR, podSubnet, tunnelRange)
+	assert.Equal(t, fmt.Errorf("Tunnel range 100.64.0.0/24 is too small for pod CIDR 10.2.254.0/24, block 254 of pod subnet 10.2.0.0/16"), err)
+	_, podCIDR, _ = net.ParseCIDR("10.3.0.0/24")
+	_, err = tunnelAddressFromPodCIDR(podCIDR, podSubnet, tunnelRange)
+	assert.Equal(t, fmt.Errorf("Pod CIDR 10.3.0.0/24 is not part of the pod subnet 10.2.0.0/16"), err)
+
+	_, tunnelRange, _ = net.ParseCIDR("fd00:64::/112")
+	_, podSubnet, _ = net.ParseCIDR("fd00:10:2::/48")
+	_, podCIDR, _ = net.ParseCIDR("fd00:10:2:7::/64")
+	addr, err = tunnelAddressFromPodCIDR(podCIDR, podSubnet, tunnelRange)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "fd00:64::8", addr.String())
+	_, err = tunnelAddressFromPodCIDR(podCIDR, podSubnet, &net.IPNet{IP: net.ParseIP("100.64.0.0").To4(), Mask: net.CIDRMask(24, 32)})
+	assert.NotEqual(t, nil, err)
+}
+
+func TestSubnetContains(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.4.0.0/16")
+	_, inside, _ := net.ParseCIDR("10.4.5.0/24")
+	_, outside, _ := net.ParseCIDR("10.5.5.0/24")
+	_, wider, _ := net.ParseCIDR("10.0.0.0/8")
+	_, v6, _ := net.ParseCIDR("fd00::/64")
+	assert.Equal(t, true, subnetContains(subnet, inside))
+	assert.Equal(t, true, subnetContains(subnet, subnet))
+	assert.Equal(t, false, subnetContains(subnet, outside))
+	assert.Equal(t, false, subnetContains(subnet, wider))
+	assert.Equal(t, false, subnetContains(subnet, v6))
+	assert.Equal(t, true, subnetsOverlap(subnet, wider))
+	assert.Equal(t, false, subnetsOverlap(subnet, outside))
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/utilitywarehouse/semaphore-wireguard/kube"
+	"github.com/utilitywarehouse/semaphore-wireguard/log"
+)
+
+// validateReport collects the results of the validate command checks and
+// prints them as a table.
+type validateReport struct {
+	w      *tabwriter.Writer
+	failed bool
+}
+
+func (vr *validateReport) add(scope, check string, err error, detail string) {
+	result := "OK"
+	if err != nil {
+		result = "FAIL"
+		detail = err.Error()
+		vr.failed = true
+	}
+	fmt.Fprintf(vr.w, "%s\t%s\t%s\t%s\n", scope, check, result, detail)
+}
+
+// runValidate implements the validate command, which checks the clusters'
+// config and the files it refers to without touching the host. With -online,
+// it also checks that the remote API servers and CA URLs are reachable. It
+// returns the process exit code.
+func runValidate(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	fs.SetOutput(out)
+	configPath := fs.String("clusters-config", getEnv("SWG_CLUSTERS_CONFIG", ""), "Path to the clusters' json or yaml config file")
+	online := fs.Bool("online", false, "Check connectivity to the remote API servers and CA URLs")
+	timeout := fs.Duration("timeout", 10*time.Second, "Timeout for each online check")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	log.InitLogger("semaphore-wireguard", "error")
+	if *configPath == "" {
+		fmt.Fprintln(out, "Must specify a clusters config file location")
+		fs.Usage()
+		return 2
+	}
+
+	report := &validateReport{w: tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)}
+	fmt.Fprintln(report.w, "SCOPE\tCHECK\tRESULT\tDETAILS")
+	defer report.w.Flush()
+
+	fileContent, err := os.ReadFile(*configPath)
+	if err != nil {
+		report.add("config", "read", err, "")
+		return 1
+	}
+	config, err := parseConfig(fileContent)
+	if err != nil {
+		report.add("config", "parse", err, "")
+		return 1
+	}
+	report.add("config", "parse", nil, fmt.Sprintf("%d remote(s)", len(config.Remotes)))
+	var homeClient kubernetes.Interface
+	if config.Local.KubeConfigPath != "" {
+		c, err := kube.ClientFromConfig(config.Local.KubeConfigPath)
+		report.add("local", "kubeconfig", err, config.Local.KubeConfigPath)
+		if err == nil {
+			homeClient = c
+		}
+	} else if *online {
+		// Fall back to the in-cluster config like the daemon. Outside
+		// of a pod, this fails when reading credentials secrets.
+		if c, err := kube.ClientFromConfig(""); err == nil {
+			homeClient = c
+		}
+	}
+
+	for _, r := range config.Remotes {
+		scope := "remote/" + r.Name
+		report.add(scope, "interface", nil, fmt.Sprintf(wgDeviceNamePattern, r.Name))
+		report.add(scope, "listenPort", nil, fmt.Sprintf("%d", r.WGListenPort))
+		if r.PodSubnet != "" {
+			report.add(scope, "podSubnet", nil, r.PodSubnet)
+		} else {
+			report.add(scope, "podSubnet", nil, "discovered via "+r.PodSubnetDiscovery)
+		}
+		// Reading the credentials secret requires the local API server
+		if r.CredentialsSecret != nil && !*online {
+			report.add(scope, "credentialsSecret", nil, r.CredentialsSecret.Namespace+"/"+r.CredentialsSecret.Name)
+			continue
+		}
+		// The URLs were checked when parsing the config
+		failover, _ := newEndpointFailover(r)
+		client, _, err := makeRemoteClient(homeClient, r, failover)
+		switch {
+		case r.KubeConfigPath != "":
+			report.add(scope, "kubeconfig", err, r.KubeConfigPath)
+		case r.CredentialsSecret != nil:
+			report.add(scope, "credentialsSecret", err, r.CredentialsSecret.Namespace+"/"+r.CredentialsSecret.Name)
+		case r.ClientCertPath != "":
+			report.add(scope, "clientCert", err, r.ClientCertPath)
+		case r.Exec != nil:
+			report.add(scope, "exec", err, r.Exec.Command)
+		default:
+			report.add(scope, "token", err, r.RemoteSATokenPath)
+		}
+		if !*online {
+			continue
+		}
+		if r.KubeConfigPath == "" && r.RemoteCAURL != "" {
+			err := withTimeout(*timeout, func() error {
+				_, err := kube.FetchCA(r.RemoteCAURL)
+				return err
+			})
+			report.add(scope, "caURL", err, r.RemoteCAURL)
+		}
+		if client == nil {
+			report.add(scope, "apiServer", fmt.Errorf("no client"), "")
+			continue
+		}
+		if failover != nil {
+			// Check every endpoint, not only the active one
+			for i, endpoint := range failover.Endpoints() {
+				ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+				err := failover.Probe(ctx, client.Discovery().RESTClient(), i)
+				cancel()
+				report.add(scope, "apiServer", err, endpoint)
+			}
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		_, err = client.Discovery().RESTClient().Get().AbsPath("/version").DoRaw(ctx)
+		cancel()
+		report.add(scope, "apiServer", err, client.Discovery().RESTClient().Get().URL().Host)
+	}
+	if report.failed {
+		return 1
+	}
+	return 0
+}
+
+// withTimeout runs fn and returns its error, or a timeout error if it does not
+// return in time.
+func withTimeout(timeout time.Duration, fn func() error) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- fn()
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out after %v", timeout)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunValidate(t *testing.T) {
+	dir := t.TempDir()
+	tokenPath := filepath.Join(dir, "token")
+	assert.Equal(t, nil, os.WriteFile(tokenPath, []byte("token\n"), 0600))
+	configPath := filepath.Join(dir, "config.yaml")
+	config := `
+local:
+  name: c1
+remotes:
+  - name: c2
+    remoteAPIURL: https://lb.c2.example.com
+    remoteCAURL: https://ca.c2.example.com
+    remoteSATokenPath: %s
+    podSubnet: 10.4.0.0/16
+`
+	assert.Equal(t, nil, os.WriteFile(configPath, []byte(fmt.Sprintf(config, tokenPath)), 0600))
+	var out bytes.Buffer
+	assert.Equal(t, 0, runValidate([]string{"-clusters-config", configPath}, &out))
+	assert.Contains(t, out.String(), "remote/c2  token       OK")
+
+	assert.Equal(t, nil, os.WriteFile(configPath, []byte(fmt.Sprintf(config, filepath.Join(dir, "missing"))), 0600))
+	out.Reset()
+	assert.Equal(t, 1, runValidate([]string{"-clusters-config", configPath}, &out))
+	assert.Contains(t, out.String(), "remote/c2  token       FAIL")
+
+	assert.Equal(t, nil, os.WriteFile(configPath, []byte("local: {}"), 0600))
+	out.Reset()
+	assert.Equal(t, 1, runValidate([]string{"-clusters-config", configPath}, &out))
+	assert.Contains(t, out.String(), "Configuration is missing local cluster name")
+}
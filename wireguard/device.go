@@ -2,30 +2,49 @@ package wireguard
 
 import (
 	"errors"
+	"fmt"
 	"net"
 	"os"
 	"path/filepath"
 
 	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
 	"golang.zx2c4.com/wireguard/device"
-	"golang.zx2c4.com/wireguard/wgctrl"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 
 	"github.com/utilitywarehouse/semaphore-wireguard/log"
 )
 
+// RouteConfig holds the policy routing options for the routes added via the
+// device. Zero values leave the kernel defaults in place: routes go to the
+// main table, with no metric or preferred source, and no rule is added.
+type RouteConfig struct {
+	Table        int
+	Metric       int
+	Src          net.IP
+	RulePriority int
+}
+
 // Device is the struct to hold the link device and the wireguard attributes we
 // need.
 type Device struct {
-	deviceName  string
-	link        netlink.Link
-	keyFilename string
-	listenPort  int
-	pubKey      string
+	deviceName     string
+	link           netlink.Link
+	keyFilename    string
+	listenPort     int
+	fwMark         int
+	routes         RouteConfig
+	implementation string
+	namespaces     Namespaces
+	userspace      *userspaceDevice // Set when running an embedded wireguard-go device
+	pubKey         string
+	created        bool // Set when the last Run created the device
+	keyGenerated   bool // Set when Configure generated a new private key
 }
 
 // NewDevice returns a new device struct.
-func NewDevice(name string, keyFilename string, mtu, listenPort int) *Device {
+func NewDevice(name string, keyFilename string, mtu, listenPort, fwMark int, routes RouteConfig, implementation string, namespaces Namespaces) *Device {
 	if mtu == 0 {
 		mtu = device.DefaultMTU
 	}
@@ -36,8 +55,12 @@ func NewDevice(name string, keyFilename string, mtu, listenPort int) *Device {
 			Name:   name,
 			TxQLen: 1000,
 		}},
-		keyFilename: keyFilename,
-		listenPort:  listenPort,
+		keyFilename:    keyFilename,
+		listenPort:     listenPort,
+		fwMark:         fwMark,
+		routes:         routes,
+		implementation: implementation,
+		namespaces:     namespaces,
 	}
 }
 
@@ -56,18 +79,72 @@ func (d *Device) ListenPort() int {
 	return d.listenPort
 }
 
+// MTU returns the device's configured MTU
+func (d *Device) MTU() int {
+	return d.link.Attrs().MTU
+}
+
+// Created returns true if the last call to Run created the device, rather than
+// finding an existing one.
+func (d *Device) Created() bool {
+	return d.created
+}
+
+// KeyGenerated returns true if Configure generated a new private key, because
+// none was found at the key path.
+func (d *Device) KeyGenerated() bool {
+	return d.keyGenerated
+}
+
+// SetMTU updates the MTU of the device.
+func (d *Device) SetMTU(mtu int) error {
+	h, err := handleAt(d.namespaces.Device)
+	if err != nil {
+		return err
+	}
+	defer h.Delete()
+	link, err := h.LinkByName(d.deviceName)
+	if err != nil {
+		return err
+	}
+	if err := h.LinkSetMTU(link, mtu); err != nil {
+		return err
+	}
+	d.link.Attrs().MTU = mtu
+	return nil
+}
+
 // Run creates the wireguard device or sets mtu and txqlen if the device exists.
+// Depending on the implementation, the device is created using the kernel
+// module, or an embedded wireguard-go device, or the kernel module with a
+// fallback to wireguard-go if the kernel does not support wireguard.
 func (d *Device) Run() error {
-	h := netlink.Handle{}
+	h, err := handleAt(d.namespaces.Device)
+	if err != nil {
+		return err
+	}
 	defer h.Delete()
+	d.created = false
 	l, err := h.LinkByName(d.deviceName)
 	if err != nil {
+		d.created = true
 		log.Logger.Info(
 			"Could not get wg device by name, will try creating",
 			"name", d.deviceName,
+			"implementation", d.implementation,
 			"err", err,
 		)
-		if err := h.LinkAdd(d.link); err != nil {
+		if d.implementation == ImplementationUserspace {
+			return d.runUserspace()
+		}
+		if err := d.addLink(); err != nil {
+			if fallbackToUserspace(d.implementation, err) {
+				log.Logger.Warn(
+					"Kernel does not support wireguard, falling back to userspace",
+					"name", d.deviceName,
+				)
+				return d.runUserspace()
+			}
 			return err
 		}
 	} else {
@@ -81,9 +158,110 @@ func (d *Device) Run() error {
 	return nil
 }
 
+// addLink creates the kernel device in the socket namespace and moves it to
+// the device namespace, if they differ.
+func (d *Device) addLink() error {
+	h, err := handleAt(d.namespaces.Socket)
+	if err != nil {
+		return err
+	}
+	defer h.Delete()
+	if err := h.LinkAdd(d.link); err != nil {
+		return err
+	}
+	if d.namespaces.Device == d.namespaces.Socket {
+		return nil
+	}
+	link, err := h.LinkByName(d.deviceName)
+	if err != nil {
+		return err
+	}
+	var ns netns.NsHandle
+	if d.namespaces.Device == "" {
+		ns, err = netns.Get()
+	} else {
+		ns, err = netns.GetFromPath(d.namespaces.Device)
+	}
+	if err != nil {
+		return fmt.Errorf("Cannot get device network namespace: %v", err)
+	}
+	defer ns.Close()
+	log.Logger.Info(
+		"Moving wg device to network namespace",
+		"name", d.deviceName,
+		"netns", d.namespaces.Device,
+	)
+	return h.LinkSetNsFd(link, int(ns))
+}
+
+// fallbackToUserspace returns true if a failure to create the kernel device
+// should be retried with a userspace device.
+func fallbackToUserspace(implementation string, err error) bool {
+	return implementation == ImplementationAuto && errors.Is(err, unix.EOPNOTSUPP)
+}
+
+// checkUserspace returns an error if a userspace device cannot run in the
+// namespaces, since wireguard-go opens its tun device and socket in the
+// namespace of the process.
+func checkUserspace(namespaces Namespaces) error {
+	if namespaces.Device != "" || namespaces.Socket != "" {
+		return fmt.Errorf("Network namespaces are not supported for userspace devices")
+	}
+	return nil
+}
+
+func (d *Device) runUserspace() error {
+	if err := checkUserspace(d.namespaces); err != nil {
+		return err
+	}
+	u, err := startUserspaceDevice(d.deviceName, d.link.Attrs().MTU)
+	if err != nil {
+		return err
+	}
+	d.userspace = u
+	h, err := handleAt(d.namespaces.Device)
+	if err != nil {
+		return err
+	}
+	defer h.Delete()
+	l, err := h.LinkByName(d.deviceName)
+	if err != nil {
+		return err
+	}
+	return h.LinkSetTxQLen(l, d.link.Attrs().TxQLen)
+}
+
+// Close stops the embedded wireguard-go device, if one is running. Kernel
+// devices are left in place.
+func (d *Device) Close() error {
+	if d.userspace == nil {
+		return nil
+	}
+	return d.userspace.Close()
+}
+
+// Delete removes the kernel device, if present, along with the routes via it.
+// Userspace devices are removed by Close.
+func (d *Device) Delete() error {
+	h, err := handleAt(d.namespaces.Device)
+	if err != nil {
+		return err
+	}
+	defer h.Delete()
+	l, err := h.LinkByName(d.deviceName)
+	if err != nil {
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			return nil
+		}
+		return err
+	}
+	return h.LinkDel(l)
+}
+
 // Configure configures wireguard keys and listen port on the device.
 func (d *Device) Configure() error {
-	wg, err := wgctrl.New()
+	wg, err := NewClient(d.namespaces.Device)
 	if err != nil {
 		return err
 	}
@@ -100,12 +278,14 @@ func (d *Device) Configure() error {
 		"Configuring wireguard",
 		"device", d.deviceName,
 		"port", d.listenPort,
+		"fwMark", d.fwMark,
 		"pubKey", key.PublicKey(),
 	)
 	d.pubKey = key.PublicKey().String()
 	return wg.ConfigureDevice(d.deviceName, wgtypes.Config{
-		PrivateKey: &key,
-		ListenPort: &d.listenPort,
+		PrivateKey:   &key,
+		ListenPort:   &d.listenPort,
+		FirewallMark: &d.fwMark,
 	})
 }
 
@@ -133,6 +313,7 @@ func (d *Device) privateKey() (wgtypes.Key, error) {
 			if err := os.WriteFile(d.keyFilename, []byte(key.String()), 0600); err != nil {
 				return wgtypes.Key{}, err
 			}
+			d.keyGenerated = true
 			return key, nil
 		}
 		return wgtypes.Key{}, err
@@ -143,13 +324,18 @@ func (d *Device) privateKey() (wgtypes.Key, error) {
 // UpdateAddress will patch the device interface so it is assigned only the
 // given address.
 func (d *Device) UpdateAddress(address *net.IPNet) error {
-	h := netlink.Handle{}
+	h, err := handleAt(d.namespaces.Device)
+	if err != nil {
+		return err
+	}
 	defer h.Delete()
 	link, err := h.LinkByName(d.deviceName)
 	if err != nil {
 		return err
 	}
-	d.FlushAddresses()
+	if err := d.FlushAddresses(); err != nil {
+		return err
+	}
 	if err := h.AddrAdd(link, &netlink.Addr{IPNet: address}); err != nil {
 		return err
 	}
@@ -158,13 +344,19 @@ func (d *Device) UpdateAddress(address *net.IPNet) error {
 
 // FlushAddresses deletes all ips from the device network interface
 func (d *Device) FlushAddresses() error {
-	h := netlink.Handle{}
+	h, err := handleAt(d.namespaces.Device)
+	if err != nil {
+		return err
+	}
 	defer h.Delete()
 	link, err := h.LinkByName(d.deviceName)
 	if err != nil {
 		return err
 	}
-	ips, err := h.AddrList(link, 2)
+	ips, err := h.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return err
+	}
 	for _, ip := range ips {
 		if err := h.AddrDel(link, &ip); err != nil {
 			return err
@@ -175,7 +367,10 @@ func (d *Device) FlushAddresses() error {
 
 // EnsureLinkUp brings up the wireguard device.
 func (d *Device) EnsureLinkUp() error {
-	h := netlink.Handle{}
+	h, err := handleAt(d.namespaces.Device)
+	if err != nil {
+		return err
+	}
 	defer h.Delete()
 	link, err := h.LinkByName(d.deviceName)
 	if err != nil {
@@ -184,17 +379,227 @@ func (d *Device) EnsureLinkUp() error {
 	return h.LinkSetUp(link)
 }
 
-// AddRouteToNet adds a route to the passed subnet via the device
+// AddRouteToNet adds a route to the passed subnet via the device, using the
+// configured table, metric and source hint. Routes to the same subnet via the
+// device that do not match the current config are removed.
 func (d *Device) AddRouteToNet(subnet *net.IPNet) error {
-	h := netlink.Handle{}
+	h, err := handleAt(d.namespaces.Device)
+	if err != nil {
+		return err
+	}
 	defer h.Delete()
 	link, err := h.LinkByName(d.deviceName)
 	if err != nil {
 		return err
 	}
-	return h.RouteReplace(&netlink.Route{
+	route := &netlink.Route{
 		LinkIndex: link.Attrs().Index,
 		Dst:       subnet,
 		Scope:     netlink.SCOPE_LINK,
-	})
+		Table:     d.routes.Table,
+		Priority:  d.routes.Metric,
+		Src:       d.routes.Src,
+	}
+	if err := h.RouteReplace(route); err != nil {
+		return err
+	}
+	existing, err := h.RouteListFiltered(familyOf(subnet), &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       subnet,
+		Table:     unix.RT_TABLE_UNSPEC,
+	}, netlink.RT_FILTER_OIF|netlink.RT_FILTER_DST|netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return err
+	}
+	for _, r := range existing {
+		if routeTable(r.Table) == routeTable(route.Table) && r.Priority == route.Priority {
+			continue
+		}
+		log.Logger.Info("Deleting stale route", "device", d.deviceName, "route", r)
+		if err := h.RouteDel(&r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EnsureRuleToNet makes sure that an ip rule exists to look up the configured
+// route table for traffic destined to the passed subnet. If a firewall mark is
+// set on the device, another rule sends packets carrying it to the main table,
+// so that encapsulated traffic is not routed via the device. It is a no-op when
+// routes are added to the main table.
+func (d *Device) EnsureRuleToNet(subnet *net.IPNet) error {
+	if routeTable(d.routes.Table) == unix.RT_TABLE_MAIN {
+		return nil
+	}
+	h, err := handleAt(d.namespaces.Device)
+	if err != nil {
+		return err
+	}
+	defer h.Delete()
+	want := d.rulesToNet(subnet)
+	rules, err := h.RuleList(familyOf(subnet))
+	if err != nil {
+		return err
+	}
+	found := make([]bool, len(want))
+	for _, r := range rules {
+		if !d.isRuleToNet(r, subnet) {
+			continue
+		}
+		stale := true
+		for i, w := range want {
+			if r.Table == w.Table && r.Priority == w.Priority && r.Mark == w.Mark && r.Invert == w.Invert {
+				found[i] = true
+				stale = false
+			}
+		}
+		if !stale {
+			continue
+		}
+		log.Logger.Info("Deleting stale rule", "device", d.deviceName, "rule", r)
+		if err := h.RuleDel(&r); err != nil {
+			return err
+		}
+	}
+	for i, w := range want {
+		if found[i] {
+			continue
+		}
+		if err := h.RuleAdd(&w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rulesToNet returns the ip rules for traffic destined to the passed subnet.
+// The kernel inverts the whole selector of a rule, destination included, so
+// skipping packets that carry the firewall mark takes a separate rule to the
+// main table, one priority ahead of the rule to the configured table.
+func (d *Device) rulesToNet(subnet *net.IPNet) []netlink.Rule {
+	var rules []netlink.Rule
+	if d.fwMark != 0 {
+		rule := netlink.NewRule()
+		rule.Family = familyOf(subnet)
+		rule.Dst = subnet
+		rule.Table = unix.RT_TABLE_MAIN
+		rule.Priority = d.routes.RulePriority - 1
+		rule.Mark = uint32(d.fwMark)
+		rules = append(rules, *rule)
+	}
+	rule := netlink.NewRule()
+	rule.Family = familyOf(subnet)
+	rule.Dst = subnet
+	rule.Table = d.routes.Table
+	rule.Priority = d.routes.RulePriority
+	return append(rules, *rule)
+}
+
+// isRuleToNet returns true if the rule is one that EnsureRuleToNet would
+// manage for the passed subnet, including stale ones.
+func (d *Device) isRuleToNet(r netlink.Rule, subnet *net.IPNet) bool {
+	if r.Dst == nil || r.Dst.String() != subnet.String() {
+		return false
+	}
+	if r.Table == d.routes.Table {
+		return true
+	}
+	return r.Table == unix.RT_TABLE_MAIN && d.fwMark != 0 && r.Mark == uint32(d.fwMark)
+}
+
+// RemoveRouteToNet deletes the routes to the passed subnet via the device and
+// the ip rules to look up the configured route table for it.
+func (d *Device) RemoveRouteToNet(subnet *net.IPNet) error {
+	h, err := handleAt(d.namespaces.Device)
+	if err != nil {
+		return err
+	}
+	defer h.Delete()
+	link, err := h.LinkByName(d.deviceName)
+	if err != nil {
+		return err
+	}
+	routes, err := h.RouteListFiltered(familyOf(subnet), &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       subnet,
+		Table:     unix.RT_TABLE_UNSPEC,
+	}, netlink.RT_FILTER_OIF|netlink.RT_FILTER_DST|netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return err
+	}
+	for _, r := range routes {
+		log.Logger.Info("Deleting route", "device", d.deviceName, "route", r)
+		if err := h.RouteDel(&r); err != nil {
+			return err
+		}
+	}
+	if routeTable(d.routes.Table) == unix.RT_TABLE_MAIN {
+		return nil
+	}
+	rules, err := h.RuleList(familyOf(subnet))
+	if err != nil {
+		return err
+	}
+	for _, r := range rules {
+		if !d.isRuleToNet(r, subnet) {
+			continue
+		}
+		log.Logger.Info("Deleting rule", "device", d.deviceName, "rule", r)
+		if err := h.RuleDel(&r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// routeTable returns the table id the kernel will use for the passed value,
+// where 0 means the main table.
+func routeTable(table int) int {
+	if table == unix.RT_TABLE_UNSPEC {
+		return unix.RT_TABLE_MAIN
+	}
+	return table
+}
+
+func familyOf(subnet *net.IPNet) int {
+	if subnet.IP.To4() != nil {
+		return netlink.FAMILY_V4
+	}
+	return netlink.FAMILY_V6
+}
+
+// Peers returns the peers currently configured on the device, along with
+// their handshake and transfer stats.
+func (d *Device) Peers() ([]wgtypes.Peer, error) {
+	wg, err := NewClient(d.namespaces.Device)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := wg.Close(); err != nil {
+			log.Logger.Error(
+				"Failed to close wireguard client", "err", err)
+		}
+	}()
+	device, err := wg.Device(d.deviceName)
+	if err != nil {
+		return nil, err
+	}
+	return device.Peers, nil
+}
+
+// SetPeers updates the device's peers list to match the passed one.
+func (d *Device) SetPeers(peers []wgtypes.PeerConfig) error {
+	wg, err := NewClient(d.namespaces.Device)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := wg.Close(); err != nil {
+			log.Logger.Error(
+				"Failed to close wireguard client", "err", err)
+		}
+	}()
+	return setPeers(wg, d.deviceName, peers)
 }
@@ -0,0 +1,44 @@
+package wireguard
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestRulesToNet(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.2.0.0/16")
+	d := &Device{deviceName: "wireguard.r1", routes: RouteConfig{Table: 100, RulePriority: 1000}}
+	rules := d.rulesToNet(subnet)
+	if len(rules) != 1 {
+		t.Fatalf("rulesToNet: expected 1 rule without fwmark, got %d", len(rules))
+	}
+	if r := rules[0]; r.Table != 100 || r.Priority != 1000 || r.Dst.String() != "10.2.0.0/16" || r.Mark != 0 || r.Invert {
+		t.Errorf("rulesToNet: unexpected rule without fwmark: %v", r)
+	}
+
+	d.fwMark = 51820
+	rules = d.rulesToNet(subnet)
+	if len(rules) != 2 {
+		t.Fatalf("rulesToNet: expected 2 rules with fwmark, got %d", len(rules))
+	}
+	// Marked packets are matched first and sent to the main table
+	if r := rules[0]; r.Table != unix.RT_TABLE_MAIN || r.Priority != 999 || r.Dst.String() != "10.2.0.0/16" || r.Mark != 51820 || r.Invert {
+		t.Errorf("rulesToNet: unexpected fwmark rule: %v", r)
+	}
+	if r := rules[1]; r.Table != 100 || r.Priority != 1000 || r.Dst.String() != "10.2.0.0/16" || r.Mark != 0 || r.Invert {
+		t.Errorf("rulesToNet: unexpected table rule with fwmark: %v", r)
+	}
+	for _, r := range rules {
+		if !d.isRuleToNet(r, subnet) {
+			t.Errorf("isRuleToNet: expected generated rule %v to be managed", r)
+		}
+	}
+	// A rule to the main table for another mark is not ours
+	other := rules[0]
+	other.Mark = 1
+	if d.isRuleToNet(other, subnet) {
+		t.Errorf("isRuleToNet: expected rule for another fwmark not to be managed")
+	}
+}
@@ -0,0 +1,74 @@
+package wireguard
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/utilitywarehouse/semaphore-wireguard/log"
+)
+
+const (
+	// WireGuard encapsulation overhead: outer IP header, UDP header (8 bytes)
+	// and WireGuard data message header and authentication tag (32 bytes).
+	overheadIPv4 = 20 + 8 + 32
+	overheadIPv6 = 40 + 8 + 32
+)
+
+// mtuForUnderlay returns the maximum device MTU for the passed underlay
+// interface MTU and endpoint address family.
+func mtuForUnderlay(underlayMTU int, ip net.IP) int {
+	if ip.To4() != nil {
+		return underlayMTU - overheadIPv4
+	}
+	return underlayMTU - overheadIPv6
+}
+
+// EndpointsMTU returns the largest device MTU that fits the egress interfaces
+// towards the passed endpoints, as seen from the device's socket network
+// namespace. Endpoints without a route are skipped with a warning, so that one
+// unreachable peer does not block the others. It returns 0 if no endpoint has
+// a route.
+func (d *Device) EndpointsMTU(endpoints []net.IP) (int, error) {
+	h, err := handleAt(d.namespaces.Socket)
+	if err != nil {
+		return 0, err
+	}
+	defer h.Delete()
+	return minEndpointsMTU(endpoints, func(ip net.IP) (int, error) {
+		routes, err := h.RouteGet(ip)
+		if err != nil {
+			return 0, fmt.Errorf("Cannot get route to %s: %v", ip, err)
+		}
+		if len(routes) == 0 {
+			return 0, fmt.Errorf("No route to %s", ip)
+		}
+		link, err := h.LinkByIndex(routes[0].LinkIndex)
+		if err != nil {
+			return 0, err
+		}
+		underlayMTU := link.Attrs().MTU
+		// Routes may carry a lower MTU than the interface
+		if routes[0].MTU != 0 && routes[0].MTU < underlayMTU {
+			underlayMTU = routes[0].MTU
+		}
+		return underlayMTU, nil
+	}, d.deviceName), nil
+}
+
+// minEndpointsMTU returns the smallest device MTU for the underlay MTUs
+// towards the endpoints, skipping the endpoints whose underlay MTU cannot be
+// determined.
+func minEndpointsMTU(endpoints []net.IP, underlayMTU func(net.IP) (int, error), deviceName string) int {
+	mtu := 0
+	for _, ip := range endpoints {
+		u, err := underlayMTU(ip)
+		if err != nil {
+			log.Logger.Warn("Skipping endpoint for device MTU", "device", deviceName, "endpoint", ip, "err", err)
+			continue
+		}
+		if m := mtuForUnderlay(u, ip); mtu == 0 || m < mtu {
+			mtu = m
+		}
+	}
+	return mtu
+}
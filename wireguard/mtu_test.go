@@ -0,0 +1,39 @@
+package wireguard
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/utilitywarehouse/semaphore-wireguard/log"
+)
+
+func TestMTUForUnderlay(t *testing.T) {
+	if mtu := mtuForUnderlay(1500, net.ParseIP("10.0.0.1")); mtu != 1440 {
+		t.Errorf("mtuForUnderlay: expected 1440 for ipv4 endpoint, got %d", mtu)
+	}
+	if mtu := mtuForUnderlay(1500, net.ParseIP("fd00::1")); mtu != 1420 {
+		t.Errorf("mtuForUnderlay: expected 1420 for ipv6 endpoint, got %d", mtu)
+	}
+	if mtu := mtuForUnderlay(9001, net.ParseIP("10.0.0.1")); mtu != 8941 {
+		t.Errorf("mtuForUnderlay: expected 8941 for jumbo frames underlay, got %d", mtu)
+	}
+}
+
+func TestMinEndpointsMTU(t *testing.T) {
+	log.InitLogger("mtu-test", "info")
+	underlay := map[string]int{"10.0.0.1": 9001, "10.0.0.2": 1500}
+	underlayMTU := func(ip net.IP) (int, error) {
+		if mtu, ok := underlay[ip.String()]; ok {
+			return mtu, nil
+		}
+		return 0, errors.New("no route")
+	}
+	endpoints := []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.3"), net.ParseIP("10.0.0.2")}
+	if mtu := minEndpointsMTU(endpoints, underlayMTU, "wireguard.r1"); mtu != 1440 {
+		t.Errorf("minEndpointsMTU: expected 1440 skipping the endpoint without a route, got %d", mtu)
+	}
+	if mtu := minEndpointsMTU([]net.IP{net.ParseIP("10.0.0.3")}, underlayMTU, "wireguard.r1"); mtu != 0 {
+		t.Errorf("minEndpointsMTU: expected 0 without routes, got %d", mtu)
+	}
+}
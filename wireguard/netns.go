@@ -0,0 +1,88 @@
+package wireguard
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.zx2c4.com/wireguard/wgctrl"
+
+	"github.com/utilitywarehouse/semaphore-wireguard/log"
+)
+
+// Namespaces holds paths to the network namespaces (e.g.
+// /var/run/netns/<name>) that the device and its UDP socket live in. Devices
+// are created in the socket namespace and then moved to the device namespace,
+// so that the UDP socket stays in the namespace the device was created in.
+// Empty paths refer to the namespace of the process.
+type Namespaces struct {
+	Device string
+	Socket string
+}
+
+// InDevice runs fn in the device namespace, like doInNetNS.
+func (n Namespaces) InDevice(fn func() error) error {
+	return doInNetNS(n.Device, fn)
+}
+
+// handleAt returns a netlink handle for the namespace at path.
+func handleAt(path string) (*netlink.Handle, error) {
+	if path == "" {
+		return netlink.NewHandle()
+	}
+	ns, err := netns.GetFromPath(path)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get network namespace %s: %v", path, err)
+	}
+	defer ns.Close()
+	return netlink.NewHandleAt(ns)
+}
+
+// doInNetNS runs fn with the calling goroutine locked to an OS thread that is
+// switched to the namespace at path. Sockets opened by fn stay in that
+// namespace after it returns.
+func doInNetNS(path string, fn func() error) error {
+	if path == "" {
+		return fn()
+	}
+	runtime.LockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("Cannot get current network namespace: %v", err)
+	}
+	defer origin.Close()
+	target, err := netns.GetFromPath(path)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("Cannot get network namespace %s: %v", path, err)
+	}
+	defer target.Close()
+	if err := netns.Set(target); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("Cannot switch to network namespace %s: %v", path, err)
+	}
+	defer func() {
+		if err := netns.Set(origin); err != nil {
+			// Leave the thread locked, so that it is terminated
+			// instead of being reused in the wrong namespace.
+			log.Logger.Error("Cannot switch back to original network namespace", "err", err)
+			return
+		}
+		runtime.UnlockOSThread()
+	}()
+	return fn()
+}
+
+// NewClient returns a wgctrl client that operates on the devices in the
+// namespace at path.
+func NewClient(path string) (*wgctrl.Client, error) {
+	var wg *wgctrl.Client
+	err := doInNetNS(path, func() error {
+		var err error
+		wg, err = wgctrl.New()
+		return err
+	})
+	return wg, err
+}
@@ -0,0 +1,88 @@
+package wireguard
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+
+	"github.com/utilitywarehouse/semaphore-wireguard/log"
+)
+
+func TestDoInNetNS(t *testing.T) {
+	called := false
+	if err := doInNetNS("", func() error {
+		called = true
+		return nil
+	}); err != nil || !called {
+		t.Errorf("doInNetNS: expected fn to run in the current namespace, got called=%v, err=%v", called, err)
+	}
+	missing := filepath.Join(t.TempDir(), "missing")
+	if err := doInNetNS(missing, func() error {
+		t.Errorf("doInNetNS: fn should not run in a missing namespace")
+		return nil
+	}); err == nil {
+		t.Errorf("doInNetNS: expected an error for a missing namespace")
+	}
+	if _, err := handleAt(missing); err == nil {
+		t.Errorf("handleAt: expected an error for a missing namespace")
+	}
+}
+
+// TestAddLinkMovesDevice creates a kernel device in the process' namespace and
+// checks that it is moved to the device namespace. It needs root and the
+// wireguard kernel module, and is skipped otherwise.
+func TestAddLinkMovesDevice(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("requires root")
+	}
+	log.InitLogger("wireguard-test", "info")
+	name := fmt.Sprintf("swg-test-%d", os.Getpid())
+	runtime.LockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		t.Fatalf("cannot get current network namespace: %v", err)
+	}
+	// NewNamed also switches the thread to the new namespace
+	ns, err := netns.NewNamed(name)
+	if err != nil {
+		origin.Close()
+		runtime.UnlockOSThread()
+		t.Skipf("cannot create network namespace: %v", err)
+	}
+	if err := netns.Set(origin); err != nil {
+		t.Fatalf("cannot switch back to original network namespace: %v", err)
+	}
+	runtime.UnlockOSThread()
+	origin.Close()
+	ns.Close()
+	defer netns.DeleteNamed(name)
+
+	path := filepath.Join("/var/run/netns", name)
+	d := NewDevice("swgtest0", "", 0, 0, 0, RouteConfig{}, ImplementationKernel, Namespaces{Device: path})
+	if err := d.addLink(); err != nil {
+		if errors.Is(err, unix.EOPNOTSUPP) {
+			t.Skip("kernel does not support wireguard")
+		}
+		t.Fatalf("addLink: %v", err)
+	}
+	h, err := handleAt(path)
+	if err != nil {
+		t.Fatalf("handleAt: %v", err)
+	}
+	defer h.Delete()
+	if _, err := h.LinkByName("swgtest0"); err != nil {
+		t.Errorf("expected the device in the device namespace: %v", err)
+	}
+	if l, err := netlink.LinkByName("swgtest0"); err == nil {
+		netlink.LinkDel(l)
+		t.Errorf("expected the device to be moved out of the process' namespace")
+	}
+}
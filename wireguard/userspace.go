@@ -0,0 +1,86 @@
+package wireguard
+
+import (
+	"fmt"
+	"net"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/ipc"
+	"golang.zx2c4.com/wireguard/tun"
+
+	"github.com/utilitywarehouse/semaphore-wireguard/log"
+)
+
+// Implementations of the wireguard device.
+const (
+	// ImplementationAuto uses the kernel module and falls back to userspace
+	// if the kernel does not support wireguard.
+	ImplementationAuto      = "auto"
+	ImplementationKernel    = "kernel"
+	ImplementationUserspace = "userspace"
+)
+
+// ValidImplementation returns true if the implementation is known.
+func ValidImplementation(implementation string) bool {
+	switch implementation {
+	case ImplementationAuto, ImplementationKernel, ImplementationUserspace:
+		return true
+	}
+	return false
+}
+
+// userspaceDevice is an embedded wireguard-go device. It listens on the UAPI
+// socket for the device name, so that wgctrl can configure and query it the
+// same way as a kernel device.
+type userspaceDevice struct {
+	device *device.Device
+	uapi   net.Listener
+}
+
+func startUserspaceDevice(name string, mtu int) (*userspaceDevice, error) {
+	tdev, err := tun.CreateTUN(name, mtu)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create tun device: %v", err)
+	}
+	logger := &device.Logger{
+		Verbosef: func(format string, args ...any) {
+			log.Logger.Debug(fmt.Sprintf(format, args...), "device", name)
+		},
+		Errorf: func(format string, args ...any) {
+			log.Logger.Error(fmt.Sprintf(format, args...), "device", name)
+		},
+	}
+	dev := device.NewDevice(tdev, conn.NewDefaultBind(), logger)
+	fileUAPI, err := ipc.UAPIOpen(name)
+	if err != nil {
+		dev.Close()
+		return nil, fmt.Errorf("Failed to open uapi socket file: %v", err)
+	}
+	uapi, err := ipc.UAPIListen(name, fileUAPI)
+	if err != nil {
+		fileUAPI.Close()
+		dev.Close()
+		return nil, fmt.Errorf("Failed to listen on uapi socket: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := uapi.Accept()
+			if err != nil {
+				log.Logger.Debug("Stopped accepting uapi connections", "device", name, "err", err)
+				return
+			}
+			go dev.IpcHandle(conn)
+		}
+	}()
+	log.Logger.Info("Started userspace wireguard device", "device", name)
+	return &userspaceDevice{device: dev, uapi: uapi}, nil
+}
+
+// Close stops the uapi listener and the device, which removes the tun
+// interface.
+func (u *userspaceDevice) Close() error {
+	err := u.uapi.Close()
+	u.device.Close()
+	return err
+}
@@ -0,0 +1,51 @@
+package wireguard
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestFallbackToUserspace(t *testing.T) {
+	notSupported := fmt.Errorf("link add: %w", unix.EOPNOTSUPP)
+	if !fallbackToUserspace(ImplementationAuto, notSupported) {
+		t.Errorf("fallbackToUserspace: expected auto to fall back when the kernel does not support wireguard")
+	}
+	if fallbackToUserspace(ImplementationKernel, notSupported) {
+		t.Errorf("fallbackToUserspace: expected kernel not to fall back")
+	}
+	if fallbackToUserspace(ImplementationAuto, errors.New("permission denied")) {
+		t.Errorf("fallbackToUserspace: expected auto not to fall back on other errors")
+	}
+}
+
+func TestCheckUserspace(t *testing.T) {
+	if err := checkUserspace(Namespaces{}); err != nil {
+		t.Errorf("checkUserspace: unexpected error: %v", err)
+	}
+	for _, ns := range []Namespaces{{Device: "/var/run/netns/wg"}, {Socket: "/var/run/netns/wg"}} {
+		if err := checkUserspace(ns); err == nil {
+			t.Errorf("checkUserspace: expected an error for namespaces %+v", ns)
+		}
+	}
+	// Userspace devices are rejected before anything is started
+	d := NewDevice("wireguard.r1", "", 0, 0, 0, RouteConfig{}, ImplementationUserspace, Namespaces{Device: "/var/run/netns/wg"})
+	if err := d.runUserspace(); err == nil {
+		t.Errorf("runUserspace: expected an error with a network namespace")
+	}
+}
+
+func TestValidImplementation(t *testing.T) {
+	for _, impl := range []string{ImplementationAuto, ImplementationKernel, ImplementationUserspace} {
+		if !ValidImplementation(impl) {
+			t.Errorf("ValidImplementation: expected %q to be valid", impl)
+		}
+	}
+	for _, impl := range []string{"", "wireguard-go"} {
+		if ValidImplementation(impl) {
+			t.Errorf("ValidImplementation: expected %q to be invalid", impl)
+		}
+	}
+}
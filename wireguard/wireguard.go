@@ -6,23 +6,20 @@ import (
 
 	"golang.zx2c4.com/wireguard/wgctrl"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
-
-	"github.com/utilitywarehouse/semaphore-wireguard/log"
 )
 
-const (
-	defaultPersistentKeepaliveInterval = 25 * time.Second
-	defaultWireguardDeviceName         = "wireguard"
-)
+// DefaultPersistentKeepaliveInterval is the keepalive interval used for peers
+// unless configured otherwise.
+const DefaultPersistentKeepaliveInterval = 25 * time.Second
 
-// NewPeerConfig constructs and returns a wgtypes PeerConfig object.
-func NewPeerConfig(publicKey string, presharedKey string, endpoint string, allowedIPs []string) (*wgtypes.PeerConfig, error) {
+// NewPeerConfig constructs and returns a wgtypes PeerConfig object. A zero
+// persistentKeepalive disables keepalives for the peer.
+func NewPeerConfig(publicKey string, presharedKey string, endpoint string, allowedIPs []string, persistentKeepalive time.Duration) (*wgtypes.PeerConfig, error) {
 	key, err := wgtypes.ParseKey(publicKey)
 	if err != nil {
 		return nil, err
 	}
-	t := defaultPersistentKeepaliveInterval
-	peer := &wgtypes.PeerConfig{PublicKey: key, PersistentKeepaliveInterval: &t}
+	peer := &wgtypes.PeerConfig{PublicKey: key, PersistentKeepaliveInterval: &persistentKeepalive}
 	if presharedKey != "" {
 		key, err := wgtypes.ParseKey(presharedKey)
 		if err != nil {
@@ -31,7 +28,7 @@ func NewPeerConfig(publicKey string, presharedKey string, endpoint string, allow
 		peer.PresharedKey = &key
 	}
 	if endpoint != "" {
-		addr, err := net.ResolveUDPAddr("udp4", endpoint)
+		addr, err := net.ResolveUDPAddr("udp", endpoint)
 		if err != nil {
 			return nil, err
 		}
@@ -47,22 +44,9 @@ func NewPeerConfig(publicKey string, presharedKey string, endpoint string, allow
 	return peer, nil
 }
 
-// SetPeers takes a device name and a list of peers and updates the device's
+// setPeers takes a device name and a list of peers and updates the device's
 // peers list to match the passed one.
-func SetPeers(deviceName string, peers []wgtypes.PeerConfig) error {
-	wg, err := wgctrl.New()
-	if err != nil {
-		return err
-	}
-	defer func() {
-		if err := wg.Close(); err != nil {
-			log.Logger.Error(
-				"Failed to close wireguard client", "err", err)
-		}
-	}()
-	if deviceName == "" {
-		deviceName = defaultWireguardDeviceName
-	}
+func setPeers(wg *wgctrl.Client, deviceName string, peers []wgtypes.PeerConfig) error {
 	device, err := wg.Device(deviceName)
 	if err != nil {
 		return err
@@ -11,28 +11,41 @@ var (
 
 func TestNewPeerConfig(t *testing.T) {
 	var err error
-	_, err = NewPeerConfig("", "", "", nil)
+	_, err = NewPeerConfig("", "", "", nil, DefaultPersistentKeepaliveInterval)
 	if err == nil {
 		t.Errorf("NewPeerConfig: empty publicKey should generate an error")
 	}
-	_, err = NewPeerConfig("foobar", "", "", nil)
+	_, err = NewPeerConfig("foobar", "", "", nil, DefaultPersistentKeepaliveInterval)
 	if err == nil {
 		t.Errorf("NewPeerConfig: invalid publicKey should generate an error")
 	}
-	_, err = NewPeerConfig(validPublicKey, "", "", []string{""})
+	_, err = NewPeerConfig(validPublicKey, "", "", []string{""}, DefaultPersistentKeepaliveInterval)
 	if err == nil {
 		t.Errorf("NewPeerConfig: invalid allowedIPs should generate an error")
 	}
-	_, err = NewPeerConfig(validPublicKey, "foo", "", validAllowedIPs)
+	_, err = NewPeerConfig(validPublicKey, "foo", "", validAllowedIPs, DefaultPersistentKeepaliveInterval)
 	if err == nil {
 		t.Errorf("NewPeerConfig: invalid presharedKey should generate an error")
 	}
-	_, err = NewPeerConfig(validPublicKey, validPublicKey, "foo", validAllowedIPs)
+	_, err = NewPeerConfig(validPublicKey, validPublicKey, "foo", validAllowedIPs, DefaultPersistentKeepaliveInterval)
 	if err == nil {
 		t.Errorf("NewPeerConfig: invalid endpoint should generate an error")
 	}
-	_, err = NewPeerConfig(validPublicKey, validPublicKey, "1.1.1.1:1111", validAllowedIPs)
+	_, err = NewPeerConfig(validPublicKey, validPublicKey, "1.1.1.1:1111", validAllowedIPs, DefaultPersistentKeepaliveInterval)
 	if err != nil {
 		t.Errorf("NewPeerConfig: unexpected error: %v", err)
 	}
+	pc, err := NewPeerConfig(validPublicKey, "", "[2001:db8::1]:1111", validAllowedIPs, DefaultPersistentKeepaliveInterval)
+	if err != nil {
+		t.Errorf("NewPeerConfig: unexpected error for IPv6 endpoint: %v", err)
+	} else if pc.Endpoint.IP.String() != "2001:db8::1" {
+		t.Errorf("NewPeerConfig: expected IPv6 endpoint, got %v", pc.Endpoint)
+	}
+	pc, err = NewPeerConfig(validPublicKey, "", "1.1.1.1:1111", validAllowedIPs, 0)
+	if err != nil {
+		t.Errorf("NewPeerConfig: unexpected error: %v", err)
+	}
+	if *pc.PersistentKeepaliveInterval != 0 {
+		t.Errorf("NewPeerConfig: expected disabled persistent keepalive, got %v", *pc.PersistentKeepaliveInterval)
+	}
 }